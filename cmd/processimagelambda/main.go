@@ -2,32 +2,128 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"strings"
 
+	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 
+	"github.com/mikarios/golib/logger"
+
+	"github.com/mikarios/imageresizer/internal/constants"
 	"github.com/mikarios/imageresizer/internal/imagehelper"
+	"github.com/mikarios/imageresizer/internal/services/cdnservice"
+	"github.com/mikarios/imageresizer/internal/services/config"
+	"github.com/mikarios/imageresizer/pkg/dtos/imagedto"
 )
 
+const sqsEventSource = "aws:sqs"
+
 var errImageProcess = errors.New("image process error")
 
+// sqsBatchResponse reports the messages of an SQS batch that failed, so that only those are received again. The
+// function's event source mapping has to enable ReportBatchItemFailures.
+type sqsBatchResponse struct {
+	BatchItemFailures []sqsBatchItemFailure `json:"batchItemFailures"`
+}
+
+type sqsBatchItemFailure struct {
+	ItemIdentifier string `json:"itemIdentifier"`
+}
+
 func main() {
-	lambda.Start(Handler)
+	createServicesNeeded()
+	lambda.Start(handle)
 }
 
-func Handler(ctx context.Context, job *imagehelper.ImageJob) error {
-	collected := imagehelper.ProcessJobImage(ctx, job)
+// createServicesNeeded initialises the config and the cdn the image jobs are processed with.
+func createServicesNeeded() {
+	cfg := config.Init("", constants.ServerTypes.ImageResizer)
 
-	if len(collected) > 0 {
-		s := make([]string, len(collected))
+	if err := logger.SetFormatter(cfg.LOG.Format); err != nil {
+		logger.Panic(context.Background(), err)
+	}
+
+	cdnservice.Init(
+		cfg.CDN.Bucket,
+		cfg.CDN.Key,
+		cfg.CDN.Secret,
+		cfg.CDN.Endpoint,
+		cfg.CDN.Region,
+		cfg.CDN.PublicURL,
+		cfg.CDN.ListingCacheTTL,
+	)
+}
+
+// handle serves both the image jobs the server invokes the function with and the batches of SQS jobs.
+func handle(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+	event := &events.SQSEvent{}
+	if err := json.Unmarshal(payload, event); err == nil &&
+		len(event.Records) > 0 && event.Records[0].EventSource == sqsEventSource {
+		return SQSHandler(ctx, event)
+	}
+
+	job := &imagehelper.ImageJob{}
+	if err := json.Unmarshal(payload, job); err != nil {
+		return nil, err
+	}
+
+	return Handler(ctx, job)
+}
+
+// Handler processes the image job the server invokes the function with. The errors of the image are part of the
+// result, not a failure of the function, so that the server also learns what was stored before they occurred.
+func Handler(ctx context.Context, job *imagehelper.ImageJob) (*imagehelper.ProcessResult, error) {
+	return imagehelper.NewProcessResult(job, imagehelper.ProcessJobImage(ctx, job)), nil
+}
 
-		for i, e := range collected {
-			s[i] = e.Error()
+// SQSHandler processes every ImageProcessJobData of the batch and reports the ones that failed.
+func SQSHandler(ctx context.Context, event *events.SQSEvent) (*sqsBatchResponse, error) {
+	resp := &sqsBatchResponse{BatchItemFailures: make([]sqsBatchItemFailure, 0)}
+
+	for i := range event.Records {
+		record := &event.Records[i]
+
+		if err := processJob(ctx, record.Body); err != nil {
+			logger.Error(ctx, err, "could not process job", record.MessageId)
+
+			resp.BatchItemFailures = append(resp.BatchItemFailures, sqsBatchItemFailure{ItemIdentifier: record.MessageId})
+		}
+	}
+
+	return resp, nil
+}
+
+func processJob(ctx context.Context, body string) error {
+	data := &imagedto.ImageProcessJobData{}
+	if err := json.Unmarshal([]byte(body), data); err != nil {
+		return fmt.Errorf("could not decode job: %w", err)
+	}
+
+	tmpl, err := imagehelper.ResolvePathTemplate(data.PathTemplate)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := imagehelper.WithJobDeadline(ctx, data)
+	defer cancel()
+
+	collected := make([]string, 0)
+
+	for _, job := range imagehelper.NewImageJobs(data, tmpl.String(), nil) {
+		imageCtx, cancelImage := imagehelper.WithImageTimeout(ctx, data)
+
+		for _, e := range imagehelper.ProcessJobImage(imageCtx, job) {
+			collected = append(collected, e.Error())
 		}
 
-		return imageProcessError(strings.Join(s, "|"))
+		cancelImage()
+	}
+
+	if len(collected) > 0 {
+		return imageProcessError(strings.Join(collected, "|"))
 	}
 
 	return nil
@@ -0,0 +1,64 @@
+// nolint:testpackage // access to internal functions needed
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/mikarios/imageresizer/internal/imagehelper"
+)
+
+// sqsEvent is a batch as the SQS event source mapping invokes the function with.
+const sqsEvent = `{"Records": [
+	{"messageId": "ok", "eventSource": "aws:sqs", "body": "{\"shopID\": 1}"},
+	{"messageId": "undecodable", "eventSource": "aws:sqs", "body": "not a job"},
+	{"messageId": "unsafe", "eventSource": "aws:sqs", "body": "{\"shopID\": 1, \"images\": [{\"name\": \"../x\"}]}"}
+]}`
+
+func TestSQSHandler_PartialBatchFailure(t *testing.T) {
+	t.Setenv("DEV", "true")
+	t.Setenv("LOG_FORMAT", "json")
+	createServicesNeeded()
+
+	resp, err := handle(context.Background(), json.RawMessage(sqsEvent))
+	if err != nil {
+		t.Fatalf("handle() error = %v, want the failures reported per message", err)
+	}
+
+	batch, ok := resp.(*sqsBatchResponse)
+	if !ok {
+		t.Fatalf("handle() = %T, want a batch response", resp)
+	}
+
+	want := []string{"undecodable", "unsafe"}
+	if len(batch.BatchItemFailures) != len(want) {
+		t.Fatalf("got failures %+v, want %v", batch.BatchItemFailures, want)
+	}
+
+	for i, failure := range batch.BatchItemFailures {
+		if failure.ItemIdentifier != want[i] {
+			t.Errorf("failure %d = %s, want %s", i, failure.ItemIdentifier, want[i])
+		}
+	}
+}
+
+func TestHandle_ImageJob(t *testing.T) {
+	t.Setenv("DEV", "true")
+	t.Setenv("LOG_FORMAT", "json")
+	createServicesNeeded()
+
+	resp, err := handle(context.Background(), json.RawMessage(`{"shopID": 1, "name": "../x", "url": "x"}`))
+	if err != nil {
+		t.Fatalf("handle() error = %v, want the failure in the result", err)
+	}
+
+	res, ok := resp.(*imagehelper.ProcessResult)
+	if !ok {
+		t.Fatalf("handle() = %T, want a process result", resp)
+	}
+
+	if len(res.Errors) != 1 || len(res.StoredKeys) != 0 || res.StoredBytes != 0 {
+		t.Errorf("handle() = %+v, want one error and nothing stored", res)
+	}
+}
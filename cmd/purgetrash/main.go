@@ -0,0 +1,54 @@
+// Command purgetrash permanently deletes the files that have been in the cdn trash folder for longer than the
+// configured retention. It is meant to be run periodically, e.g. from cron.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/mikarios/golib/logger"
+
+	"github.com/mikarios/imageresizer/internal/constants"
+	"github.com/mikarios/imageresizer/internal/services/cdnservice"
+	"github.com/mikarios/imageresizer/internal/services/config"
+)
+
+func main() {
+	ctx := context.Background()
+	cfg := config.Init("", constants.ServerTypes.ImageResizer)
+
+	dryRun := flag.Bool("dry-run", false, "only list the files that would be purged")
+	retention := flag.Duration("retention", cfg.CDN.TrashRetention, "purge files trashed longer than this ago, 0 never")
+	flag.Parse()
+
+	if err := logger.SetFormatter(cfg.LOG.Format); err != nil {
+		logger.Panic(ctx, err)
+	}
+
+	if *retention <= 0 {
+		logger.Info(ctx, "no trash retention configured, keeping the trash")
+		return
+	}
+
+	cdn := cdnservice.Init(
+		cfg.CDN.Bucket,
+		cfg.CDN.Key,
+		cfg.CDN.Secret,
+		cfg.CDN.Endpoint,
+		cfg.CDN.Region,
+		cfg.CDN.PublicURL,
+		cfg.CDN.ListingCacheTTL,
+	)
+
+	keys, err := cdn.PurgeTrash(ctx, "", cfg.CDN.TrashFolder, *retention, *dryRun)
+	for _, key := range keys {
+		fmt.Println(key)
+	}
+
+	if err != nil {
+		logger.Panic(ctx, err, "could not purge trash")
+	}
+
+	logger.Info(ctx, fmt.Sprintf("purged %d files from %s (dry run: %v)", len(keys), cfg.CDN.TrashFolder, *dryRun))
+}
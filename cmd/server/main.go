@@ -19,6 +19,7 @@ import (
 	"github.com/mikarios/imageresizer/internal/services/cdnservice"
 	"github.com/mikarios/imageresizer/internal/services/config"
 	"github.com/mikarios/imageresizer/internal/services/imageservice"
+	"github.com/mikarios/imageresizer/internal/services/stateservice"
 	"github.com/mikarios/imageresizer/pkg/dtos/imagedto"
 	"github.com/mikarios/imageresizer/pkg/queueservice"
 )
@@ -70,9 +71,9 @@ func startListenerForJobs() {
 			QueueJob: job,
 			Data:     &imagedto.ImageProcessJobData{},
 		}
-		if err = json.Unmarshal(job.Body, &imageJob.Data); err != nil {
-			logger.Error(context.Background(), err, "could not unmarshal imageJob", job.Body)
-			_ = job.Nack(false, false)
+		if err = json.Unmarshal(job.Body(), &imageJob.Data); err != nil {
+			logger.Error(context.Background(), err, "could not unmarshal imageJob", job.Body())
+			_ = job.Reject()
 
 			continue
 		}
@@ -84,7 +85,16 @@ func startListenerForJobs() {
 }
 
 func createServicesNeeded(cfg *config.Config) {
-	cdnservice.Init(cfg.CDN.Bucket, cfg.CDN.Key, cfg.CDN.Secret, cfg.CDN.Endpoint, cfg.CDN.Region)
+	cdnservice.Init(
+		cfg.CDN.Bucket,
+		cfg.CDN.Key,
+		cfg.CDN.Secret,
+		cfg.CDN.Endpoint,
+		cfg.CDN.Region,
+		cfg.CDN.PublicURL,
+		cfg.CDN.ListingCacheTTL,
+	)
+	stateservice.Init(&cfg.StateConfig)
 	imageservice.Init()
 	queueservice.Init(true, true, false, false)
 }
@@ -92,6 +102,7 @@ func createServicesNeeded(cfg *config.Config) {
 func destroyServices() {
 	queueservice.Destroy()
 	imageservice.Destroy()
+	stateservice.Destroy()
 }
 
 func startHTTPServer(bgCTX context.Context) *http.Server {
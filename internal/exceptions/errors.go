@@ -12,4 +12,18 @@ var (
 	ErrInvalidJobPriority    = errors.New("INVALID_JOB_PRIORITY")
 	ErrUnauthorised          = errors.New("UNAUTHORISED")
 	ErrInternalServerError   = errors.New("INTERNAL_SERVER_ERROR")
+	ErrEmptyDesiredSet       = errors.New("EMPTY_DESIRED_SET")
+	ErrInvalidShopID         = errors.New("INVALID_SHOP_ID")
+	ErrTooManyObjects        = errors.New("TOO_MANY_OBJECTS")
+	ErrInvalidDeletePath     = errors.New("INVALID_DELETE_PATH")
+	ErrInvalidUpload         = errors.New("INVALID_UPLOAD")
+	ErrInvalidTransformation = errors.New("INVALID_TRANSFORMATION")
+	ErrNotFound              = errors.New("NOT_FOUND")
+	ErrInvalidJob            = errors.New("INVALID_JOB")
+	ErrInvalidJobState       = errors.New("INVALID_JOB_STATE")
+	ErrJobCancelled          = errors.New("JOB_CANCELLED")
+	ErrJobDeadlineExceeded   = errors.New("JOB_DEADLINE_EXCEEDED")
+	ErrImageTimeout          = errors.New("IMAGE_TIMEOUT")
+	ErrQuotaExceeded         = errors.New("QUOTA_EXCEEDED")
+	ErrIdempotencyKeyReused  = errors.New("IDEMPOTENCY_KEY_REUSED")
 )
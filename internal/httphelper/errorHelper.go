@@ -9,6 +9,7 @@ import (
 	"github.com/mikarios/golib/logger"
 
 	"github.com/mikarios/imageresizer/internal/exceptions"
+	"github.com/mikarios/imageresizer/internal/pathtemplate"
 )
 
 func LogAndRespondErr(ctx context.Context, w http.ResponseWriter, httpError, err error, logMessages ...interface{}) {
@@ -27,10 +28,31 @@ func respondWithError(ctx context.Context, w http.ResponseWriter, err error) {
 	errResp := &ErrResp{Error: err.Error(), TransactionID: transactionID}
 
 	switch {
-	case oneOf(err, exceptions.ErrInvalidJobPriority):
+	case oneOf(
+		err,
+		exceptions.ErrInvalidJobPriority,
+		exceptions.ErrEmptyDesiredSet,
+		exceptions.ErrInvalidShopID,
+		exceptions.ErrTooManyObjects,
+		exceptions.ErrInvalidDeletePath,
+		exceptions.ErrNotImplemented,
+		exceptions.ErrInvalidUpload,
+		exceptions.ErrInvalidImageSize,
+		exceptions.ErrInvalidTransformation,
+		exceptions.ErrInvalidJob,
+		exceptions.ErrInvalidJobState,
+		pathtemplate.ErrInvalidTemplate,
+		pathtemplate.ErrInvalidValue,
+	):
 		RespondJSON(ctx, w, http.StatusBadRequest, errResp)
+	case oneOf(err, exceptions.ErrNotFound):
+		RespondJSON(ctx, w, http.StatusNotFound, errResp)
 	case oneOf(err, exceptions.ErrUnauthorised):
 		RespondJSON(ctx, w, http.StatusUnauthorized, errResp)
+	case oneOf(err, exceptions.ErrIdempotencyKeyReused):
+		RespondJSON(ctx, w, http.StatusUnprocessableEntity, errResp)
+	case oneOf(err, exceptions.ErrQuotaExceeded):
+		RespondJSON(ctx, w, http.StatusTooManyRequests, errResp)
 	default:
 		errResp.Error = exceptions.ErrInternalServerError.Error()
 		RespondJSON(ctx, w, http.StatusInternalServerError, errResp)
@@ -0,0 +1,76 @@
+package imagehelper
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/mikarios/imageresizer/internal/exceptions"
+	"github.com/mikarios/imageresizer/internal/services/config"
+	"github.com/mikarios/imageresizer/pkg/dtos/imagedto"
+)
+
+// imageDeadlineKey holds the deadline set by WithImageTimeout, so that it can be told apart from the one of the job.
+type imageDeadlineKey struct{}
+
+// WithJobDeadline returns a copy of ctx that expires at the deadline of the job or, if it does not set one, once the
+// configured IMG_JOB_TIMEOUT elapses.
+func WithJobDeadline(ctx context.Context, data *imagedto.ImageProcessJobData) (context.Context, context.CancelFunc) {
+	if data.Deadline != nil {
+		return context.WithDeadline(ctx, *data.Deadline)
+	}
+
+	if timeout := config.GetInstance().ImageConfig.JobTimeout; timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+
+	return context.WithCancel(ctx)
+}
+
+// WithImageTimeout returns a copy of ctx for processing a single image of the job, which expires once the image timeout
+// of the job, or the configured IMG_IMAGE_TIMEOUT, elapses.
+func WithImageTimeout(ctx context.Context, data *imagedto.ImageProcessJobData) (context.Context, context.CancelFunc) {
+	timeout := time.Duration(data.ImageTimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = config.GetInstance().ImageConfig.ImageTimeout
+	}
+
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	deadline := time.Now().Add(timeout)
+
+	return context.WithDeadline(context.WithValue(ctx, imageDeadlineKey{}, deadline), deadline)
+}
+
+// Interrupted returns why processing under ctx stopped: exceptions.ErrJobCancelled, exceptions.ErrJobDeadlineExceeded
+// or exceptions.ErrImageTimeout. Nil if ctx is not done.
+func Interrupted(ctx context.Context) error {
+	err := ctx.Err()
+
+	switch {
+	case err == nil:
+		return nil
+	case !errors.Is(err, context.DeadlineExceeded):
+		return exceptions.ErrJobCancelled
+	}
+
+	// the image deadline only applies if it is earlier than the one of the job
+	imageDeadline, ok := ctx.Value(imageDeadlineKey{}).(time.Time)
+	if deadline, _ := ctx.Deadline(); ok && deadline.Equal(imageDeadline) {
+		return exceptions.ErrImageTimeout
+	}
+
+	return exceptions.ErrJobDeadlineExceeded
+}
+
+// errCode returns the code of err or, if ctx is done, the reason processing stopped, as the failure was most likely
+// caused by it.
+func errCode(ctx context.Context, err error) string {
+	if interrupted := Interrupted(ctx); interrupted != nil {
+		return interrupted.Error()
+	}
+
+	return err.Error()
+}
@@ -0,0 +1,58 @@
+package imagehelper_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mikarios/imageresizer/internal/exceptions"
+	"github.com/mikarios/imageresizer/internal/imagehelper"
+	"github.com/mikarios/imageresizer/pkg/dtos/imagedto"
+)
+
+func TestInterrupted(t *testing.T) {
+	t.Parallel()
+
+	past, future := time.Now().Add(-time.Minute), time.Now().Add(time.Hour)
+
+	tests := map[string]struct {
+		deadline *time.Time
+		cancel   bool
+		want     error
+	}{
+		"cancelled":         {deadline: &future, cancel: true, want: exceptions.ErrJobCancelled},
+		"deadline exceeded": {deadline: &past, want: exceptions.ErrJobDeadlineExceeded},
+		"image timeout":     {deadline: &future, want: exceptions.ErrImageTimeout},
+	}
+
+	for name, tt := range tests {
+		tt := tt
+
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			data := &imagedto.ImageProcessJobData{Deadline: tt.deadline, ImageTimeoutSeconds: 1}
+
+			jobCtx, cancelJob := imagehelper.WithJobDeadline(context.Background(), data)
+			defer cancelJob()
+
+			ctx, cancel := imagehelper.WithImageTimeout(jobCtx, data)
+			defer cancel()
+
+			if err := imagehelper.Interrupted(ctx); tt.deadline.After(time.Now()) && err != nil {
+				t.Fatalf("Interrupted() before done = %v, want nil", err)
+			}
+
+			if tt.cancel {
+				cancelJob()
+			}
+
+			<-ctx.Done()
+
+			if err := imagehelper.Interrupted(ctx); !errors.Is(err, tt.want) {
+				t.Errorf("Interrupted() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
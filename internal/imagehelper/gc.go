@@ -0,0 +1,147 @@
+package imagehelper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+
+	"github.com/mikarios/golib/logger"
+
+	"github.com/mikarios/imageresizer/internal/exceptions"
+	"github.com/mikarios/imageresizer/internal/pathtemplate"
+	"github.com/mikarios/imageresizer/internal/services/cdnservice"
+	"github.com/mikarios/imageresizer/pkg/dtos/imagedto"
+)
+
+// CollectGarbage diffs the desired images of the shop against the files stored under the shop's folder and deletes
+// everything that is not desired. Manifests of the remaining products are pruned accordingly. Like Delete, more orphans
+// than the configured maximum are only reported, not deleted.
+func CollectGarbage(
+	ctx context.Context,
+	cdn *cdnservice.CdnStruct,
+	imagesFolder string,
+	req *imagedto.ImageGCReq,
+) (*imagedto.ImageGCResp, error) {
+	if len(req.Images) == 0 {
+		return nil, fmt.Errorf("%w: use deleteImages to remove all images of a shop", exceptions.ErrEmptyDesiredSet)
+	}
+
+	tmpl, err := ResolvePathTemplate(req.PathTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	shopFolder := tmpl.Prefix(&pathtemplate.Vars{ShopID: strconv.Itoa(req.ShopID)})
+	if req.ShopID == 0 || shopFolder == "" {
+		return nil, fmt.Errorf("%w: the path template does not have a folder per shop", exceptions.ErrInvalidShopID)
+	}
+
+	desired, manifests := desiredKeys(imagesFolder, tmpl, req)
+
+	listed, err := cdn.ListFiles(ctx, "", path.Join(imagesFolder, shopFolder)+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &imagedto.ImageGCResp{
+		ShopID:  req.ShopID,
+		Listed:  len(listed),
+		Desired: len(desired),
+		Orphans: findOrphans(listed, desired),
+		DryRun:  req.DryRun,
+	}
+
+	if req.DryRun || len(resp.Orphans) == 0 {
+		return resp, nil
+	}
+
+	if err = cdnservice.CheckDeleteLimit(len(resp.Orphans)); err != nil {
+		return resp, err
+	}
+
+	logger.Info(ctx, fmt.Sprintf("deleting %d orphans of shop %d", len(resp.Orphans), req.ShopID))
+
+	if err = cdn.DeleteKeys(ctx, "", resp.Orphans); err != nil {
+		return resp, err
+	}
+
+	orphans := make(map[string]struct{}, len(resp.Orphans))
+	for _, key := range resp.Orphans {
+		orphans[key] = struct{}{}
+	}
+
+	for _, key := range manifests {
+		if err = pruneManifest(ctx, cdn, key, orphans); err != nil && !errors.Is(err, cdnservice.ErrFileNotFound) {
+			logger.Error(ctx, err, "could not prune manifest", key)
+		}
+	}
+
+	return resp, nil
+}
+
+// desiredKeys returns the keys of the originals, variants and manifests the shop should have.
+func desiredKeys(
+	imagesFolder string,
+	tmpl *pathtemplate.Template,
+	req *imagedto.ImageGCReq,
+) (desired map[string]struct{}, manifests []string) {
+	desired = make(map[string]struct{})
+	manifests = make([]string, 0)
+
+	for _, img := range req.Images {
+		job := &ImageJob{ImageStruct: img, ShopID: req.ShopID, template: tmpl}
+
+		desired[job.OriginalKey(imagesFolder)] = struct{}{}
+
+		for _, key := range job.VariantKeys(imagesFolder) {
+			desired[key] = struct{}{}
+		}
+
+		manifestKey := ManifestKey(imagesFolder, tmpl, req.ShopID, img.ProductID)
+		if _, ok := desired[manifestKey]; !ok {
+			desired[manifestKey] = struct{}{}
+			manifests = append(manifests, manifestKey)
+		}
+	}
+
+	return desired, manifests
+}
+
+// findOrphans returns the listed keys that are not desired, sorted.
+func findOrphans(listed []string, desired map[string]struct{}) []string {
+	orphans := make([]string, 0)
+
+	for _, key := range listed {
+		if _, ok := desired[key]; !ok {
+			orphans = append(orphans, key)
+		}
+	}
+
+	sort.Strings(orphans)
+
+	return orphans
+}
+
+// pruneManifest removes the variants with the given keys from the manifest stored under key.
+func pruneManifest(ctx context.Context, cdn manifestStore, key string, deleted map[string]struct{}) error {
+	return writeManifest(ctx, cdn, key, false, func(manifest *imagedto.Manifest) error {
+		variants := make([]*imagedto.ManifestVariant, 0, len(manifest.Variants))
+
+		for _, v := range manifest.Variants {
+			if _, ok := deleted[v.Key]; !ok {
+				variants = append(variants, v)
+			}
+		}
+
+		if len(variants) == len(manifest.Variants) {
+			return errManifestUnchanged
+		}
+
+		manifest.Variants = variants
+
+		return nil
+	})
+}
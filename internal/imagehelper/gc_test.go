@@ -0,0 +1,85 @@
+// nolint:testpackage // access to internal functions needed
+package imagehelper
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/mikarios/imageresizer/internal/exceptions"
+	"github.com/mikarios/imageresizer/internal/pathtemplate"
+	"github.com/mikarios/imageresizer/pkg/dtos/imagedto"
+)
+
+func TestCollectGarbage_EmptyDesiredSet(t *testing.T) {
+	t.Parallel()
+
+	_, err := CollectGarbage(context.Background(), nil, "images", &imagedto.ImageGCReq{ShopID: 1})
+	if !errors.Is(err, exceptions.ErrEmptyDesiredSet) {
+		t.Errorf("CollectGarbage() error = %v, want %v", err, exceptions.ErrEmptyDesiredSet)
+	}
+}
+
+func TestFindOrphans(t *testing.T) {
+	t.Parallel()
+
+	tmpl, err := pathtemplate.Parse("{shop}/{product}/{mode}/{w}x{h}/{name}.{ext}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scale := 300
+	req := &imagedto.ImageGCReq{
+		ShopID: 1,
+		Images: []*imagedto.ImageStruct{{
+			Name:              "a.jpg",
+			ProductID:         "p1",
+			ScaleDimensionMax: []*int{&scale},
+			CropDimensions:    []*imagedto.Dimensions{{X: 100, Y: 50}},
+		}},
+	}
+
+	desired, manifests := desiredKeys("images", tmpl, req)
+
+	if want := []string{"images/1/p1/manifest.json"}; !reflect.DeepEqual(manifests, want) {
+		t.Errorf("desiredKeys() manifests = %v, want %v", manifests, want)
+	}
+
+	tests := map[string]struct {
+		listed []string
+		want   []string
+	}{
+		"nothing listed": {want: []string{}},
+		"template variants kept": {
+			listed: []string{
+				"images/1/p1/original/a.jpg",
+				"images/1/p1/scale/300x300/a.jpg",
+				"images/1/p1/crop/100x50/a.jpg",
+				"images/1/p1/manifest.json",
+			},
+			want: []string{},
+		},
+		"orphans found": {
+			listed: []string{
+				"images/1/p2/original/b.jpg",
+				"images/1/p1/scale/600x600/a.jpg",
+				"images/1/p1/original/a.jpg",
+				"images/1/p1/original/a.png",
+				"images/1/p10/original/a.jpg",
+			},
+			want: []string{
+				"images/1/p1/original/a.png",
+				"images/1/p1/scale/600x600/a.jpg",
+				"images/1/p10/original/a.jpg",
+				"images/1/p2/original/b.jpg",
+			},
+		},
+	}
+
+	for name, tt := range tests {
+		if got := findOrphans(tt.listed, desired); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: findOrphans() = %v, want %v", name, got, tt.want)
+		}
+	}
+}
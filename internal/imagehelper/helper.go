@@ -22,8 +22,10 @@ import (
 
 	"github.com/mikarios/golib/logger"
 
+	"github.com/mikarios/imageresizer/internal/pathtemplate"
 	"github.com/mikarios/imageresizer/internal/services/cdnservice"
 	"github.com/mikarios/imageresizer/internal/services/config"
+	"github.com/mikarios/imageresizer/internal/sourcefetcher"
 	"github.com/mikarios/imageresizer/pkg/dtos/imagedto"
 )
 
@@ -43,6 +45,8 @@ var (
 	errMinXMaxY            = errors.New("could not scale minXmaxY")
 	errMinYMaxX            = errors.New("could not scale minYmaxX")
 	errDeletingImage       = errors.New("could not delete image")
+	errInvalidPathTemplate = errors.New("invalid path template")
+	errUpdatingManifest    = errors.New("could not update manifest")
 )
 
 type ImageJob struct {
@@ -51,19 +55,173 @@ type ImageJob struct {
 	ImageExtension string                  `json:"imageExtension"`
 	ImagesOnCdn    *map[string]interface{} `json:"-"`
 	DeleteImages   []string                `json:"deleteImages"`
+	PathTemplate   string                  `json:"pathTemplate,omitempty"`
+	StoredKeys     []string                `json:"-"` // filled by ProcessJobImage
+	StoredBytes    int64                   `json:"-"` // filled by ProcessJobImage
+	template       *pathtemplate.Template
 }
 
-type ProcessImageError struct {
-	URL string `json:"url"`
-	Err string `json:"err"`
-	Msg string `json:"msg"`
-	Dim string `json:"dim"`
+// NewImageJobs splits the job into one image job per image, followed by a job deleting the images of DeleteImages.
+func NewImageJobs(
+	data *imagedto.ImageProcessJobData,
+	pathTemplate string,
+	imagesOnCdn *map[string]interface{},
+) []*ImageJob {
+	imageJobs := make([]*ImageJob, 0, len(data.Images)+1)
+
+	for _, img := range data.Images {
+		imageJobs = append(imageJobs, &ImageJob{
+			ImageStruct:    img,
+			ShopID:         data.ShopID,
+			ImageExtension: data.ImageExtension,
+			ImagesOnCdn:    imagesOnCdn,
+			PathTemplate:   pathTemplate,
+		})
+	}
+
+	return append(imageJobs, &ImageJob{DeleteImages: data.DeleteImages})
 }
 
-func (e *ProcessImageError) Error() string {
-	return fmt.Sprintf("Err: %v, url: %s, dimensions: %s, msg: %s", e.Err, e.URL, e.Dim, e.Msg)
+// url returns the source of the image, empty for deletion jobs.
+func (imageJob *ImageJob) url() string {
+	if imageJob.ImageStruct == nil {
+		return ""
+	}
+
+	return imageJob.URL
+}
+
+// Template returns the parsed path template of the job. If the job does not define one the configured template is
+// used and if that is not set either the default layout.
+func (imageJob *ImageJob) Template() (*pathtemplate.Template, error) {
+	if imageJob.template == nil {
+		t, err := ResolvePathTemplate(imageJob.PathTemplate)
+		if err != nil {
+			return nil, err
+		}
+
+		imageJob.template = t
+	}
+
+	return imageJob.template, nil
+}
+
+// SubPath returns the path of the image variant, relative to the images folder, using the path template of the job.
+// Only one of the dimensions should be set. If none is, the path of the original image is returned.
+func (imageJob *ImageJob) SubPath(scaleDimension *int, cropDimensions, minXMaxY, minYMaxX *imagedto.Dimensions) string {
+	t, err := imageJob.Template()
+	if err != nil {
+		t = pathtemplate.Default()
+	}
+
+	shopID := imageJob.ShopID
+	vars := variantVars(&shopID, imageJob.ProductID, scaleDimension, cropDimensions, minXMaxY, minYMaxX, imageJob.Name)
+
+	return t.Expand(vars)
+}
+
+// OriginalKey returns the storage key of the original image.
+func (imageJob *ImageJob) OriginalKey(imagesFolder string) string {
+	return path.Join(imagesFolder, imageJob.SubPath(nil, nil, nil, nil))
+}
+
+// VariantKeys returns the storage keys of every variant requested for the image.
+func (imageJob *ImageJob) VariantKeys(imagesFolder string) []string {
+	keys := make([]string, 0)
+
+	add := func(subPath string) {
+		keys = append(keys, path.Join(imagesFolder, subPath))
+	}
+
+	for _, v := range imageJob.ScaleDimensionMax {
+		add(imageJob.SubPath(v, nil, nil, nil))
+	}
+
+	for _, v := range imageJob.CropDimensions {
+		add(imageJob.SubPath(nil, v, nil, nil))
+	}
+
+	for _, v := range imageJob.MinXMaxY {
+		add(imageJob.SubPath(nil, nil, v, nil))
+	}
+
+	for _, v := range imageJob.MinYMaxX {
+		add(imageJob.SubPath(nil, nil, nil, v))
+	}
+
+	return keys
+}
+
+// ValidateJob returns an error wrapping pathtemplate.ErrInvalidValue if one of the images of the job would not be
+// stored under its own path, see ValidateImage.
+func ValidateJob(data *imagedto.ImageProcessJobData) error {
+	for _, img := range data.Images {
+		if err := ValidateImage(data.ShopID, img); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ValidateImage returns an error wrapping pathtemplate.ErrInvalidValue if the image has no name, or a product ID or
+// name that would add or escape path segments.
+func ValidateImage(shopID int, img *imagedto.ImageStruct) error {
+	if img == nil || img.Name == "" {
+		return fmt.Errorf("%w: every image needs a name", pathtemplate.ErrInvalidValue)
+	}
+
+	return variantVars(&shopID, img.ProductID, nil, nil, nil, nil, img.Name).Validate()
+}
+
+// ResolvePathTemplate parses the given layout, falling back to the configured one and then to the default layout.
+func ResolvePathTemplate(layout string) (*pathtemplate.Template, error) {
+	if layout == "" {
+		layout = config.GetInstance().ImageConfig.PathTemplate
+	}
+
+	return pathtemplate.Parse(layout)
+}
+
+type ProcessImageError = imagedto.ProcessImageError
+
+// ProcessResult is what the processimage lambda responds with to an ImageJob, so that the server records what was
+// stored and what failed as if it processed the image itself.
+type ProcessResult struct {
+	StoredKeys  []string             `json:"storedKeys"`
+	StoredBytes int64                `json:"storedBytes"`
+	Errors      []*ProcessImageError `json:"errors"`
 }
 
+// NewProcessResult returns the result of imageJob once ProcessJobImage returned errs.
+func NewProcessResult(imageJob *ImageJob, errs []error) *ProcessResult {
+	res := &ProcessResult{
+		StoredKeys:  imageJob.StoredKeys,
+		StoredBytes: imageJob.StoredBytes,
+		Errors:      make([]*ProcessImageError, len(errs)),
+	}
+
+	for i, err := range errs {
+		if !errors.As(err, &res.Errors[i]) {
+			res.Errors[i] = &ProcessImageError{Err: err.Error()}
+		}
+	}
+
+	return res
+}
+
+// Errs returns the errors of the result the way ProcessJobImage returned them.
+func (r *ProcessResult) Errs() []error {
+	errs := make([]error, len(r.Errors))
+	for i, err := range r.Errors {
+		errs[i] = err
+	}
+
+	return errs
+}
+
+// ProcessJobImage stores the image and its variants and deletes the images of the job. Once ctx is cancelled or
+// expires the remaining variants are skipped and nothing is deleted, see Interrupted for the reported error.
 func ProcessJobImage(ctx context.Context, imageJob *ImageJob) []error {
 	logger.Debug(ctx, "processing photo for shop", imageJob.ShopID, *imageJob)
 
@@ -79,14 +237,36 @@ func ProcessJobImage(ctx context.Context, imageJob *ImageJob) []error {
 		}
 	}
 
+	if interrupted := Interrupted(ctx); interrupted != nil {
+		return []error{&ProcessImageError{URL: imageJob.url(), Err: interrupted.Error(), Msg: ctx.Err().Error()}}
+	}
+
 	if imageJob.ImageStruct != nil { // this is not a deletion job, this needs to process the image
+		if _, err := imageJob.Template(); err != nil {
+			return []error{&ProcessImageError{URL: imageJob.URL, Err: errInvalidPathTemplate.Error(), Msg: err.Error()}}
+		}
+
+		if err := ValidateImage(imageJob.ShopID, imageJob.ImageStruct); err != nil {
+			return []error{&ProcessImageError{URL: imageJob.URL, Err: errInvalidPathTemplate.Error(), Msg: err.Error()}}
+		}
+
 		processScaleImageJob(ctx, cdn, imageJob, cfg, &collectedErrors)
 	}
 
 	now := time.Now()
 
-	if err := cdn.Delete(cfg.CDN.Bucket, imageJob.DeleteImages); err != nil {
-		errProcessImage := &ProcessImageError{URL: imageJob.URL, Err: errDeletingImage.Error(), Msg: err.Error()}
+	// an interrupted job skips its remaining variants and does not delete anything
+	if interrupted := Interrupted(ctx); interrupted != nil {
+		return append(collectedErrors, &ProcessImageError{
+			URL: imageJob.url(),
+			Err: interrupted.Error(),
+			Msg: ctx.Err().Error(),
+		})
+	}
+
+	if _, err := cdn.Delete(ctx, cfg.CDN.Bucket, imageJob.DeleteImages, false); err != nil {
+		// deletion jobs have no ImageStruct so there is no url to report
+		errProcessImage := &ProcessImageError{Err: errCode(ctx, errDeletingImage), Msg: err.Error()}
 		collectedErrors = append(collectedErrors, errProcessImage)
 	}
 
@@ -102,6 +282,7 @@ func ProcessJobImage(ctx context.Context, imageJob *ImageJob) []error {
 func UploadMainProductImageToCDN(
 	ctx context.Context,
 	cdn *cdnservice.CdnStruct,
+	tmpl *pathtemplate.Template,
 	shopID *int,
 	productID,
 	imageName,
@@ -110,7 +291,7 @@ func UploadMainProductImageToCDN(
 	img []byte,
 	imagesOnCDN *map[string]interface{}, // nolint:gocritic // this should be pointer
 ) (downloadedImage []byte, err error) {
-	fullImagePath := ImageSubPath("", shopID, productID, nil, nil, nil, nil, imageName)
+	fullImagePath := tmpl.Expand(variantVars(shopID, productID, nil, nil, nil, nil, imageName))
 	fullImagePath = path.Join(imagesFolder, fullImagePath)
 	downloadedImage = img
 
@@ -125,18 +306,23 @@ func UploadMainProductImageToCDN(
 		if err != nil {
 			return nil, fmt.Errorf("could not download image [%v]: %w", imgURL, err)
 		}
+
+		// the source is the stored original itself, e.g. of an upload
+		if imgURL == fullImagePath {
+			return downloadedImage, nil
+		}
 	}
 
 	contentType := http.DetectContentType(downloadedImage)
-	if err = cdn.StoreFile("", fullImagePath, bytes.NewReader(downloadedImage), contentType); err != nil {
+	if err = cdn.StoreFile(ctx, "", fullImagePath, bytes.NewReader(downloadedImage), contentType); err != nil {
 		err = fmt.Errorf("could not store full image: %w", err)
 	}
 
 	return downloadedImage, err
 }
 
-// ImageSubPath calculates the correct image path based on the data provided. EITHER scaleDimension OR cropDimensions
-// should have value. If both have one will be ignored.
+// ImageSubPath calculates the image path of the default layout based on the data provided. EITHER scaleDimension OR
+// cropDimensions should have value. If both have one will be ignored.
 func ImageSubPath(
 	prefix string,
 	shopID *int,
@@ -147,28 +333,38 @@ func ImageSubPath(
 	minYMaxX *imagedto.Dimensions,
 	fileName string,
 ) string {
-	shopIDStr := ""
+	vars := variantVars(shopID, productID, scaleDimension, cropDimensions, minXMaxY, minYMaxX, fileName)
+
+	return path.Join(prefix, pathtemplate.Default().Expand(vars))
+}
+
+func variantVars(
+	shopID *int,
+	productID string,
+	scaleDimension *int,
+	cropDimensions,
+	minXMaxY,
+	minYMaxX *imagedto.Dimensions,
+	fileName string,
+) *pathtemplate.Vars {
+	vars := &pathtemplate.Vars{ProductID: productID, Mode: pathtemplate.ModeOriginal, FileName: fileName}
 
 	if shopID != nil {
-		shopIDStr = strconv.Itoa(*shopID)
+		vars.ShopID = strconv.Itoa(*shopID)
 	}
 
-	p := path.Join(prefix, shopIDStr, productID)
-
 	switch {
 	case scaleDimension != nil:
-		p = path.Join(p, strconv.Itoa(*scaleDimension))
+		vars.Mode, vars.Width, vars.Height = pathtemplate.ModeScale, *scaleDimension, *scaleDimension
 	case cropDimensions != nil:
-		p = path.Join(p, fmt.Sprintf("%vx%v", cropDimensions.X, cropDimensions.Y))
+		vars.Mode, vars.Width, vars.Height = pathtemplate.ModeCrop, cropDimensions.X, cropDimensions.Y
 	case minXMaxY != nil:
-		p = path.Join(p, "minxmaxy", fmt.Sprintf("%vx%v", minXMaxY.X, minXMaxY.Y))
+		vars.Mode, vars.Width, vars.Height = pathtemplate.ModeMinXMaxY, minXMaxY.X, minXMaxY.Y
 	case minYMaxX != nil:
-		p = path.Join(p, "minymaxx", fmt.Sprintf("%vx%v", minYMaxX.X, minYMaxX.Y))
-	default:
-		p = path.Join(prefix, shopIDStr, productID)
+		vars.Mode, vars.Width, vars.Height = pathtemplate.ModeMinYMaxX, minYMaxX.X, minYMaxX.Y
 	}
 
-	return path.Join(p, fileName)
+	return vars
 }
 
 func processScaleImageJob(
@@ -182,9 +378,12 @@ func processScaleImageJob(
 
 	now := time.Now()
 
+	tmpl, _ := imageJob.Template()
+
 	img, err := UploadMainProductImageToCDN(
 		ctx,
 		cdn,
+		tmpl,
 		&imageJob.ShopID,
 		imageJob.ProductID,
 		imageJob.Name,
@@ -194,19 +393,30 @@ func processScaleImageJob(
 		imageJob.ImagesOnCdn,
 	)
 	if err != nil {
-		errProcessImage := &ProcessImageError{URL: imageJob.URL, Err: errUploadingImage.Error(), Msg: err.Error()}
+		errProcessImage := &ProcessImageError{URL: imageJob.URL, Err: errCode(ctx, errUploadingImage), Msg: err.Error()}
 		*collectedErrors = append(*collectedErrors, errProcessImage)
 	}
 
+	variants := make([]*imagedto.ManifestVariant, 0)
+
+	if err == nil && len(img) > 0 {
+		key := imageJob.OriginalKey(cfg.CDN.ImagesFolder)
+		variants = append(variants, describeVariant(cdn, key, imageJob.Name, pathtemplate.ModeOriginal, img))
+	}
+
 	start := time.Now()
 	extension := imageJob.ImageExtension
 
 	for _, scaleDimension := range imageJob.ScaleDimensionMax {
-		img, err = handleScaleImage(ctx, imageJob, &cfg.CDN, scaleDimension, img, cdn, extension)
+		if ctx.Err() != nil {
+			break
+		}
+
+		img, err = handleScaleImage(ctx, imageJob, &cfg.CDN, scaleDimension, img, cdn, extension, &variants)
 		if err != nil {
 			errProcessImage := &ProcessImageError{
 				URL: imageJob.URL,
-				Err: errScalingImage.Error(),
+				Err: errCode(ctx, errScalingImage),
 				Msg: err.Error(),
 				Dim: fmt.Sprintf("%d", *scaleDimension),
 			}
@@ -215,11 +425,15 @@ func processScaleImageJob(
 	}
 
 	for _, cropDimension := range imageJob.CropDimensions {
-		img, err = handleCropImage(ctx, imageJob, &cfg.CDN, cropDimension, img, cdn, extension)
+		if ctx.Err() != nil {
+			break
+		}
+
+		img, err = handleCropImage(ctx, imageJob, &cfg.CDN, cropDimension, img, cdn, extension, &variants)
 		if err != nil {
 			errProcessImage := &ProcessImageError{
 				URL: imageJob.URL,
-				Err: errCropImage.Error(),
+				Err: errCode(ctx, errCropImage),
 				Msg: err.Error(),
 				Dim: fmt.Sprintf("%dx%d", cropDimension.X, cropDimension.Y),
 			}
@@ -228,11 +442,15 @@ func processScaleImageJob(
 	}
 
 	for _, minXMaxY := range imageJob.MinXMaxY {
-		img, err = handleMinXMaxYImage(ctx, imageJob, &cfg.CDN, minXMaxY, img, cdn, extension)
+		if ctx.Err() != nil {
+			break
+		}
+
+		img, err = handleMinXMaxYImage(ctx, imageJob, &cfg.CDN, minXMaxY, img, cdn, extension, &variants)
 		if err != nil {
 			errProcessImage := &ProcessImageError{
 				URL: imageJob.URL,
-				Err: errMinXMaxY.Error(),
+				Err: errCode(ctx, errMinXMaxY),
 				Msg: err.Error(),
 				Dim: fmt.Sprintf("%dx%d", minXMaxY.X, minXMaxY.Y),
 			}
@@ -241,11 +459,15 @@ func processScaleImageJob(
 	}
 
 	for _, minYMaxX := range imageJob.MinYMaxX {
-		img, err = handleMinYMaxXImage(ctx, imageJob, &cfg.CDN, minYMaxX, img, cdn, extension)
+		if ctx.Err() != nil {
+			break
+		}
+
+		img, err = handleMinYMaxXImage(ctx, imageJob, &cfg.CDN, minYMaxX, img, cdn, extension, &variants)
 		if err != nil {
 			errProcessImage := &ProcessImageError{
 				URL: imageJob.URL,
-				Err: errMinYMaxX.Error(),
+				Err: errCode(ctx, errMinYMaxX),
 				Msg: err.Error(),
 				Dim: fmt.Sprintf("%dx%d", minYMaxX.X, minYMaxX.Y),
 			}
@@ -255,6 +477,21 @@ func processScaleImageJob(
 
 	logger.Debug(ctx, fmt.Sprintf("Scaling ALL %v took: %v", imageJob.Name, time.Since(start)))
 
+	if len(variants) > 0 {
+		sourceFingerprint := fingerprint(img)
+		for _, v := range variants {
+			v.SourceFingerprint = sourceFingerprint
+			imageJob.StoredKeys = append(imageJob.StoredKeys, v.Key)
+			imageJob.StoredBytes += int64(v.Size)
+		}
+
+		key := ManifestKey(cfg.CDN.ImagesFolder, tmpl, imageJob.ShopID, imageJob.ProductID)
+		if err = updateManifest(ctx, cdn, key, imageJob.ShopID, imageJob.ProductID, variants); err != nil {
+			errProcessImage := &ProcessImageError{URL: imageJob.URL, Err: errCode(ctx, errUpdatingManifest), Msg: err.Error()}
+			*collectedErrors = append(*collectedErrors, errProcessImage)
+		}
+	}
+
 	logger.Debug(
 		ctx,
 		fmt.Sprintf("processing photo %v for shop ID: %v finished. Took: %v",
@@ -271,8 +508,9 @@ func handleScaleImage(
 	img []byte,
 	cdn *cdnservice.CdnStruct,
 	extension string,
+	variants *[]*imagedto.ManifestVariant,
 ) (downloadedImage []byte, err error) {
-	imagePath := ImageSubPath("", &imageJob.ShopID, imageJob.ProductID, scaleDimension, nil, nil, nil, imageJob.Name)
+	imagePath := imageJob.SubPath(scaleDimension, nil, nil, nil)
 	downloadedImage = img
 
 	if imageJob.ImagesOnCdn != nil {
@@ -288,13 +526,16 @@ func handleScaleImage(
 		}
 	}
 
-	output, err := scaleImage(&downloadedImage, scaleDimension, extension)
+	output, err := scaleImage(&downloadedImage, scaleDimension, extension, 0)
 	if err != nil {
 		return downloadedImage, fmt.Errorf("could not scale %v to %v: %w", imagePath, *scaleDimension, err)
 	}
 
+	key := path.Join(cdnConfig.ImagesFolder, imagePath)
 	contentType := http.DetectContentType(downloadedImage)
-	if err = cdn.StoreFile("", path.Join(cdnConfig.ImagesFolder, imagePath), output, contentType); err != nil {
+
+	err = storeVariant(ctx, cdn, key, imageJob.Name, pathtemplate.ModeScale, output, contentType, variants)
+	if err != nil {
 		return downloadedImage, fmt.Errorf("could not store image %v to cdn: %w", imagePath, err)
 	}
 
@@ -309,9 +550,10 @@ func handleCropImage(
 	img []byte,
 	cdn *cdnservice.CdnStruct,
 	extension string,
+	variants *[]*imagedto.ManifestVariant,
 ) (downloadedImage []byte, err error) {
 	downloadedImage = img
-	imagePath := ImageSubPath("", &imageJob.ShopID, imageJob.ProductID, nil, cropDimension, nil, nil, imageJob.Name)
+	imagePath := imageJob.SubPath(nil, cropDimension, nil, nil)
 
 	if imageJob.ImagesOnCdn != nil {
 		if _, ok := (*imageJob.ImagesOnCdn)[path.Join(cdnConfig.ImagesFolder, imagePath)]; ok {
@@ -326,14 +568,17 @@ func handleCropImage(
 		}
 	}
 
-	output, err := cropImage(&downloadedImage, cropDimension, extension)
+	output, err := cropImage(&downloadedImage, cropDimension, extension, 0)
 	if err != nil {
 		err = fmt.Errorf("could not scale %v to %vx%v: %w", imagePath, cropDimension.X, cropDimension.Y, err)
 		return downloadedImage, err
 	}
 
+	key := path.Join(cdnConfig.ImagesFolder, imagePath)
 	contentType := http.DetectContentType(downloadedImage)
-	if err = cdn.StoreFile("", path.Join(cdnConfig.ImagesFolder, imagePath), output, contentType); err != nil {
+
+	err = storeVariant(ctx, cdn, key, imageJob.Name, pathtemplate.ModeCrop, output, contentType, variants)
+	if err != nil {
 		return downloadedImage, fmt.Errorf("could not store image %v to cdn: %w", imagePath, err)
 	}
 
@@ -348,9 +593,10 @@ func handleMinXMaxYImage(
 	img []byte,
 	cdn *cdnservice.CdnStruct,
 	extension string,
+	variants *[]*imagedto.ManifestVariant,
 ) (downloadedImage []byte, err error) {
 	downloadedImage = img
-	imagePath := ImageSubPath("", &imageJob.ShopID, imageJob.ProductID, nil, nil, minXMaxY, nil, imageJob.Name)
+	imagePath := imageJob.SubPath(nil, nil, minXMaxY, nil)
 
 	if imageJob.ImagesOnCdn != nil {
 		if _, ok := (*imageJob.ImagesOnCdn)[path.Join(cdnConfig.ImagesFolder, imagePath)]; ok {
@@ -365,13 +611,16 @@ func handleMinXMaxYImage(
 		}
 	}
 
-	output, err := cropImageMinXMaxY(&downloadedImage, minXMaxY, extension)
+	output, err := cropImageMinXMaxY(&downloadedImage, minXMaxY, extension, 0)
 	if err != nil {
 		return downloadedImage, fmt.Errorf("could not minXmaxY crop %v to %vx%v: %w", imagePath, minXMaxY.X, minXMaxY.Y, err)
 	}
 
+	key := path.Join(cdnConfig.ImagesFolder, imagePath)
 	contentType := http.DetectContentType(downloadedImage)
-	if err = cdn.StoreFile("", path.Join(cdnConfig.ImagesFolder, imagePath), output, contentType); err != nil {
+
+	err = storeVariant(ctx, cdn, key, imageJob.Name, pathtemplate.ModeMinXMaxY, output, contentType, variants)
+	if err != nil {
 		return downloadedImage, fmt.Errorf("could not store image %v to cdn: %w", imagePath, err)
 	}
 
@@ -386,9 +635,10 @@ func handleMinYMaxXImage(
 	img []byte,
 	cdn *cdnservice.CdnStruct,
 	extension string,
+	variants *[]*imagedto.ManifestVariant,
 ) (downloadedImage []byte, err error) {
 	downloadedImage = img
-	imagePath := ImageSubPath("", &imageJob.ShopID, imageJob.ProductID, nil, nil, nil, minYMaxX, imageJob.Name)
+	imagePath := imageJob.SubPath(nil, nil, nil, minYMaxX)
 
 	if imageJob.ImagesOnCdn != nil {
 		if _, ok := (*imageJob.ImagesOnCdn)[path.Join(cdnConfig.ImagesFolder, imagePath)]; ok {
@@ -403,20 +653,23 @@ func handleMinYMaxXImage(
 		}
 	}
 
-	output, err := cropImageMinYMaxX(&downloadedImage, minYMaxX, extension)
+	output, err := cropImageMinYMaxX(&downloadedImage, minYMaxX, extension, 0)
 	if err != nil {
 		return downloadedImage, fmt.Errorf("could not minXmaxY crop %v to %vx%v: %w", imagePath, minYMaxX.X, minYMaxX.Y, err)
 	}
 
+	key := path.Join(cdnConfig.ImagesFolder, imagePath)
 	contentType := http.DetectContentType(downloadedImage)
-	if err = cdn.StoreFile("", path.Join(cdnConfig.ImagesFolder, imagePath), output, contentType); err != nil {
+
+	err = storeVariant(ctx, cdn, key, imageJob.Name, pathtemplate.ModeMinYMaxX, output, contentType, variants)
+	if err != nil {
 		return downloadedImage, fmt.Errorf("could not store image %v to cdn: %w", imagePath, err)
 	}
 
 	return downloadedImage, nil
 }
 
-func scaleImage(img *[]byte, scaleDimension *int, extension string) (io.ReadSeeker, error) {
+func scaleImage(img *[]byte, scaleDimension *int, extension string, quality int) (io.ReadSeeker, error) {
 	origExtension := strings.TrimPrefix(mimetype.Detect(*img).Extension(), ".")
 
 	if extension == "" {
@@ -438,14 +691,19 @@ func scaleImage(img *[]byte, scaleDimension *int, extension string) (io.ReadSeek
 	draw.NearestNeighbor.Scale(dst, dst.Rect, src, src.Bounds(), draw.Over, nil)
 
 	var output bytes.Buffer
-	if err := encodeImage(dst, extension, &output); err != nil {
+	if err := encodeImage(dst, extension, quality, &output); err != nil {
 		return nil, err
 	}
 
 	return bytes.NewReader(output.Bytes()), nil
 }
 
-func cropImage(img *[]byte, cropDimension *imagedto.Dimensions, extension string) (io.ReadSeeker, error) {
+func cropImage(
+	img *[]byte,
+	cropDimension *imagedto.Dimensions,
+	extension string,
+	quality int,
+) (io.ReadSeeker, error) {
 	origExtension := strings.TrimPrefix(mimetype.Detect(*img).Extension(), ".")
 
 	if extension == "" {
@@ -489,14 +747,19 @@ func cropImage(img *[]byte, cropDimension *imagedto.Dimensions, extension string
 	draw.Draw(res, container, shrunkImage, image.Point{}, draw.Over)
 
 	var output bytes.Buffer
-	if err := encodeImage(res, extension, &output); err != nil {
+	if err := encodeImage(res, extension, quality, &output); err != nil {
 		return nil, err
 	}
 
 	return bytes.NewReader(output.Bytes()), nil
 }
 
-func cropImageMinXMaxY(img *[]byte, minXMaxY *imagedto.Dimensions, extension string) (io.ReadSeeker, error) {
+func cropImageMinXMaxY(
+	img *[]byte,
+	minXMaxY *imagedto.Dimensions,
+	extension string,
+	quality int,
+) (io.ReadSeeker, error) {
 	origExtension := strings.TrimPrefix(mimetype.Detect(*img).Extension(), ".")
 
 	if extension == "" {
@@ -546,14 +809,19 @@ func cropImageMinXMaxY(img *[]byte, minXMaxY *imagedto.Dimensions, extension str
 	draw.Draw(res, container, shrunkImage, image.Point{}, draw.Over)
 
 	var output bytes.Buffer
-	if err := encodeImage(res, extension, &output); err != nil {
+	if err := encodeImage(res, extension, quality, &output); err != nil {
 		return nil, err
 	}
 
 	return bytes.NewReader(output.Bytes()), nil
 }
 
-func cropImageMinYMaxX(img *[]byte, minYMaxX *imagedto.Dimensions, extension string) (io.ReadSeeker, error) {
+func cropImageMinYMaxX(
+	img *[]byte,
+	minYMaxX *imagedto.Dimensions,
+	extension string,
+	quality int,
+) (io.ReadSeeker, error) {
 	origExtension := strings.TrimPrefix(mimetype.Detect(*img).Extension(), ".")
 
 	if extension == "" {
@@ -603,7 +871,7 @@ func cropImageMinYMaxX(img *[]byte, minYMaxX *imagedto.Dimensions, extension str
 	draw.Draw(res, container, shrunkImage, image.Point{}, draw.Over)
 
 	var output bytes.Buffer
-	if err := encodeImage(res, extension, &output); err != nil {
+	if err := encodeImage(res, extension, quality, &output); err != nil {
 		return nil, err
 	}
 
@@ -623,9 +891,14 @@ func decodeImage(img *[]byte, extension string) (image.Image, error) {
 	}
 }
 
-func encodeImage(img image.Image, extension string, output *bytes.Buffer) error {
+// encodeImage encodes the image in the given format. quality only applies to jpeg, zero means the default one.
+func encodeImage(img image.Image, extension string, quality int, output *bytes.Buffer) error {
 	switch extension {
 	case jpgExtension, jpegExtension:
+		if quality > 0 {
+			return jpeg.Encode(output, img, &jpeg.Options{Quality: quality})
+		}
+
 		return jpeg.Encode(output, img, nil)
 	case pngExtension:
 		return png.Encode(output, img)
@@ -718,24 +991,7 @@ func calculateTargetDimensions(
 	return x, y, errNoDimensionsDefined
 }
 
-func downloadImage(parentContext context.Context, url string) ([]byte, error) {
-	ctx, cancel := context.WithTimeout(parentContext, 20*time.Second)
-
-	defer cancel()
-
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, http.NoBody)
-	if err != nil {
-		return nil, err
-	}
-
-	httpClient := &http.Client{}
-
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-
-	defer resp.Body.Close()
-
-	return io.ReadAll(resp.Body)
+// downloadImage fetches the original image from its source, see sourcefetcher for the supported schemes.
+func downloadImage(ctx context.Context, source string) ([]byte, error) {
+	return sourcefetcher.Fetch(ctx, source)
 }
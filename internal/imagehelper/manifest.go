@@ -0,0 +1,251 @@
+package imagehelper
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gabriel-vasile/mimetype"
+
+	"github.com/mikarios/golib/logger"
+
+	"github.com/mikarios/imageresizer/internal/pathtemplate"
+	"github.com/mikarios/imageresizer/internal/services/cdnservice"
+	"github.com/mikarios/imageresizer/pkg/dtos/imagedto"
+)
+
+// manifestLocks serialises the read-modify-write of the manifests since images of the same product are processed
+// concurrently by different workers. Writers on other instances are caught by the versioned write, see writeManifest.
+var manifestLocks = &keyedMutex{locks: make(map[string]*refMutex)}
+
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*refMutex
+}
+
+type refMutex struct {
+	sync.Mutex
+	refs int
+}
+
+func (k *keyedMutex) lock(key string) (unlock func()) {
+	k.mu.Lock()
+
+	m, ok := k.locks[key]
+	if !ok {
+		m = &refMutex{}
+		k.locks[key] = m
+	}
+
+	m.refs++
+	k.mu.Unlock()
+
+	m.Lock()
+
+	return func() {
+		m.Unlock()
+
+		k.mu.Lock()
+		defer k.mu.Unlock()
+
+		if m.refs--; m.refs == 0 {
+			delete(k.locks, key)
+		}
+	}
+}
+
+// ManifestKey returns the storage key of the manifest of the given product, which is stored in the deepest folder of
+// the path template that is common to all images of the product.
+func ManifestKey(imagesFolder string, tmpl *pathtemplate.Template, shopID int, productID string) string {
+	prefix := tmpl.Prefix(&pathtemplate.Vars{ShopID: strconv.Itoa(shopID), ProductID: productID})
+
+	return path.Join(imagesFolder, prefix, imagedto.ManifestFileName)
+}
+
+// storeVariant uploads the given output to the cdn and appends its description to variants.
+func storeVariant(
+	ctx context.Context,
+	cdn *cdnservice.CdnStruct,
+	key,
+	name string,
+	mode pathtemplate.Mode,
+	output io.Reader,
+	contentType string,
+	variants *[]*imagedto.ManifestVariant,
+) error {
+	data, err := io.ReadAll(output)
+	if err != nil {
+		return err
+	}
+
+	if err = cdn.StoreFile(ctx, "", key, bytes.NewReader(data), contentType); err != nil {
+		return err
+	}
+
+	*variants = append(*variants, describeVariant(cdn, key, name, mode, data))
+
+	return nil
+}
+
+func describeVariant(
+	cdn *cdnservice.CdnStruct,
+	key,
+	name string,
+	mode pathtemplate.Mode,
+	data []byte,
+) *imagedto.ManifestVariant {
+	variant := &imagedto.ManifestVariant{
+		Key:    key,
+		URL:    cdn.PublicURL(key),
+		Name:   name,
+		Mode:   string(mode),
+		Format: strings.TrimPrefix(mimetype.Detect(data).Extension(), "."),
+		Size:   len(data),
+	}
+
+	if imgConfig, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+		variant.Width, variant.Height = imgConfig.Width, imgConfig.Height
+	}
+
+	return variant
+}
+
+func fingerprint(img []byte) string {
+	sum := sha256.Sum256(img)
+
+	return hex.EncodeToString(sum[:])
+}
+
+// manifestStore is the part of the cdn the manifests are read from and written to.
+type manifestStore interface {
+	GetFileVersion(ctx context.Context, bucket, filePath string) ([]byte, string, error)
+	StoreFileIfVersion(ctx context.Context, bucket, filePath string, file io.ReadSeeker, contentType, version string) error
+}
+
+// manifestWriteAttempts is how many times a manifest is re-read and written again when another instance changed it in
+// between.
+const manifestWriteAttempts = 5
+
+// errManifestUnchanged is returned by the modify functions of writeManifest when there is nothing to store.
+var errManifestUnchanged = errors.New("manifest unchanged")
+
+// updateManifest merges the given variants into the manifest stored under key. Variants with the same key are
+// replaced. The manifest is uploaded as a single object so readers never see a partially written one.
+func updateManifest(
+	ctx context.Context,
+	cdn manifestStore,
+	key string,
+	shopID int,
+	productID string,
+	variants []*imagedto.ManifestVariant,
+) error {
+	return writeManifest(ctx, cdn, key, true, func(manifest *imagedto.Manifest) error {
+		byKey := make(map[string]*imagedto.ManifestVariant, len(manifest.Variants)+len(variants))
+		for _, v := range manifest.Variants {
+			byKey[v.Key] = v
+		}
+
+		for _, v := range variants {
+			byKey[v.Key] = v
+		}
+
+		manifest.ShopID, manifest.ProductID = shopID, productID
+		manifest.Variants = make([]*imagedto.ManifestVariant, 0, len(byKey))
+
+		for _, v := range byKey {
+			manifest.Variants = append(manifest.Variants, v)
+		}
+
+		sort.Slice(manifest.Variants, func(i, j int) bool { return manifest.Variants[i].Key < manifest.Variants[j].Key })
+
+		return nil
+	})
+}
+
+// writeManifest applies modify to the manifest stored under key and writes it back. The write only succeeds if nobody
+// else wrote the manifest since it was read, otherwise it is read again and modify re-applied, so concurrent writers on
+// other instances do not lose each other's changes. If create is set a missing (or corrupt) manifest is started from
+// scratch, otherwise its read error is returned.
+func writeManifest(
+	ctx context.Context,
+	cdn manifestStore,
+	key string,
+	create bool,
+	modify func(manifest *imagedto.Manifest) error,
+) error {
+	// writers of this instance take turns so that only writers of other instances can conflict
+	unlock := manifestLocks.lock(key)
+	defer unlock()
+
+	var err error
+
+	for attempt := 0; attempt < manifestWriteAttempts; attempt++ {
+		if err = tryWriteManifest(ctx, cdn, key, create, modify); !errors.Is(err, cdnservice.ErrVersionConflict) {
+			break
+		}
+
+		logger.Debug(ctx, "manifest changed while updating, retrying", key)
+	}
+
+	if errors.Is(err, errManifestUnchanged) {
+		return nil
+	}
+
+	return err
+}
+
+func tryWriteManifest(
+	ctx context.Context,
+	cdn manifestStore,
+	key string,
+	create bool,
+	modify func(manifest *imagedto.Manifest) error,
+) error {
+	manifest := &imagedto.Manifest{}
+
+	data, version, err := cdn.GetFileVersion(ctx, "", key)
+
+	switch {
+	case err == nil:
+		if err = json.Unmarshal(data, manifest); err != nil {
+			if !create {
+				return fmt.Errorf("could not decode manifest %v: %w", key, err)
+			}
+
+			logger.Warning(ctx, "overwriting corrupt manifest", key, err.Error())
+
+			manifest = &imagedto.Manifest{}
+		}
+	case create && errors.Is(err, cdnservice.ErrFileNotFound):
+	default:
+		return fmt.Errorf("could not read manifest %v: %w", key, err)
+	}
+
+	if err = modify(manifest); err != nil {
+		return err
+	}
+
+	manifest.UpdatedAt = time.Now().UTC()
+
+	if data, err = json.Marshal(manifest); err != nil {
+		return fmt.Errorf("could not encode manifest %v: %w", key, err)
+	}
+
+	if err = cdn.StoreFileIfVersion(ctx, "", key, bytes.NewReader(data), "application/json", version); err != nil {
+		return fmt.Errorf("could not store manifest %v: %w", key, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,234 @@
+// nolint:testpackage // access to internal functions needed
+package imagehelper
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/mikarios/imageresizer/internal/services/cdnservice"
+	"github.com/mikarios/imageresizer/pkg/dtos/imagedto"
+)
+
+const testManifestKey = "images/1/p1/manifest.json"
+
+// fakeManifestStore keeps the files in memory and versions them with a counter. interfere is called before every
+// write, like a writer on another instance.
+type fakeManifestStore struct {
+	mu        sync.Mutex
+	files     map[string][]byte
+	versions  map[string]int
+	reads     int
+	conflicts int
+	interfere func(s *fakeManifestStore)
+}
+
+func newFakeManifestStore() *fakeManifestStore {
+	return &fakeManifestStore{files: make(map[string][]byte), versions: make(map[string]int)}
+}
+
+func (s *fakeManifestStore) GetFileVersion(_ context.Context, _, filePath string) ([]byte, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.reads++
+
+	data, ok := s.files[filePath]
+	if !ok {
+		return nil, "", fmt.Errorf("%w: %s", cdnservice.ErrFileNotFound, filePath)
+	}
+
+	return data, strconv.Itoa(s.versions[filePath]), nil
+}
+
+func (s *fakeManifestStore) StoreFileIfVersion(
+	_ context.Context,
+	_,
+	filePath string,
+	file io.ReadSeeker,
+	_,
+	version string,
+) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.interfere != nil {
+		s.interfere(s)
+	}
+
+	current := ""
+	if _, ok := s.files[filePath]; ok {
+		current = strconv.Itoa(s.versions[filePath])
+	}
+
+	if current != version {
+		s.conflicts++
+		return fmt.Errorf("%w: %s", cdnservice.ErrVersionConflict, filePath)
+	}
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return err
+	}
+
+	s.put(filePath, data)
+
+	return nil
+}
+
+func (s *fakeManifestStore) put(filePath string, data []byte) {
+	s.files[filePath] = data
+	s.versions[filePath]++
+}
+
+func (s *fakeManifestStore) putManifest(t *testing.T, keys ...string) {
+	t.Helper()
+
+	manifest := &imagedto.Manifest{ShopID: 1, ProductID: "p1"}
+	for _, key := range keys {
+		manifest.Variants = append(manifest.Variants, &imagedto.ManifestVariant{Key: key})
+	}
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.put(testManifestKey, data)
+}
+
+func (s *fakeManifestStore) variantKeys(t *testing.T) []string {
+	t.Helper()
+
+	manifest := &imagedto.Manifest{}
+	if err := json.Unmarshal(s.files[testManifestKey], manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := make([]string, 0, len(manifest.Variants))
+	for _, v := range manifest.Variants {
+		keys = append(keys, v.Key)
+	}
+
+	return keys
+}
+
+func TestWriteManifest_Conflict(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	tests := map[string]struct {
+		existing  []string
+		interfere []string
+		write     func(store *fakeManifestStore) error
+		want      []string
+	}{
+		"update merges the other write": {
+			interfere: []string{"b"},
+			write: func(store *fakeManifestStore) error {
+				return updateManifest(ctx, store, testManifestKey, 1, "p1", []*imagedto.ManifestVariant{{Key: "a"}})
+			},
+			want: []string{"a", "b"},
+		},
+		"prune keeps the other write": {
+			existing:  []string{"a", "b"},
+			interfere: []string{"a", "b", "c"},
+			write: func(store *fakeManifestStore) error {
+				return pruneManifest(ctx, store, testManifestKey, map[string]struct{}{"a": {}})
+			},
+			want: []string{"b", "c"},
+		},
+	}
+
+	for name, tt := range tests {
+		tt := tt
+
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			store := newFakeManifestStore()
+			if tt.existing != nil {
+				store.putManifest(t, tt.existing...)
+			}
+
+			store.interfere = func(s *fakeManifestStore) {
+				s.interfere = nil
+				s.putManifest(t, tt.interfere...)
+			}
+
+			if err := tt.write(store); err != nil {
+				t.Fatalf("write error = %v", err)
+			}
+
+			if store.conflicts != 1 || store.reads != 2 {
+				t.Errorf("conflicts = %d, reads = %d, want 1 conflict and the manifest read again", store.conflicts, store.reads)
+			}
+
+			if got := store.variantKeys(t); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("variants = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteManifest_GivesUp(t *testing.T) {
+	t.Parallel()
+
+	store := newFakeManifestStore()
+	store.interfere = func(s *fakeManifestStore) { s.putManifest(t, "b") }
+
+	err := updateManifest(context.Background(), store, testManifestKey, 1, "p1", []*imagedto.ManifestVariant{{Key: "a"}})
+	if !errors.Is(err, cdnservice.ErrVersionConflict) {
+		t.Errorf("updateManifest() error = %v, want %v", err, cdnservice.ErrVersionConflict)
+	}
+
+	if store.reads != manifestWriteAttempts {
+		t.Errorf("reads = %d, want %d", store.reads, manifestWriteAttempts)
+	}
+}
+
+// nolint:paralleltest // checks the shared manifest locks
+func TestWriteManifest_Lock(t *testing.T) {
+	const writers = 20
+
+	store := newFakeManifestStore()
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			variants := []*imagedto.ManifestVariant{{Key: fmt.Sprintf("v%02d", i)}}
+			if err := updateManifest(context.Background(), store, testManifestKey, 1, "p1", variants); err != nil {
+				t.Errorf("updateManifest() error = %v", err)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	if store.conflicts != 0 {
+		t.Errorf("conflicts = %d, want writers of the same instance to take turns", store.conflicts)
+	}
+
+	if got := store.variantKeys(t); len(got) != writers {
+		t.Errorf("variants = %v, want %d", got, writers)
+	}
+
+	manifestLocks.mu.Lock()
+	defer manifestLocks.mu.Unlock()
+
+	if _, ok := manifestLocks.locks[testManifestKey]; ok {
+		t.Error("lock of the manifest kept after every writer finished")
+	}
+}
@@ -0,0 +1,183 @@
+package imagehelper
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gabriel-vasile/mimetype"
+
+	"github.com/mikarios/imageresizer/internal/exceptions"
+	"github.com/mikarios/imageresizer/pkg/dtos/imagedto"
+)
+
+const (
+	optionScale    = "scale"
+	optionCrop     = "crop"
+	optionMinXMaxY = "minxmaxy"
+	optionMinYMaxX = "minymaxx"
+	optionFormat   = "format"
+	optionQuality  = "quality"
+	maxQuality     = 100
+)
+
+// Transformation is a single operation applied to an image on demand, the same ones a job applies to create variants.
+// Exactly one of ScaleDimension, CropDimensions, MinXMaxY, MinYMaxX is set.
+type Transformation struct {
+	ScaleDimension *int
+	CropDimensions *imagedto.Dimensions
+	MinXMaxY       *imagedto.Dimensions
+	MinYMaxX       *imagedto.Dimensions
+	Extension      string
+	Quality        int
+}
+
+// ParseTransformation parses comma separated options, e.g. "scale:300,format:png" or "crop:100x100,quality:80".
+// Supported options are scale:<dim>, crop:<x>x<y>, minxmaxy:<x>x<y>, minymaxx:<x>x<y>, format:<jpg|png> and
+// quality:<1-100>. Dimensions larger than maxDimension are rejected unless it is zero.
+func ParseTransformation(options string, maxDimension int) (*Transformation, error) {
+	t := &Transformation{}
+	geometries := 0
+
+	for _, option := range strings.Split(options, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(option), ":")
+		if !ok || value == "" {
+			return nil, fmt.Errorf("%w: malformed option %q", exceptions.ErrInvalidTransformation, option)
+		}
+
+		var err error
+
+		switch strings.ToLower(name) {
+		case optionScale:
+			t.ScaleDimension = new(int)
+			*t.ScaleDimension, err = parseDimension(value, maxDimension)
+			geometries++
+		case optionCrop:
+			t.CropDimensions, err = parseDimensions(value, maxDimension)
+			geometries++
+		case optionMinXMaxY:
+			t.MinXMaxY, err = parseDimensions(value, maxDimension)
+			geometries++
+		case optionMinYMaxX:
+			t.MinYMaxX, err = parseDimensions(value, maxDimension)
+			geometries++
+		case optionFormat:
+			t.Extension = strings.ToLower(value)
+			if t.Extension != jpgExtension && t.Extension != jpegExtension && t.Extension != pngExtension {
+				err = fmt.Errorf("%w: unsupported format %q", exceptions.ErrInvalidTransformation, value)
+			}
+		case optionQuality:
+			if t.Quality, err = strconv.Atoi(value); err == nil && (t.Quality < 1 || t.Quality > maxQuality) {
+				err = fmt.Errorf("%w: quality should be between 1 and %d", exceptions.ErrInvalidTransformation, maxQuality)
+			}
+		default:
+			err = fmt.Errorf("%w: unknown option %q", exceptions.ErrInvalidTransformation, name)
+		}
+
+		if err != nil {
+			if !errors.Is(err, exceptions.ErrInvalidTransformation) {
+				err = fmt.Errorf("%w: %s", exceptions.ErrInvalidTransformation, err.Error())
+			}
+
+			return nil, err
+		}
+	}
+
+	if geometries != 1 {
+		return nil, fmt.Errorf(
+			"%w: exactly one of scale, crop, minxmaxy, minymaxx is required",
+			exceptions.ErrInvalidTransformation,
+		)
+	}
+
+	return t, nil
+}
+
+// String returns the canonical form of the options, so that equivalent option strings share the stored result.
+func (t *Transformation) String() string {
+	options := make([]string, 0)
+
+	switch {
+	case t.ScaleDimension != nil:
+		options = append(options, optionScale+":"+strconv.Itoa(*t.ScaleDimension))
+	case t.CropDimensions != nil:
+		options = append(options, fmt.Sprintf("%s:%dx%d", optionCrop, t.CropDimensions.X, t.CropDimensions.Y))
+	case t.MinXMaxY != nil:
+		options = append(options, fmt.Sprintf("%s:%dx%d", optionMinXMaxY, t.MinXMaxY.X, t.MinXMaxY.Y))
+	case t.MinYMaxX != nil:
+		options = append(options, fmt.Sprintf("%s:%dx%d", optionMinYMaxX, t.MinYMaxX.X, t.MinYMaxX.Y))
+	}
+
+	if t.Extension != "" {
+		options = append(options, optionFormat+":"+t.Extension)
+	}
+
+	if t.Quality > 0 {
+		options = append(options, optionQuality+":"+strconv.Itoa(t.Quality))
+	}
+
+	sort.Strings(options)
+
+	return strings.Join(options, ",")
+}
+
+// Transform applies the transformation to the given image and returns the encoded result.
+func Transform(img []byte, t *Transformation) ([]byte, error) {
+	var (
+		output io.ReadSeeker
+		err    error
+	)
+
+	extension := t.Extension
+	if extension == "" && mimetype.Detect(img).Is("image/webp") {
+		// webp can only be decoded
+		extension = jpgExtension
+	}
+
+	switch {
+	case t.ScaleDimension != nil:
+		output, err = scaleImage(&img, t.ScaleDimension, extension, t.Quality)
+	case t.CropDimensions != nil:
+		output, err = cropImage(&img, t.CropDimensions, extension, t.Quality)
+	case t.MinXMaxY != nil:
+		output, err = cropImageMinXMaxY(&img, t.MinXMaxY, extension, t.Quality)
+	case t.MinYMaxX != nil:
+		output, err = cropImageMinYMaxX(&img, t.MinYMaxX, extension, t.Quality)
+	default:
+		return nil, errNoDimensionsDefined
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return io.ReadAll(output)
+}
+
+func parseDimension(value string, maxDimension int) (int, error) {
+	dim, err := strconv.Atoi(value)
+	if err != nil || dim <= 0 || (maxDimension > 0 && dim > maxDimension) {
+		return 0, fmt.Errorf("%w: invalid dimension %q", exceptions.ErrInvalidTransformation, value)
+	}
+
+	return dim, nil
+}
+
+func parseDimensions(value string, maxDimension int) (*imagedto.Dimensions, error) {
+	xStr, yStr, _ := strings.Cut(strings.ToLower(value), "x")
+
+	x, err := parseDimension(xStr, maxDimension)
+	if err != nil {
+		return nil, err
+	}
+
+	y, err := parseDimension(yStr, maxDimension)
+	if err != nil {
+		return nil, err
+	}
+
+	return &imagedto.Dimensions{X: x, Y: y}, nil
+}
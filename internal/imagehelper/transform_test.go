@@ -0,0 +1,51 @@
+package imagehelper_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/mikarios/imageresizer/internal/exceptions"
+	"github.com/mikarios/imageresizer/internal/imagehelper"
+)
+
+func TestParseTransformation(t *testing.T) {
+	t.Parallel()
+
+	valid := map[string]string{
+		"scale:300":                            "scale:300",
+		"format:png,scale:300":                 "format:png,scale:300",
+		" CROP:100X50 , quality:80":            "crop:100x50,quality:80",
+		"minxmaxy:100x200,format:jpg":          "format:jpg,minxmaxy:100x200",
+		"quality:10,minymaxx:10x20,format:png": "format:png,minymaxx:10x20,quality:10",
+	}
+
+	for options, want := range valid {
+		transformation, err := imagehelper.ParseTransformation(options, 1000)
+		if err != nil {
+			t.Errorf("ParseTransformation(%q) error = %v", options, err)
+			continue
+		}
+
+		if got := transformation.String(); got != want {
+			t.Errorf("ParseTransformation(%q).String() = %q, want %q", options, got, want)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"format:png",
+		"scale:300,crop:100x100",
+		"scale:2000",
+		"scale:-1",
+		"crop:100",
+		"format:gif,scale:100",
+		"quality:101,scale:100",
+		"rotate:90,scale:100",
+	}
+
+	for _, options := range invalid {
+		if _, err := imagehelper.ParseTransformation(options, 1000); !errors.Is(err, exceptions.ErrInvalidTransformation) {
+			t.Errorf("ParseTransformation(%q) error = %v, want %v", options, err, exceptions.ErrInvalidTransformation)
+		}
+	}
+}
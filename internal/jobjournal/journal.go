@@ -0,0 +1,211 @@
+// Package jobjournal persists the jobs accepted by an instance so that the ones not finished by the time it stops can
+// be processed once it starts again.
+package jobjournal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"go.etcd.io/bbolt"
+
+	"github.com/mikarios/imageresizer/pkg/dtos/imagedto"
+)
+
+const openTimeout = time.Second
+
+var (
+	bucketJobs = []byte("jobs")
+
+	ErrJournal = errors.New("job journal error")
+)
+
+// Entry is a job recorded in the journal along with its progress.
+type Entry struct {
+	Job        *imagedto.ImageProcessJobData `json:"job"`
+	Priority   imagedto.PriorityType         `json:"priority"`
+	State      imagedto.JobState             `json:"state"`
+	AcceptedAt time.Time                     `json:"acceptedAt"`
+	FinishedAt *time.Time                    `json:"finishedAt,omitempty"`
+}
+
+// Journal records jobs in a bbolt database, keyed by job ID. A nil journal records nothing.
+type Journal struct {
+	db *bbolt.DB
+}
+
+// Open opens the journal at path, creating it if it does not exist. Only one process can open it at a time.
+func Open(path string) (*Journal, error) {
+	db, err := bbolt.Open(path, 0o600, &bbolt.Options{Timeout: openTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not open %s: %s", ErrJournal, path, err.Error())
+	}
+
+	if err = db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketJobs)
+		return err
+	}); err != nil {
+		_ = db.Close()
+
+		return nil, fmt.Errorf("%w: %s", ErrJournal, err.Error())
+	}
+
+	return &Journal{db: db}, nil
+}
+
+// Record adds the job as queued.
+func (j *Journal) Record(job *imagedto.ImageProcessJobData, priority imagedto.PriorityType) error {
+	if j == nil {
+		return nil
+	}
+
+	return j.db.Update(func(tx *bbolt.Tx) error {
+		return put(tx, &Entry{
+			Job:        job,
+			Priority:   priority,
+			State:      imagedto.JobStateQueued,
+			AcceptedAt: time.Now().UTC(),
+		})
+	})
+}
+
+// Started marks the job as running. Jobs not in the journal are ignored.
+func (j *Journal) Started(id string) error {
+	return j.update(id, func(e *Entry) {
+		e.State, e.FinishedAt = imagedto.JobStateRunning, nil
+	})
+}
+
+// Finished records the final state of the job. The entry is kept until the next compaction.
+func (j *Journal) Finished(id string, state imagedto.JobState) error {
+	return j.update(id, func(e *Entry) {
+		now := time.Now().UTC()
+		e.State, e.FinishedAt = state, &now
+	})
+}
+
+// Remove deletes the job, e.g. because it was never scheduled.
+func (j *Journal) Remove(id string) error {
+	if j == nil {
+		return nil
+	}
+
+	return j.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketJobs).Delete([]byte(id))
+	})
+}
+
+// Unfinished returns the jobs that have not finished, urgent first and then in the order they were accepted.
+func (j *Journal) Unfinished() ([]*Entry, error) {
+	res := make([]*Entry, 0)
+
+	if j == nil {
+		return res, nil
+	}
+
+	err := j.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketJobs).ForEach(func(k, v []byte) error {
+			e := &Entry{}
+			if err := json.Unmarshal(v, e); err != nil {
+				return fmt.Errorf("%w: invalid entry %s: %s", ErrJournal, k, err.Error())
+			}
+
+			if !e.State.Finished() {
+				res = append(res, e)
+			}
+
+			return nil
+		})
+	})
+
+	sort.SliceStable(res, func(a, b int) bool {
+		urgentA, urgentB := res[a].Priority == imagedto.PriorityUrgent, res[b].Priority == imagedto.PriorityUrgent
+		if urgentA != urgentB {
+			return urgentA
+		}
+
+		return res[a].AcceptedAt.Before(res[b].AcceptedAt)
+	})
+
+	return res, err
+}
+
+// Compact deletes the jobs that finished before the given time, along with any entry that cannot be decoded, and
+// returns how many were deleted.
+func (j *Journal) Compact(before time.Time) (int, error) {
+	if j == nil {
+		return 0, nil
+	}
+
+	deleted := 0
+
+	err := j.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(bucketJobs)
+		keys := make([][]byte, 0)
+
+		if err := b.ForEach(func(k, v []byte) error {
+			e := &Entry{}
+			if err := json.Unmarshal(v, e); err != nil || (e.FinishedAt != nil && e.FinishedAt.Before(before)) {
+				// keys are only valid during the transaction, which is still open when they are deleted
+				keys = append(keys, k)
+			}
+
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		deleted = len(keys)
+
+		return nil
+	})
+
+	return deleted, err
+}
+
+func (j *Journal) Close() error {
+	if j == nil {
+		return nil
+	}
+
+	return j.db.Close()
+}
+
+func (j *Journal) update(id string, fn func(e *Entry)) error {
+	if j == nil {
+		return nil
+	}
+
+	return j.db.Update(func(tx *bbolt.Tx) error {
+		v := tx.Bucket(bucketJobs).Get([]byte(id))
+		if v == nil {
+			return nil
+		}
+
+		e := &Entry{}
+		if err := json.Unmarshal(v, e); err != nil {
+			return fmt.Errorf("%w: invalid entry %s: %s", ErrJournal, id, err.Error())
+		}
+
+		fn(e)
+
+		return put(tx, e)
+	})
+}
+
+func put(tx *bbolt.Tx, e *Entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket(bucketJobs).Put([]byte(e.Job.ID), b)
+}
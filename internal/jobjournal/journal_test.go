@@ -0,0 +1,78 @@
+package jobjournal_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mikarios/imageresizer/internal/jobjournal"
+	"github.com/mikarios/imageresizer/pkg/dtos/imagedto"
+)
+
+func TestJournal(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "journal.db")
+
+	j, err := jobjournal.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, job := range []struct {
+		id       string
+		priority imagedto.PriorityType
+	}{
+		{"normal", imagedto.PriorityNormal},
+		{"urgent", imagedto.PriorityUrgent},
+		{"finished", imagedto.PriorityUrgent},
+		{"forgotten", imagedto.PriorityUrgent},
+	} {
+		if err = j.Record(&imagedto.ImageProcessJobData{ID: job.id}, job.priority); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = j.Started("urgent"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = j.Finished("finished", imagedto.JobStateSucceeded); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = j.Remove("forgotten"); err != nil {
+		t.Fatal(err)
+	}
+
+	// entries survive reopening
+	if err = j.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if j, err = jobjournal.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	entries, err := j.Unfinished()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 2 || entries[0].Job.ID != "urgent" || entries[1].Job.ID != "normal" {
+		t.Fatalf("unfinished = %v, want urgent and normal", entries)
+	}
+
+	if entries[0].State != imagedto.JobStateRunning || entries[1].State != imagedto.JobStateQueued {
+		t.Fatalf("states = %s, %s, want running, queued", entries[0].State, entries[1].State)
+	}
+
+	if deleted, err := j.Compact(time.Now()); err != nil || deleted != 1 {
+		t.Fatalf("compact deleted %d, %v, want the finished job", deleted, err)
+	}
+
+	if deleted, err := j.Compact(time.Now()); err != nil || deleted != 0 {
+		t.Fatalf("second compact deleted %d, %v, want none", deleted, err)
+	}
+}
@@ -0,0 +1,339 @@
+// Package pathtemplate implements the small template language used to lay out images in storage.
+//
+// A template is a slash separated path whose segments may contain placeholders in curly braces, e.g.
+// "{shop}/{product}/{mode}/{w}x{h}/{name}.{ext}". A segment whose placeholders all expand to an empty value is
+// dropped, so the same template can describe both the original image and its variants.
+//
+// Supported placeholders:
+//
+//	{shop}, {tenant}  the shop ID
+//	{product}         the product ID
+//	{mode}            original, scale, crop, minxmaxy or minymaxx
+//	{dir}             the legacy variant folder: <dim>, <x>x<y>, minxmaxy/<x>x<y> or minymaxx/<x>x<y>
+//	{dim}             <dim> when scaling, <x>x<y> otherwise
+//	{w}, {h}          the requested width and height
+//	{file}            the full file name
+//	{name}, {ext}     the file name without its extension and the extension without the dot
+//
+// Every image and variant must map to its own path, so a template has to reference the file, with {file} or with both
+// {name} and {ext}, and the variant, with {dir} or with {mode} and either {dim} or both {w} and {h}.
+package pathtemplate
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// DefaultLayout is the layout the service has always used: <shop>/<product>/<variant folder>/<file name>.
+const DefaultLayout = "{shop}/{product}/{dir}/{file}"
+
+type Mode string
+
+const (
+	ModeOriginal Mode = "original"
+	ModeScale    Mode = "scale"
+	ModeCrop     Mode = "crop"
+	ModeMinXMaxY Mode = "minxmaxy"
+	ModeMinYMaxX Mode = "minymaxx"
+)
+
+var (
+	ErrInvalidTemplate = errors.New("INVALID_PATH_TEMPLATE")
+	ErrInvalidValue    = errors.New("INVALID_PATH_VALUE")
+
+	placeholders = map[string]func(v *Vars) string{
+		"shop":    func(v *Vars) string { return v.ShopID },
+		"tenant":  func(v *Vars) string { return v.ShopID },
+		"product": func(v *Vars) string { return v.ProductID },
+		"mode":    func(v *Vars) string { return string(v.Mode) },
+		"dir":     (*Vars).dir,
+		"dim":     (*Vars).dim,
+		"w":       func(v *Vars) string { return itoa(v.Width) },
+		"h":       func(v *Vars) string { return itoa(v.Height) },
+		"file":    func(v *Vars) string { return v.FileName },
+		"name":    func(v *Vars) string { return strings.TrimSuffix(v.FileName, path.Ext(v.FileName)) },
+		"ext":     func(v *Vars) string { return strings.TrimPrefix(path.Ext(v.FileName), ".") },
+	}
+
+	defaultTemplate = mustParse(DefaultLayout)
+)
+
+// Vars holds the values a template is expanded with. Empty values are treated as unknown.
+type Vars struct {
+	ShopID    string
+	ProductID string
+	Mode      Mode
+	Width     int
+	Height    int
+	FileName  string
+}
+
+type Template struct {
+	raw      string
+	segments [][]part
+}
+
+type part struct {
+	literal     string
+	placeholder string
+}
+
+// Default returns the template for DefaultLayout.
+func Default() *Template {
+	return defaultTemplate
+}
+
+// Parse parses the given layout. An empty layout results in the default template.
+func Parse(layout string) (*Template, error) {
+	layout = strings.Trim(strings.TrimSpace(layout), "/")
+	if layout == "" {
+		return defaultTemplate, nil
+	}
+
+	return parse(layout)
+}
+
+// MustParse is like Parse but panics if the layout is invalid.
+func MustParse(layout string) *Template {
+	t, err := Parse(layout)
+	if err != nil {
+		panic(err)
+	}
+
+	return t
+}
+
+func (t *Template) String() string {
+	return t.raw
+}
+
+func mustParse(layout string) *Template {
+	t, err := parse(layout)
+	if err != nil {
+		panic(err)
+	}
+
+	return t
+}
+
+// Validate returns ErrInvalidValue if a value would add or escape path segments: one containing a slash, . or .. .
+func (v *Vars) Validate() error {
+	for _, value := range []struct{ name, value string }{
+		{name: "shop", value: v.ShopID},
+		{name: "product", value: v.ProductID},
+		{name: "file", value: v.FileName},
+	} {
+		if !safe(value.value) {
+			return fmt.Errorf("%w: %s %q", ErrInvalidValue, value.name, value.value)
+		}
+	}
+
+	return nil
+}
+
+// Expand returns the path for the given values. Segments whose placeholders are all empty are omitted. Values that do
+// not pass Validate are replaced with an underscore, so that the path never leaves the layout of the template.
+func (t *Template) Expand(v *Vars) string {
+	v = v.sanitised()
+	segments := make([]string, 0, len(t.segments))
+
+	for _, seg := range t.segments {
+		s, hasPlaceholder, empty := expandSegment(seg, v)
+		if hasPlaceholder && empty {
+			continue
+		}
+
+		segments = append(segments, s)
+	}
+
+	return path.Join(segments...)
+}
+
+// Prefix returns the leading part of the path that can be determined from the given values, stopping at the first
+// segment that references an empty value. It is used to narrow storage listings, e.g. to a shop or a product.
+func (t *Template) Prefix(v *Vars) string {
+	v = v.sanitised()
+	segments := make([]string, 0, len(t.segments))
+
+	for _, seg := range t.segments {
+		if !segmentComplete(seg, v) {
+			break
+		}
+
+		s, _, _ := expandSegment(seg, v)
+		segments = append(segments, s)
+	}
+
+	return path.Join(segments...)
+}
+
+func parse(layout string) (*Template, error) {
+	t := &Template{raw: layout}
+
+	for _, s := range strings.Split(layout, "/") {
+		if s == "" {
+			continue
+		}
+
+		seg, err := parseSegment(s)
+		if err != nil {
+			return nil, fmt.Errorf("%w in %s", err, layout)
+		}
+
+		t.segments = append(t.segments, seg)
+	}
+
+	if err := t.checkUnique(); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// checkUnique returns ErrInvalidTemplate unless the template tells every file and every variant apart.
+func (t *Template) checkUnique() error {
+	used := make(map[string]bool)
+
+	for _, seg := range t.segments {
+		for _, p := range seg {
+			used[p.placeholder] = true
+		}
+	}
+
+	if !used["file"] && !(used["name"] && used["ext"]) {
+		return fmt.Errorf("%w: %s does not reference the file, use {file} or {name} and {ext}", ErrInvalidTemplate, t.raw)
+	}
+
+	if !used["dir"] && !(used["mode"] && (used["dim"] || (used["w"] && used["h"]))) {
+		return fmt.Errorf(
+			"%w: %s does not tell variants apart, use {dir} or {mode} with {dim} or {w} and {h}",
+			ErrInvalidTemplate,
+			t.raw,
+		)
+	}
+
+	return nil
+}
+
+func parseSegment(s string) ([]part, error) {
+	parts := make([]part, 0)
+
+	for s != "" {
+		open := strings.IndexByte(s, '{')
+		closing := strings.IndexByte(s, '}')
+
+		switch {
+		case open < 0 && closing < 0:
+			return append(parts, part{literal: s}), nil
+		case open < 0 || closing < open:
+			return nil, fmt.Errorf("%w: unbalanced braces in %q", ErrInvalidTemplate, s)
+		}
+
+		if open > 0 {
+			parts = append(parts, part{literal: s[:open]})
+		}
+
+		name := s[open+1 : closing]
+		if strings.ContainsRune(name, '{') {
+			return nil, fmt.Errorf("%w: unbalanced braces in %q", ErrInvalidTemplate, s)
+		}
+
+		if _, ok := placeholders[name]; !ok {
+			return nil, fmt.Errorf("%w: unknown placeholder {%s}", ErrInvalidTemplate, name)
+		}
+
+		parts = append(parts, part{placeholder: name})
+		s = s[closing+1:]
+	}
+
+	return parts, nil
+}
+
+func expandSegment(seg []part, v *Vars) (s string, hasPlaceholder, empty bool) {
+	var sb strings.Builder
+
+	empty = true
+
+	for _, p := range seg {
+		if p.placeholder == "" {
+			sb.WriteString(p.literal)
+			continue
+		}
+
+		hasPlaceholder = true
+
+		if value := placeholders[p.placeholder](v); value != "" {
+			empty = false
+
+			sb.WriteString(value)
+		}
+	}
+
+	return sb.String(), hasPlaceholder, empty
+}
+
+func segmentComplete(seg []part, v *Vars) bool {
+	for _, p := range seg {
+		if p.placeholder != "" && placeholders[p.placeholder](v) == "" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// sanitised returns a copy of v with the values that do not pass Validate replaced.
+func (v *Vars) sanitised() *Vars {
+	c := *v
+
+	for _, value := range []*string{&c.ShopID, &c.ProductID, &c.FileName} {
+		if !safe(*value) {
+			*value = "_"
+		}
+	}
+
+	return &c
+}
+
+func safe(value string) bool {
+	return !strings.ContainsAny(value, `/\`) && value != "." && value != ".."
+}
+
+func (v *Vars) dir() string {
+	switch v.Mode {
+	case ModeScale:
+		return itoa(v.Width)
+	case ModeCrop:
+		return v.dimensions()
+	case ModeMinXMaxY, ModeMinYMaxX:
+		return path.Join(string(v.Mode), v.dimensions())
+	default:
+		return ""
+	}
+}
+
+func (v *Vars) dim() string {
+	switch v.Mode {
+	case ModeScale:
+		return itoa(v.Width)
+	case ModeCrop, ModeMinXMaxY, ModeMinYMaxX:
+		return v.dimensions()
+	default:
+		return ""
+	}
+}
+
+func (v *Vars) dimensions() string {
+	return fmt.Sprintf("%dx%d", v.Width, v.Height)
+}
+
+func itoa(i int) string {
+	if i == 0 {
+		return ""
+	}
+
+	return strconv.Itoa(i)
+}
@@ -0,0 +1,138 @@
+package pathtemplate_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/mikarios/imageresizer/internal/pathtemplate"
+)
+
+// nolint:funlen // table tests
+func TestTemplate_Expand(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		layout string
+		vars   pathtemplate.Vars
+		want   string
+		prefix string
+	}{
+		{
+			name:   "default original",
+			vars:   pathtemplate.Vars{ShopID: "1", ProductID: "asd", Mode: pathtemplate.ModeOriginal, FileName: "a.jpg"},
+			want:   "1/asd/a.jpg",
+			prefix: "1/asd",
+		},
+		{
+			name: "default scale",
+			vars: pathtemplate.Vars{
+				ShopID: "1", ProductID: "asd", Mode: pathtemplate.ModeScale, Width: 1000, Height: 1000, FileName: "a.jpg",
+			},
+			want:   "1/asd/1000/a.jpg",
+			prefix: "1/asd/1000/a.jpg",
+		},
+		{
+			name: "default minxmaxy",
+			vars: pathtemplate.Vars{
+				ShopID: "1", ProductID: "asd", Mode: pathtemplate.ModeMinXMaxY, Width: 100, Height: 50, FileName: "a.jpg",
+			},
+			want:   "1/asd/minxmaxy/100x50/a.jpg",
+			prefix: "1/asd/minxmaxy/100x50/a.jpg",
+		},
+		{
+			name:   "default shop only",
+			vars:   pathtemplate.Vars{ShopID: "1"},
+			want:   "1",
+			prefix: "1",
+		},
+		{
+			name:   "custom crop",
+			layout: "/{tenant}/{product}/{mode}/{w}x{h}/{name}.{ext}/",
+			vars: pathtemplate.Vars{
+				ShopID: "1", ProductID: "asd", Mode: pathtemplate.ModeCrop, Width: 100, Height: 50, FileName: "a.jpg",
+			},
+			want:   "1/asd/crop/100x50/a.jpg",
+			prefix: "1/asd/crop/100x50/a.jpg",
+		},
+		{
+			name:   "custom original drops empty dimensions",
+			layout: "shops/{tenant}/{product}/{mode}/{w}x{h}/{name}.{ext}",
+			vars:   pathtemplate.Vars{ShopID: "1", ProductID: "asd", Mode: pathtemplate.ModeOriginal, FileName: "a.jpg"},
+			want:   "shops/1/asd/original/a.jpg",
+			prefix: "shops/1/asd/original",
+		},
+		{
+			name:   "custom without product",
+			layout: "{shop}/{mode}-{dim}/{file}",
+			vars:   pathtemplate.Vars{ShopID: "1", Mode: pathtemplate.ModeScale, Width: 300, FileName: "a.jpg"},
+			want:   "1/scale-300/a.jpg",
+			prefix: "1/scale-300/a.jpg",
+		},
+		{
+			name:   "unsafe values are replaced",
+			vars:   pathtemplate.Vars{ShopID: "1", ProductID: "../../x", Mode: pathtemplate.ModeOriginal, FileName: ".."},
+			want:   "1/_/_",
+			prefix: "1/_",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			tmpl, err := pathtemplate.Parse(tt.layout)
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+
+			if got := tmpl.Expand(&tt.vars); got != tt.want {
+				t.Errorf("Expand() = %v, want %v", got, tt.want)
+			}
+
+			if got := tmpl.Prefix(&tt.vars); got != tt.prefix {
+				t.Errorf("Prefix() = %v, want %v", got, tt.prefix)
+			}
+		})
+	}
+}
+
+func TestParse_Invalid(t *testing.T) {
+	t.Parallel()
+
+	for _, layout := range []string{
+		"{shop}/{unknown}",
+		"{shop/{file}",
+		"{shop}}/{file}",
+		"shop}/{file}",
+		"{shop}/{dir}/{name}",
+		"{shop}/{product}/{file}",
+		"{shop}/{dim}/{file}",
+		"{shop}/{mode}/{w}/{file}",
+	} {
+		if _, err := pathtemplate.Parse(layout); !errors.Is(err, pathtemplate.ErrInvalidTemplate) {
+			t.Errorf("Parse(%q) error = %v, want %v", layout, err, pathtemplate.ErrInvalidTemplate)
+		}
+	}
+}
+
+func TestVars_Validate(t *testing.T) {
+	t.Parallel()
+
+	valid := pathtemplate.Vars{ShopID: "1", ProductID: "p..1", FileName: "a.jpg"}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("Validate(%+v) error = %v", valid, err)
+	}
+
+	for _, v := range []pathtemplate.Vars{
+		{ShopID: "1", ProductID: "../../x", FileName: "a.jpg"},
+		{ShopID: "1", ProductID: "p", FileName: ".."},
+		{ShopID: "1", ProductID: "p", FileName: "a/b.jpg"},
+		{ShopID: "1", ProductID: `p\q`, FileName: "a.jpg"},
+	} {
+		if err := v.Validate(); !errors.Is(err, pathtemplate.ErrInvalidValue) {
+			t.Errorf("Validate(%+v) error = %v, want %v", v, err, pathtemplate.ErrInvalidValue)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package queues_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/mikarios/imageresizer/internal/queues"
+	"github.com/mikarios/imageresizer/internal/services/config"
+	"github.com/mikarios/imageresizer/pkg/dtos/imagedto"
+)
+
+// newBroker starts a queue on a broker for the test, along with a function returning the bodies of its dead letters.
+// The queue is closed when the test finishes.
+type newBroker func(t *testing.T, queueCfg *config.QueueConfig) (q queues.Q, deadLetters func() [][]byte)
+
+// TestBrokers runs the behaviour every broker has to provide against each of them.
+func TestBrokers(t *testing.T) {
+	t.Parallel()
+
+	brokers := map[string]newBroker{
+		queues.BrokerMemory: newMemoryBroker,
+		queues.BrokerNATS:   newNATSBroker,
+		queues.BrokerRedis:  newRedisBroker,
+		queues.BrokerSQS:    newSQSBroker,
+	}
+
+	for name, newBroker := range brokers {
+		newBroker := newBroker
+
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			q, deadLetters := newBroker(t, &config.QueueConfig{MaxRetries: 1, RetryDelay: 10 * time.Millisecond})
+			testBroker(t, q, deadLetters)
+		})
+	}
+}
+
+// testBroker checks that urgent jobs overtake normal ones, that acknowledged jobs are not delivered again and that
+// failed jobs are retried once and then dead lettered.
+func testBroker(t *testing.T, q queues.Q, deadLetters func() [][]byte) {
+	t.Helper()
+
+	for _, job := range []*queues.Job{
+		{ImageJob: &imagedto.ImageProcessJobData{ID: "normal"}, Priority: imagedto.PriorityNormal},
+		{ImageJob: &imagedto.ImageProcessJobData{ID: "urgent"}, Priority: imagedto.PriorityUrgent},
+	} {
+		if err := q.Publish(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	messages, err := q.Consume()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := receive(t, messages)
+	if id := jobID(t, first); id != "urgent" {
+		t.Fatalf("first job = %s, want urgent", id)
+	}
+
+	if err = first.Ack(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		m := receive(t, messages)
+		if id := jobID(t, m); id != "normal" {
+			t.Fatalf("delivery %d = %s, want normal", i, id)
+		}
+
+		if err = m.Retry(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case m := <-messages:
+		t.Fatalf("received %s after every job was settled", jobID(t, m))
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	dead := deadLetters()
+
+	job := &imagedto.ImageProcessJobData{}
+	if len(dead) != 1 || json.Unmarshal(dead[0], job) != nil || job.ID != "normal" {
+		t.Fatalf("dead letters = %q, want the normal job", dead)
+	}
+}
+
+func receive(t *testing.T, messages <-chan queues.Message) queues.Message {
+	t.Helper()
+
+	select {
+	case m := <-messages:
+		return m
+	case <-time.After(time.Second):
+		t.Fatal("no message received")
+		return nil
+	}
+}
+
+func jobID(t *testing.T, m queues.Message) string {
+	t.Helper()
+
+	job := &imagedto.ImageProcessJobData{}
+	if err := json.Unmarshal(m.Body(), job); err != nil {
+		t.Fatal(err)
+	}
+
+	return job.ID
+}
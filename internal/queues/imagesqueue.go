@@ -1,82 +1,135 @@
 package queues
 
 import (
+	"context"
 	"encoding/json"
+	"sync"
+	"time"
 
 	"github.com/streadway/amqp"
 
+	"github.com/mikarios/golib/logger"
 	"github.com/mikarios/golib/queue"
 
 	"github.com/mikarios/imageresizer/internal/services/config"
+	"github.com/mikarios/imageresizer/pkg/dtos/imagedto"
 )
 
+// The arguments of an existing queue cannot change, so the queue with dead lettering and priorities is declared under a
+// new name. Consumers move the binding of the exchange from the legacy queue to the new one and keep consuming the
+// legacy queue as well, so it drains while the instances are rolled out. Once it is empty and no instance of an older
+// version runs any more, since those would bind it again, it can be deleted, e.g. with
+// `rabbitmqctl delete_queue imageQueue`.
 const (
-	imageExchangeName = "imageExchange"
-	imageQueueName    = "imageQueue"
-	imageKey          = "imageKey"
+	imageExchangeName    = "imageExchange"
+	imageQueueName       = "imageQueue.v2"
+	legacyImageQueueName = "imageQueue"
+	imageKey             = "imageKey"
+
+	// urgent jobs are delivered before normal ones, see x-max-priority
+	priorityNormal uint8 = 0
+	priorityUrgent uint8 = 1
+	maxPriority          = priorityUrgent
 )
 
+// ImageQ is the image queue on RabbitMQ.
 type ImageQ struct {
-	imageQueue *queue.RabbitMQ
+	imageQueue *session
+	cfg        *config.RabbitMQConfig
+	queueCfg   *config.QueueConfig
 }
 
-func ImagePublisher(cfg *config.RabbitMQConfig) (*ImageQ, error) {
-	r, err := queue.NewQueue(&queue.RabbitMQConf{URL: cfg.URL})
-	if err != nil {
-		return nil, err
-	}
+// amqpMessage is a delivery of the image queue.
+type amqpMessage struct {
+	delivery amqp.Delivery
+	queue    *ImageQ
+}
 
-	if err := declareExchange(r, imageExchangeName); err != nil {
-		return nil, err
-	}
+func (m *amqpMessage) Body() []byte {
+	return m.delivery.Body
+}
 
-	if _, err := declareQueue(r, imageQueueName); err != nil {
-		return nil, err
-	}
+func (m *amqpMessage) Ack() error {
+	return m.delivery.Ack(false)
+}
 
-	return &ImageQ{imageQueue: r}, nil
+func (m *amqpMessage) Reject() error {
+	return m.delivery.Nack(false, false)
 }
 
-func ImageConsumer(cfg *config.RabbitMQConfig) (*ImageQ, error) {
-	r, err := queue.NewQueue(&queue.RabbitMQConf{URL: cfg.URL})
+func (m *amqpMessage) Retry() error {
+	r, err := m.queue.imageQueue.get()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	if err := declareExchange(r, imageExchangeName); err != nil {
-		return nil, err
+	// publishing the retry on the new channel of a reconnection while the broker redelivers the original would process
+	// the job twice
+	if m.delivery.Acknowledger != amqp.Acknowledger(r.Ch) {
+		return errStaleDelivery
 	}
 
-	if _, err := declareQueue(r, imageQueueName); err != nil {
-		return nil, err
-	}
+	return retry(r, m.queue.queueCfg, imageQueueName, &m.delivery)
+}
+
+func ImagePublisher(cfg *config.RabbitMQConfig, queueCfg *config.QueueConfig) (*ImageQ, error) {
+	s, err := newSession(cfg, errImageQueue, func(r *queue.RabbitMQ) error {
+		if err := declareExchange(r, imageExchangeName); err != nil {
+			return err
+		}
 
-	if err := bindQueue(r, imageQueueName, imageKey, imageExchangeName); err != nil {
+		_, err := declareQueue(r, queueCfg, imageQueueName, imageExchangeName, imageKey)
+
+		return err
+	})
+	if err != nil {
 		return nil, err
 	}
 
-	ch := make(chan *amqp.Error)
+	return &ImageQ{imageQueue: s, cfg: cfg, queueCfg: queueCfg}, nil
+}
+
+func ImageConsumer(cfg *config.RabbitMQConfig, queueCfg *config.QueueConfig) (*ImageQ, error) {
+	s, err := newSession(cfg, errImageQueue, func(r *queue.RabbitMQ) error {
+		if err := declareExchange(r, imageExchangeName); err != nil {
+			return err
+		}
+
+		if _, err := declareQueue(r, queueCfg, imageQueueName, imageExchangeName, imageKey); err != nil {
+			return err
+		}
+
+		if err := bindQueue(r, imageQueueName, imageKey, imageExchangeName); err != nil {
+			return err
+		}
 
-	go panicOnError(ch, errImageQueue)
+		if !queueExists(r, legacyImageQueueName) {
+			return nil
+		}
 
-	r.Ch.NotifyClose(ch)
+		return r.Ch.QueueUnbind(legacyImageQueueName, imageKey, imageExchangeName, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
 
-	return &ImageQ{imageQueue: r}, nil
+	return &ImageQ{imageQueue: s, cfg: cfg, queueCfg: queueCfg}, nil
 }
 
+// Publish queues the job. Urgent jobs are published with a higher priority so they overtake the normal ones waiting in
+// the queue.
 func (i *ImageQ) Publish(job *Job) error {
 	b, err := json.Marshal(job.ImageJob)
 	if err != nil {
 		return err
 	}
 
-	ch := make(chan *amqp.Error)
-
-	go panicOnError(ch, errImageQueue)
-
-	i.imageQueue.Ch.NotifyClose(ch)
+	r, err := i.imageQueue.get()
+	if err != nil {
+		return err
+	}
 
-	return i.imageQueue.Ch.Publish(
+	return r.Ch.Publish(
 		imageExchangeName,
 		imageKey,
 		false,
@@ -84,24 +137,115 @@ func (i *ImageQ) Publish(job *Job) error {
 		amqp.Publishing{
 			ContentType:  "application/json",
 			DeliveryMode: amqp.Persistent,
+			Priority:     messagePriority(job.Priority),
 			Body:         b,
 		},
 	)
 }
 
-func (i *ImageQ) Consume() (<-chan amqp.Delivery, error) {
-	return i.imageQueue.Ch.Consume(
-		imageQueueName,
-		"",
-		false,
-		false,
-		false,
-		false,
-		nil,
-	)
+// Consume returns the deliveries of the image queue. Consumption resumes on every reconnection and the channel is only
+// closed once the queue is closed. Deliveries received before a reconnection cannot be acknowledged any more, the
+// broker redelivers them.
+func (i *ImageQ) Consume() (<-chan Message, error) {
+	r, err := i.imageQueue.get()
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries, err := consume(r, i.queueCfg.Prefetch)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan Message)
+
+	go func() {
+		defer close(out)
+
+		for {
+			for d := range deliveries {
+				out <- &amqpMessage{delivery: d, queue: i}
+			}
+
+			for deliveries = nil; deliveries == nil; {
+				if r = i.imageQueue.next(r); r == nil {
+					return
+				}
+
+				if deliveries, err = consume(r, i.queueCfg.Prefetch); err != nil {
+					logger.Error(context.Background(), err, "could not resume consuming")
+					time.Sleep(i.cfg.ReconnectDelay)
+				}
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+// consume starts consuming the image queue, and the legacy one while it exists. At most prefetch deliveries are
+// unacknowledged at any time, so the backlog is shared among the replicas and priorities apply to the waiting jobs.
+// Zero means no limit.
+func consume(r *queue.RabbitMQ, prefetch int) (<-chan amqp.Delivery, error) {
+	if prefetch > 0 {
+		if err := r.Ch.Qos(prefetch, 0, false); err != nil {
+			return nil, err
+		}
+	}
+
+	deliveries, err := r.Ch.Consume(imageQueueName, "", false, false, false, false, nil)
+	if err != nil || !queueExists(r, legacyImageQueueName) {
+		return deliveries, err
+	}
+
+	legacy, err := r.Ch.Consume(legacyImageQueueName, "", false, false, false, false, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return mergeDeliveries(deliveries, legacy), nil
+}
+
+// mergeDeliveries forwards the deliveries of both channels to the returned one, which is closed once both are.
+func mergeDeliveries(a, b <-chan amqp.Delivery) <-chan amqp.Delivery {
+	out := make(chan amqp.Delivery)
+
+	var wg sync.WaitGroup
+
+	forward := func(in <-chan amqp.Delivery) {
+		defer wg.Done()
+
+		for d := range in {
+			out <- d
+		}
+	}
+
+	wg.Add(2)
+
+	go forward(a)
+	go forward(b)
+
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+
+	return out
+}
+
+// Ready reports whether the queue is connected to the broker.
+func (i *ImageQ) Ready() bool {
+	return i.imageQueue.Ready()
 }
 
 func (i *ImageQ) Close() {
-	_ = i.imageQueue.Ch.Close()
-	_ = i.imageQueue.Conn.Close()
+	i.imageQueue.Close()
+}
+
+func messagePriority(priority imagedto.PriorityType) uint8 {
+	if priority == imagedto.PriorityUrgent {
+		return priorityUrgent
+	}
+
+	return priorityNormal
 }
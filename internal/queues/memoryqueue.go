@@ -0,0 +1,227 @@
+package queues
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/mikarios/imageresizer/internal/services/config"
+	"github.com/mikarios/imageresizer/pkg/dtos/imagedto"
+)
+
+const memoryQueueCapacity = 100000
+
+var (
+	errQueueClosed     = errors.New("queue closed")
+	errMessageSettled  = errors.New("message already settled")
+	errMemoryQueueFull = errors.New("memory queue full")
+)
+
+// MemoryQ is an in process image queue with the same semantics as the brokers: priorities, prefetch, delayed retries
+// and a dead letter queue. Jobs are lost on restart, so it is meant for development and tests.
+type MemoryQ struct {
+	cfg *config.QueueConfig
+
+	mu       sync.Mutex
+	urgent   []*memoryMessage
+	normal   []*memoryMessage
+	dead     [][]byte
+	inFlight int
+	notify   chan struct{}
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+type memoryMessage struct {
+	queue    *MemoryQ
+	body     []byte
+	priority imagedto.PriorityType
+	attempt  int
+	settled  bool
+}
+
+func NewMemoryQ(cfg *config.QueueConfig) *MemoryQ {
+	return &MemoryQ{
+		cfg:    cfg,
+		notify: make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+}
+
+func (q *MemoryQ) Publish(job *Job) error {
+	b, err := json.Marshal(job.ImageJob)
+	if err != nil {
+		return err
+	}
+
+	return q.push(&memoryMessage{queue: q, body: b, priority: job.Priority})
+}
+
+// Consume returns the deliveries of the queue, urgent jobs first. The channel is closed once the queue is closed.
+func (q *MemoryQ) Consume() (<-chan Message, error) {
+	if !q.Ready() {
+		return nil, errQueueClosed
+	}
+
+	out := make(chan Message)
+
+	go func() {
+		defer close(out)
+
+		for {
+			m := q.pop()
+			if m == nil {
+				select {
+				case <-q.notify:
+					continue
+				case <-q.closed:
+					return
+				}
+			}
+
+			select {
+			case out <- m:
+			case <-q.closed:
+				return
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+// DeadLetters returns the bodies of the messages parked in the dead letter queue.
+func (q *MemoryQ) DeadLetters() [][]byte {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return append([][]byte(nil), q.dead...)
+}
+
+func (q *MemoryQ) Ready() bool {
+	select {
+	case <-q.closed:
+		return false
+	default:
+		return true
+	}
+}
+
+func (q *MemoryQ) Close() {
+	q.closeOnce.Do(func() { close(q.closed) })
+}
+
+func (q *MemoryQ) push(m *memoryMessage) error {
+	if !q.Ready() {
+		return errQueueClosed
+	}
+
+	q.mu.Lock()
+
+	if len(q.urgent)+len(q.normal) >= memoryQueueCapacity {
+		q.mu.Unlock()
+
+		return errMemoryQueueFull
+	}
+
+	if m.priority == imagedto.PriorityUrgent {
+		q.urgent = append(q.urgent, m)
+	} else {
+		q.normal = append(q.normal, m)
+	}
+
+	q.mu.Unlock()
+	q.signal()
+
+	return nil
+}
+
+// pop returns the next message, or nil if there is none or the prefetch limit is reached.
+func (q *MemoryQ) pop() *memoryMessage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.cfg.Prefetch > 0 && q.inFlight >= q.cfg.Prefetch {
+		return nil
+	}
+
+	var m *memoryMessage
+
+	switch {
+	case len(q.urgent) > 0:
+		m, q.urgent = q.urgent[0], q.urgent[1:]
+	case len(q.normal) > 0:
+		m, q.normal = q.normal[0], q.normal[1:]
+	default:
+		return nil
+	}
+
+	q.inFlight++
+
+	return m
+}
+
+func (q *MemoryQ) signal() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// settle marks the message as handled, freeing its prefetch slot.
+func (q *MemoryQ) settle(m *memoryMessage) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if m.settled {
+		return errMessageSettled
+	}
+
+	m.settled = true
+	q.inFlight--
+
+	q.signal()
+
+	return nil
+}
+
+func (m *memoryMessage) Body() []byte {
+	return m.body
+}
+
+func (m *memoryMessage) Ack() error {
+	return m.queue.settle(m)
+}
+
+func (m *memoryMessage) Reject() error {
+	if err := m.queue.settle(m); err != nil {
+		return err
+	}
+
+	m.queue.mu.Lock()
+	defer m.queue.mu.Unlock()
+
+	m.queue.dead = append(m.queue.dead, m.body)
+
+	return nil
+}
+
+func (m *memoryMessage) Retry() error {
+	if m.attempt >= m.queue.cfg.MaxRetries {
+		return m.Reject()
+	}
+
+	if err := m.queue.settle(m); err != nil {
+		return err
+	}
+
+	retried := &memoryMessage{queue: m.queue, body: m.body, priority: m.priority, attempt: m.attempt + 1}
+
+	time.AfterFunc(m.queue.cfg.RetryDelay<<m.attempt, func() {
+		_ = m.queue.push(retried)
+	})
+
+	return nil
+}
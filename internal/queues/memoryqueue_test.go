@@ -0,0 +1,57 @@
+package queues_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mikarios/imageresizer/internal/queues"
+	"github.com/mikarios/imageresizer/internal/services/config"
+	"github.com/mikarios/imageresizer/pkg/dtos/imagedto"
+)
+
+func newMemoryBroker(t *testing.T, queueCfg *config.QueueConfig) (queues.Q, func() [][]byte) {
+	t.Helper()
+
+	q := queues.NewMemoryQ(queueCfg)
+	t.Cleanup(q.Close)
+
+	return q, q.DeadLetters
+}
+
+func TestMemoryQ_Prefetch(t *testing.T) {
+	t.Parallel()
+
+	q := queues.NewMemoryQ(&config.QueueConfig{Prefetch: 1})
+	defer q.Close()
+
+	for _, id := range []string{"first", "second"} {
+		if err := q.Publish(&queues.Job{ImageJob: &imagedto.ImageProcessJobData{ID: id}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	messages, err := q.Consume()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := receive(t, messages)
+
+	select {
+	case m := <-messages:
+		t.Fatalf("received %s while the prefetch limit is reached", jobID(t, m))
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	if err = first.Ack(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = first.Ack(); err == nil {
+		t.Error("settling a message twice should fail")
+	}
+
+	if id := jobID(t, receive(t, messages)); id != "second" {
+		t.Errorf("job after ack = %s, want second", id)
+	}
+}
@@ -0,0 +1,371 @@
+package queues
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/mikarios/golib/logger"
+
+	"github.com/mikarios/imageresizer/internal/services/config"
+	"github.com/mikarios/imageresizer/pkg/dtos/imagedto"
+)
+
+const (
+	natsUrgentWait = 50 * time.Millisecond
+	natsNormalWait = time.Second
+	natsDeadSuffix = "_DEAD"
+	// natsDefaultAckWait is the AckWait of JetStream if NATS_ACK_WAIT is not set.
+	natsDefaultAckWait = 30 * time.Second
+)
+
+var errNATSQueue = errors.New("got error from NATS image queue")
+
+// NATSQ is the image queue on NATS JetStream. Jobs are stored in a work queue stream under <subject>.urgent and
+// <subject>.normal, each consumed by its own durable pull consumer so that urgent jobs are fetched first. Failed jobs
+// are redelivered with a delay and, once their retries are exhausted, moved to the <stream>_DEAD stream. The consumers
+// do not limit the deliveries themselves, since JetStream silently drops a message whose last delivery is never
+// settled, e.g. because the consumer crashed. Jobs delivered more often than the retries allow are dead lettered
+// instead. Jobs being processed are reported in progress every half AckWait, so that they are not redelivered while
+// they run.
+type NATSQ struct {
+	cfg      *config.NATSConfig
+	queueCfg *config.QueueConfig
+	conn     *nats.Conn
+	js       nats.JetStreamContext
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+type natsMessage struct {
+	msg   *nats.Msg
+	queue *NATSQ
+
+	settleOnce sync.Once
+	settled    chan struct{}
+}
+
+// NewNATSQ connects to NATS and declares the streams. The connection is re-established automatically when lost.
+func NewNATSQ(cfg *config.NATSConfig, queueCfg *config.QueueConfig) (*NATSQ, error) {
+	ctx := context.Background()
+
+	conn, err := nats.Connect(
+		cfg.URL,
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			logger.Error(ctx, errNATSQueue, "disconnected, reconnecting", err)
+		}),
+		nats.ReconnectHandler(func(_ *nats.Conn) {
+			logger.Info(ctx, "reconnected to NATS")
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &NATSQ{cfg: cfg, queueCfg: queueCfg, conn: conn, closed: make(chan struct{})}
+
+	if q.js, err = conn.JetStream(); err != nil {
+		conn.Close()
+
+		return nil, err
+	}
+
+	if err = q.declareStreams(); err != nil {
+		conn.Close()
+
+		return nil, err
+	}
+
+	return q, nil
+}
+
+func (q *NATSQ) declareStreams() error {
+	streams := []*nats.StreamConfig{
+		{
+			Name:      q.cfg.Stream,
+			Subjects:  []string{q.cfg.Subject + ".>"},
+			Retention: nats.WorkQueuePolicy,
+			Storage:   nats.FileStorage,
+		},
+		{
+			Name:     q.cfg.Stream + natsDeadSuffix,
+			Subjects: []string{q.deadSubject()},
+			Storage:  nats.FileStorage,
+		},
+	}
+
+	for _, stream := range streams {
+		if _, err := q.js.StreamInfo(stream.Name); err == nil {
+			if _, err = q.js.UpdateStream(stream); err != nil {
+				return fmt.Errorf("could not update stream %s: %w", stream.Name, err)
+			}
+
+			continue
+		} else if !errors.Is(err, nats.ErrStreamNotFound) {
+			return err
+		}
+
+		if _, err := q.js.AddStream(stream); err != nil {
+			return fmt.Errorf("could not add stream %s: %w", stream.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// Publish stores the job. The job ID, if set, is used as the message ID so that JetStream drops duplicates.
+func (q *NATSQ) Publish(job *Job) error {
+	b, err := json.Marshal(job.ImageJob)
+	if err != nil {
+		return err
+	}
+
+	opts := make([]nats.PubOpt, 0, 1)
+	if job.ImageJob.ID != "" {
+		opts = append(opts, nats.MsgId(job.ImageJob.ID))
+	}
+
+	_, err = q.js.Publish(q.prioritySubject(job.Priority), b, opts...)
+
+	return err
+}
+
+// Consume returns the jobs of both consumers, urgent first. The channel is closed once the queue is closed.
+func (q *NATSQ) Consume() (<-chan Message, error) {
+	urgent, err := q.subscribe(imagedto.PriorityUrgent)
+	if err != nil {
+		return nil, err
+	}
+
+	normal, err := q.subscribe(imagedto.PriorityNormal)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan Message)
+
+	go func() {
+		defer close(out)
+
+		for {
+			select {
+			case <-q.closed:
+				return
+			default:
+			}
+
+			msgs, err := urgent.Fetch(1, nats.MaxWait(natsUrgentWait))
+			if len(msgs) == 0 {
+				msgs, err = normal.Fetch(1, nats.MaxWait(natsNormalWait))
+			}
+
+			if err != nil && !errors.Is(err, nats.ErrTimeout) {
+				logger.Error(context.Background(), err, "could not fetch jobs")
+				q.sleep(natsNormalWait)
+			}
+
+			for _, msg := range msgs {
+				m := &natsMessage{msg: msg, queue: q, settled: make(chan struct{})}
+
+				if q.exhausted(msg) {
+					if err = m.Reject(); err != nil {
+						logger.Error(context.Background(), err, "could not dead letter unsettled job")
+					}
+
+					continue
+				}
+
+				go m.keepInProgress()
+
+				select {
+				case out <- m:
+				case <-q.closed:
+					return
+				}
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+func (q *NATSQ) subscribe(priority imagedto.PriorityType) (*nats.Subscription, error) {
+	durable := q.cfg.Durable + "-" + string(priority)
+
+	// consumers declared by earlier versions limit the deliveries
+	if info, err := q.js.ConsumerInfo(q.cfg.Stream, durable); err == nil && info.Config.MaxDeliver != -1 {
+		info.Config.MaxDeliver = -1
+
+		if _, err = q.js.UpdateConsumer(q.cfg.Stream, &info.Config); err != nil {
+			return nil, fmt.Errorf("could not lift the delivery limit of consumer %s: %w", durable, err)
+		}
+	}
+
+	opts := []nats.SubOpt{
+		nats.BindStream(q.cfg.Stream),
+		nats.ManualAck(),
+		nats.AckExplicit(),
+		nats.MaxDeliver(-1),
+	}
+
+	if q.cfg.AckWait > 0 {
+		opts = append(opts, nats.AckWait(q.cfg.AckWait))
+	}
+
+	if q.queueCfg.Prefetch > 0 {
+		opts = append(opts, nats.MaxAckPending(q.queueCfg.Prefetch))
+	}
+
+	return q.js.PullSubscribe(q.prioritySubject(priority), durable, opts...)
+}
+
+// exhausted reports whether the message was delivered more often than the retries allow, i.e. an earlier delivery
+// exhausted them but was never settled.
+func (q *NATSQ) exhausted(msg *nats.Msg) bool {
+	meta, err := msg.Metadata()
+
+	return err == nil && meta.NumDelivered > uint64(q.queueCfg.MaxRetries+1)
+}
+
+func (q *NATSQ) Ready() bool {
+	return q.conn.IsConnected()
+}
+
+func (q *NATSQ) Close() {
+	q.closeOnce.Do(func() {
+		close(q.closed)
+		q.conn.Close()
+	})
+}
+
+func (q *NATSQ) prioritySubject(priority imagedto.PriorityType) string {
+	if priority == imagedto.PriorityUrgent {
+		return q.cfg.Subject + "." + string(imagedto.PriorityUrgent)
+	}
+
+	return q.cfg.Subject + "." + string(imagedto.PriorityNormal)
+}
+
+func (q *NATSQ) deadSubject() string {
+	return q.cfg.Subject + "_dead"
+}
+
+func (q *NATSQ) sleep(d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-q.closed:
+	}
+}
+
+func (m *natsMessage) Body() []byte {
+	return m.msg.Data
+}
+
+func (m *natsMessage) Ack() error {
+	return m.settle(func() error { return m.msg.Ack() })
+}
+
+// Reject moves the message to the dead letter stream.
+func (m *natsMessage) Reject() error {
+	return m.settle(m.reject)
+}
+
+func (m *natsMessage) reject() error {
+	if _, err := m.queue.js.Publish(m.queue.deadSubject(), m.msg.Data); err != nil {
+		_ = m.msg.Nak()
+
+		return fmt.Errorf("could not dead letter message: %w", err)
+	}
+
+	return m.msg.Term()
+}
+
+// Retry redelivers the message after a delay doubling with every delivery, or dead letters it once the retries are
+// exhausted.
+func (m *natsMessage) Retry() error {
+	return m.settle(func() error {
+		meta, err := m.msg.Metadata()
+		if err != nil {
+			return err
+		}
+
+		attempt := int(meta.NumDelivered)
+		if attempt > m.queue.queueCfg.MaxRetries {
+			return m.reject()
+		}
+
+		return m.msg.NakWithDelay(retryDelay(m.queue.queueCfg, attempt))
+	})
+}
+
+// settle runs fn unless the message was settled already and stops reporting it in progress.
+func (m *natsMessage) settle(fn func() error) error {
+	err := errMessageSettled
+
+	m.settleOnce.Do(func() {
+		close(m.settled)
+
+		err = fn()
+	})
+
+	return err
+}
+
+// keepInProgress reports the message in progress every half AckWait, until it is settled, so that JetStream does not
+// redeliver it while the job runs.
+func (m *natsMessage) keepInProgress() {
+	ackWait := m.queue.cfg.AckWait
+	if ackWait <= 0 {
+		ackWait = natsDefaultAckWait
+	}
+
+	ticker := time.NewTicker(ackWait / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := m.msg.InProgress(); err != nil {
+				logger.Error(context.Background(), err, "could not report job in progress")
+			}
+		case <-m.settled:
+			return
+		case <-m.queue.closed:
+			return
+		}
+	}
+}
+
+// natsResultQ publishes the reports of finished jobs to a NATS subject, over the connection of the image queue.
+type natsResultQ struct {
+	queue   *NATSQ
+	subject string
+}
+
+// ResultQueue returns a queue publishing the reports of finished jobs to the given subject.
+func (q *NATSQ) ResultQueue(subject string) ResultQueue {
+	return &natsResultQ{queue: q, subject: subject}
+}
+
+func (r *natsResultQ) Publish(report *imagedto.JobReport) error {
+	b, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	return r.queue.conn.Publish(r.subject, b)
+}
+
+func (r *natsResultQ) Ready() bool {
+	return r.queue.Ready()
+}
+
+// Close is a no-op, the connection is closed along with the image queue.
+func (r *natsResultQ) Close() {}
@@ -0,0 +1,247 @@
+package queues_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+
+	"github.com/mikarios/imageresizer/internal/queues"
+	"github.com/mikarios/imageresizer/internal/services/config"
+	"github.com/mikarios/imageresizer/pkg/dtos/imagedto"
+)
+
+func newNATSBroker(t *testing.T, queueCfg *config.QueueConfig) (queues.Q, func() [][]byte) {
+	t.Helper()
+
+	cfg := startNATS(t)
+
+	q, err := queues.NewNATSQ(cfg, queueCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(q.Close)
+
+	return q, func() [][]byte {
+		dead, err := natsDeadLetters(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return dead
+	}
+}
+
+func TestNATSQ_Duplicates(t *testing.T) {
+	t.Parallel()
+
+	q, err := queues.NewNATSQ(startNATS(t), &config.QueueConfig{MaxRetries: 1, RetryDelay: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	for i := 0; i < 2; i++ {
+		if err = q.Publish(&queues.Job{ImageJob: &imagedto.ImageProcessJobData{ID: "job"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	messages, err := q.Consume()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = receive(t, messages).Ack(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case m := <-messages:
+		t.Fatalf("received the duplicate of %s", jobID(t, m))
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// startNATS runs a JetStream enabled server for the test and returns the configuration of a queue on it.
+func startNATS(t *testing.T) *config.NATSConfig {
+	t.Helper()
+
+	ns, err := server.NewServer(&server.Options{Port: -1, JetStream: true, StoreDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go ns.Start()
+	t.Cleanup(ns.Shutdown)
+
+	if !ns.ReadyForConnections(5 * time.Second) {
+		t.Fatal("nats server not ready")
+	}
+
+	return &config.NATSConfig{URL: ns.ClientURL(), Stream: "IMAGES", Subject: "images.jobs", Durable: "test"}
+}
+
+func natsDeadLetters(cfg *config.NATSConfig) ([][]byte, error) {
+	conn, err := nats.Connect(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	js, err := conn.JetStream()
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := js.StreamInfo(cfg.Stream + "_DEAD")
+	if err != nil {
+		return nil, err
+	}
+
+	dead := make([][]byte, 0, info.State.Msgs)
+
+	for seq := info.State.FirstSeq; info.State.Msgs > 0 && seq <= info.State.LastSeq; seq++ {
+		msg, err := js.GetMsg(cfg.Stream+"_DEAD", seq)
+		if err != nil {
+			return nil, err
+		}
+
+		dead = append(dead, msg.Data)
+	}
+
+	return dead, nil
+}
+
+func TestNATSQ_UnsettledDeliveries(t *testing.T) {
+	t.Parallel()
+
+	cfg := startNATS(t)
+	cfg.AckWait = 50 * time.Millisecond
+
+	// a consumer of an earlier version, limiting the deliveries
+	if err := declareLimitedConsumer(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	queueCfg := &config.QueueConfig{MaxRetries: 1, RetryDelay: 10 * time.Millisecond}
+
+	// neither delivery is settled, since the consumers crash while processing it
+	for i := 0; i < 3; i++ {
+		q, err := queues.NewNATSQ(cfg, queueCfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if i == 0 {
+			if err = q.Publish(&queues.Job{ImageJob: &imagedto.ImageProcessJobData{ID: "stuck"}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		messages, err := q.Consume()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the third consumer dead letters the job instead of processing it
+		if i < 2 {
+			if id := jobID(t, receive(t, messages)); id != "stuck" {
+				t.Fatalf("delivery %d = %s, want stuck", i, id)
+			}
+
+			q.Close()
+
+			continue
+		}
+
+		defer q.Close()
+	}
+
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		dead, err := natsDeadLetters(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(dead) == 1 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d dead letters, want the stuck job", len(dead))
+		}
+	}
+}
+
+func TestNATSQ_InProgress(t *testing.T) {
+	t.Parallel()
+
+	cfg := startNATS(t)
+	cfg.AckWait = 100 * time.Millisecond
+
+	q, err := queues.NewNATSQ(cfg, &config.QueueConfig{MaxRetries: 1, RetryDelay: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	if err = q.Publish(&queues.Job{ImageJob: &imagedto.ImageProcessJobData{ID: "slow"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	messages, err := q.Consume()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := receive(t, messages)
+
+	// the job runs for several AckWaits without being redelivered
+	select {
+	case m := <-messages:
+		t.Fatalf("%s redelivered while in progress", jobID(t, m))
+	case <-time.After(5 * cfg.AckWait):
+	}
+
+	if err = m.Retry(); err != nil {
+		t.Fatal(err)
+	}
+
+	if id := jobID(t, receive(t, messages)); id != "slow" {
+		t.Fatalf("retry = %s, want slow", id)
+	}
+}
+
+func declareLimitedConsumer(cfg *config.NATSConfig) error {
+	conn, err := nats.Connect(cfg.URL)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	js, err := conn.JetStream()
+	if err != nil {
+		return err
+	}
+
+	if _, err = js.AddStream(&nats.StreamConfig{
+		Name:      cfg.Stream,
+		Subjects:  []string{cfg.Subject + ".>"},
+		Retention: nats.WorkQueuePolicy,
+	}); err != nil {
+		return err
+	}
+
+	_, err = js.AddConsumer(cfg.Stream, &nats.ConsumerConfig{
+		Durable:       cfg.Durable + "-" + string(imagedto.PriorityNormal),
+		FilterSubject: cfg.Subject + "." + string(imagedto.PriorityNormal),
+		AckPolicy:     nats.AckExplicitPolicy,
+		AckWait:       cfg.AckWait,
+		MaxDeliver:    2,
+	})
+
+	return err
+}
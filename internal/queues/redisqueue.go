@@ -0,0 +1,474 @@
+package queues
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/mikarios/golib/logger"
+
+	"github.com/mikarios/imageresizer/internal/services/config"
+	"github.com/mikarios/imageresizer/pkg/dtos/imagedto"
+)
+
+const (
+	redisFieldJob     = "job"
+	redisFieldAttempt = "attempt"
+	redisDeadSuffix   = ":dead"
+	redisRetrySuffix  = ":retry"
+	redisBlock        = time.Second
+	redisRetryBatch   = 100
+	redisPingTimeout  = 2 * time.Second
+)
+
+var (
+	errRedisQueue = errors.New("got error from redis image queue")
+
+	// promoteRetry moves a retry (ARGV[1]) from the retry set (KEYS[1]) to the stream (KEYS[2]) as the job ARGV[2]
+	// with the attempt ARGV[3]. Returns 0 if another consumer moved it already.
+	promoteRetry = redis.NewScript(`
+if redis.call('ZREM', KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call('XADD', KEYS[2], '*', '` + redisFieldJob + `', ARGV[2], '` + redisFieldAttempt + `', ARGV[3])
+return 1
+`)
+)
+
+// RedisQ is the image queue on Redis Streams. Jobs are added to the <stream>:urgent and <stream>:normal streams and
+// read through a consumer group, urgent first. Jobs left pending by a crashed consumer are claimed by the others once
+// idle for ClaimMinIdle, every delivery counting as a retry. Failed jobs wait in the <stream>:retry sorted set, scored
+// by the time they are due, and are moved to the <stream>:dead stream once their retries are exhausted.
+type RedisQ struct {
+	cfg      *config.RedisConfig
+	queueCfg *config.QueueConfig
+	client   *redis.Client
+	consumer string
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+}
+
+type redisMessage struct {
+	queue    *RedisQ
+	stream   string
+	id       string
+	body     []byte
+	attempt  int
+	priority imagedto.PriorityType
+
+	settleOnce sync.Once
+	release    func()
+}
+
+// redisRetry is a member of the retry set.
+type redisRetry struct {
+	ID       string                `json:"id"`
+	Priority imagedto.PriorityType `json:"priority"`
+	Attempt  int                   `json:"attempt"`
+	Job      json.RawMessage       `json:"job"`
+}
+
+// NewRedisQ connects to Redis and creates the consumer group of both streams.
+func NewRedisQ(cfg *config.RedisConfig, queueCfg *config.QueueConfig) (*RedisQ, error) {
+	opts, err := redis.ParseURL(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid url: %s", errRedisQueue, err.Error())
+	}
+
+	consumer := cfg.Consumer
+	if consumer == "" {
+		if consumer, err = os.Hostname(); err != nil {
+			return nil, err
+		}
+	}
+
+	q := &RedisQ{cfg: cfg, queueCfg: queueCfg, client: redis.NewClient(opts), consumer: consumer}
+	q.ctx, q.cancel = context.WithCancel(context.Background())
+
+	for _, priority := range []imagedto.PriorityType{imagedto.PriorityUrgent, imagedto.PriorityNormal} {
+		err = q.client.XGroupCreateMkStream(q.ctx, q.priorityStream(priority), cfg.Group, "0").Err()
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			q.Close()
+
+			return nil, fmt.Errorf("could not create consumer group %s: %w", cfg.Group, err)
+		}
+	}
+
+	return q, nil
+}
+
+// Publish adds the job to the stream of its priority.
+func (q *RedisQ) Publish(job *Job) error {
+	b, err := json.Marshal(job.ImageJob)
+	if err != nil {
+		return err
+	}
+
+	return q.add(q.ctx, q.client, q.priorityStream(job.Priority), b, 0)
+}
+
+func (q *RedisQ) add(ctx context.Context, c redis.Cmdable, stream string, body []byte, attempt int) error {
+	return c.XAdd(ctx, &redis.XAddArgs{
+		Stream: stream,
+		Values: map[string]interface{}{redisFieldJob: body, redisFieldAttempt: attempt},
+	}).Err()
+}
+
+// Consume returns the jobs of both streams, urgent first, along with the jobs claimed from crashed consumers and the
+// retries that are due. At most Prefetch jobs are handed out unsettled. The channel is closed once the queue is closed.
+func (q *RedisQ) Consume() (<-chan Message, error) {
+	out := make(chan Message)
+
+	var inFlight chan struct{}
+	if q.queueCfg.Prefetch > 0 {
+		inFlight = make(chan struct{}, q.queueCfg.Prefetch)
+	}
+
+	go func() {
+		defer close(out)
+
+		lastClaim := time.Time{}
+
+		for q.ctx.Err() == nil {
+			if inFlight != nil {
+				select {
+				case inFlight <- struct{}{}:
+				case <-q.ctx.Done():
+					return
+				}
+			}
+
+			block, err := q.promoteRetries()
+			if err != nil {
+				q.logError(err, "could not requeue retries")
+			}
+
+			var m *redisMessage
+
+			if q.cfg.ClaimMinIdle > 0 && time.Since(lastClaim) > q.cfg.ClaimMinIdle/2 {
+				if m, err = q.claim(); m == nil {
+					lastClaim = time.Now()
+				}
+			}
+
+			if m == nil && err == nil {
+				m, err = q.read(block)
+			}
+
+			if err != nil {
+				q.logError(err, "could not read jobs")
+				q.sleep(redisBlock)
+			}
+
+			if m == nil {
+				if inFlight != nil {
+					<-inFlight
+				}
+
+				continue
+			}
+
+			if inFlight != nil {
+				m.release = func() { <-inFlight }
+			}
+
+			select {
+			case out <- m:
+			case <-q.ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+// read returns the next urgent job, or waits up to block for a normal one. Returns nil if there is none.
+func (q *RedisQ) read(block time.Duration) (*redisMessage, error) {
+	for _, priority := range []imagedto.PriorityType{imagedto.PriorityUrgent, imagedto.PriorityNormal} {
+		// a negative block does not wait at all
+		wait := time.Duration(-1)
+		if priority == imagedto.PriorityNormal {
+			wait = block
+		}
+
+		streams, err := q.client.XReadGroup(q.ctx, &redis.XReadGroupArgs{
+			Group:    q.cfg.Group,
+			Consumer: q.consumer,
+			Streams:  []string{q.priorityStream(priority), ">"},
+			Count:    1,
+			Block:    wait,
+		}).Result()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return nil, err
+		}
+
+		for _, s := range streams {
+			for _, msg := range s.Messages {
+				return q.message(priority, &msg), nil
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+// claim takes over a job left pending by another consumer for longer than ClaimMinIdle. Returns nil if there is none.
+func (q *RedisQ) claim() (*redisMessage, error) {
+	for _, priority := range []imagedto.PriorityType{imagedto.PriorityUrgent, imagedto.PriorityNormal} {
+		msgs, _, err := q.client.XAutoClaim(q.ctx, &redis.XAutoClaimArgs{
+			Stream:   q.priorityStream(priority),
+			Group:    q.cfg.Group,
+			MinIdle:  q.cfg.ClaimMinIdle,
+			Start:    "0-0",
+			Count:    1,
+			Consumer: q.consumer,
+		}).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, msg := range msgs {
+			m := q.message(priority, &msg)
+
+			deliveries, err := q.deliveries(m)
+			if err != nil {
+				return nil, err
+			}
+
+			// e.g. a job crashing every consumer that takes it
+			if m.attempt+deliveries-1 > q.queueCfg.MaxRetries {
+				logger.Warning(q.ctx, "dead lettering job delivered too often", msg.ID, deliveries)
+
+				return nil, m.Reject()
+			}
+
+			logger.Info(q.ctx, "claimed pending job", msg.ID)
+
+			return m, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// deliveries returns how often the pending job has been delivered, including the current delivery.
+func (q *RedisQ) deliveries(m *redisMessage) (int, error) {
+	pending, err := q.client.XPendingExt(q.ctx, &redis.XPendingExtArgs{
+		Stream: m.stream,
+		Group:  q.cfg.Group,
+		Start:  m.id,
+		End:    m.id,
+		Count:  1,
+	}).Result()
+	if err != nil || len(pending) == 0 {
+		return 1, err
+	}
+
+	return int(pending[0].RetryCount), nil
+}
+
+// promoteRetries moves the retries that are due back to their stream and returns how long to wait for new jobs, which
+// is until the next retry is due but at most redisBlock. Every retry is removed from the set and added to its stream
+// atomically, so that exactly one consumer moves it.
+func (q *RedisQ) promoteRetries() (time.Duration, error) {
+	due, err := q.client.ZRangeByScore(q.ctx, q.retrySet(), &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(time.Now().UnixMilli(), 10),
+		Count: redisRetryBatch,
+	}).Result()
+	if err != nil {
+		return redisBlock, err
+	}
+
+	for _, member := range due {
+		r := &redisRetry{}
+		if err = json.Unmarshal([]byte(member), r); err != nil {
+			q.logError(err, "dropping invalid retry", member)
+			_ = q.client.ZRem(q.ctx, q.retrySet(), member).Err()
+
+			continue
+		}
+
+		keys := []string{q.retrySet(), q.priorityStream(r.Priority)}
+		if err = promoteRetry.Run(q.ctx, q.client, keys, member, []byte(r.Job), r.Attempt).Err(); err != nil {
+			return redisBlock, err
+		}
+	}
+
+	next, err := q.client.ZRangeWithScores(q.ctx, q.retrySet(), 0, 0).Result()
+	if err != nil || len(next) == 0 {
+		return redisBlock, err
+	}
+
+	block := time.Until(time.UnixMilli(int64(next[0].Score)))
+
+	switch {
+	case block > redisBlock:
+		return redisBlock, nil
+	case block < time.Millisecond:
+		// zero would block until a job arrives
+		return time.Millisecond, nil
+	default:
+		return block, nil
+	}
+}
+
+func (q *RedisQ) message(priority imagedto.PriorityType, msg *redis.XMessage) *redisMessage {
+	m := &redisMessage{queue: q, stream: q.priorityStream(priority), id: msg.ID, priority: priority}
+
+	if v, ok := msg.Values[redisFieldJob].(string); ok {
+		m.body = []byte(v)
+	}
+
+	if v, ok := msg.Values[redisFieldAttempt].(string); ok {
+		m.attempt, _ = strconv.Atoi(v)
+	}
+
+	return m
+}
+
+// Ready reports whether Redis answers.
+func (q *RedisQ) Ready() bool {
+	ctx, cancel := context.WithTimeout(q.ctx, redisPingTimeout)
+	defer cancel()
+
+	return q.client.Ping(ctx).Err() == nil
+}
+
+func (q *RedisQ) Close() {
+	q.closeOnce.Do(func() {
+		q.cancel()
+		_ = q.client.Close()
+	})
+}
+
+func (q *RedisQ) priorityStream(priority imagedto.PriorityType) string {
+	if priority == imagedto.PriorityUrgent {
+		return q.cfg.Stream + ":" + string(imagedto.PriorityUrgent)
+	}
+
+	return q.cfg.Stream + ":" + string(imagedto.PriorityNormal)
+}
+
+func (q *RedisQ) deadStream() string {
+	return q.cfg.Stream + redisDeadSuffix
+}
+
+func (q *RedisQ) retrySet() string {
+	return q.cfg.Stream + redisRetrySuffix
+}
+
+func (q *RedisQ) sleep(d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-q.ctx.Done():
+	}
+}
+
+func (q *RedisQ) logError(err error, msgs ...interface{}) {
+	if q.ctx.Err() == nil {
+		logger.Error(q.ctx, err, msgs...)
+	}
+}
+
+func (m *redisMessage) Body() []byte {
+	return m.body
+}
+
+// Ack acknowledges the job and deletes it from the stream.
+func (m *redisMessage) Ack() error {
+	return m.settle(nil)
+}
+
+// Reject moves the job to the dead letter stream.
+func (m *redisMessage) Reject() error {
+	return m.settle(func(pipe redis.Pipeliner) {
+		_ = m.queue.add(m.queue.ctx, pipe, m.queue.deadStream(), m.body, m.attempt)
+	})
+}
+
+// Retry schedules the job again after a delay doubling with every attempt, or dead letters it once the retries are
+// exhausted.
+func (m *redisMessage) Retry() error {
+	attempt := m.attempt + 1
+	if attempt > m.queue.queueCfg.MaxRetries {
+		return m.Reject()
+	}
+
+	member, err := json.Marshal(&redisRetry{ID: m.id, Priority: m.priority, Attempt: attempt, Job: m.body})
+	if err != nil {
+		return err
+	}
+
+	due := time.Now().Add(retryDelay(m.queue.queueCfg, attempt))
+
+	return m.settle(func(pipe redis.Pipeliner) {
+		pipe.ZAdd(m.queue.ctx, m.queue.retrySet(), redis.Z{Score: float64(due.UnixMilli()), Member: member})
+	})
+}
+
+// settle acknowledges and deletes the job in a transaction along with the commands queued by then. Only the first call
+// has any effect.
+func (m *redisMessage) settle(then func(pipe redis.Pipeliner)) error {
+	err := errMessageSettled
+
+	m.settleOnce.Do(func() {
+		_, err = m.queue.client.TxPipelined(m.queue.ctx, func(pipe redis.Pipeliner) error {
+			if then != nil {
+				then(pipe)
+			}
+
+			pipe.XAck(m.queue.ctx, m.stream, m.queue.cfg.Group, m.id)
+			pipe.XDel(m.queue.ctx, m.stream, m.id)
+
+			return nil
+		})
+
+		if m.release != nil {
+			m.release()
+		}
+	})
+
+	return err
+}
+
+// redisResultQ adds the reports of finished jobs to a stream, over the connection of the image queue.
+type redisResultQ struct {
+	queue  *RedisQ
+	stream string
+}
+
+// ResultQueue returns a queue adding the reports of finished jobs to the given stream.
+func (q *RedisQ) ResultQueue(stream string) ResultQueue {
+	return &redisResultQ{queue: q, stream: stream}
+}
+
+func (r *redisResultQ) Publish(report *imagedto.JobReport) error {
+	b, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	return r.queue.client.XAdd(r.queue.ctx, &redis.XAddArgs{
+		Stream: r.stream,
+		Values: map[string]interface{}{"report": b},
+	}).Err()
+}
+
+func (r *redisResultQ) Ready() bool {
+	return r.queue.Ready()
+}
+
+// Close is a no-op, the connection is closed along with the image queue.
+func (r *redisResultQ) Close() {}
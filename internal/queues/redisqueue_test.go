@@ -0,0 +1,231 @@
+package queues_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/mikarios/imageresizer/internal/queues"
+	"github.com/mikarios/imageresizer/internal/services/config"
+	"github.com/mikarios/imageresizer/pkg/dtos/imagedto"
+)
+
+func newRedisBroker(t *testing.T, queueCfg *config.QueueConfig) (queues.Q, func() [][]byte) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { _ = client.Close() })
+
+	cfg := &config.RedisConfig{URL: "redis://" + mr.Addr(), Stream: "images:jobs", Group: "test", Consumer: "worker"}
+
+	q, err := queues.NewRedisQ(cfg, queueCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(q.Close)
+
+	return q, func() [][]byte {
+		entries, err := client.XRange(context.Background(), cfg.Stream+":dead", "-", "+").Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dead := make([][]byte, 0, len(entries))
+		for _, entry := range entries {
+			dead = append(dead, []byte(entry.Values["job"].(string)))
+		}
+
+		return dead
+	}
+}
+
+func TestRedisQ_Claim(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+
+	defer client.Close()
+
+	cfg := &config.RedisConfig{
+		URL:          "redis://" + mr.Addr(),
+		Stream:       "images:jobs",
+		Group:        "test",
+		Consumer:     "worker",
+		ClaimMinIdle: 50 * time.Millisecond,
+	}
+
+	q, err := queues.NewRedisQ(cfg, &config.QueueConfig{MaxRetries: 1, RetryDelay: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	for _, id := range []string{"crashed", "normal"} {
+		if err = q.Publish(&queues.Job{ImageJob: &imagedto.ImageProcessJobData{ID: id}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// another consumer reads the first job and never settles it
+	if err = client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    cfg.Group,
+		Consumer: "crashed",
+		Streams:  []string{cfg.Stream + ":normal", ">"},
+		Count:    1,
+		Block:    -1,
+	}).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(2 * cfg.ClaimMinIdle)
+
+	messages, err := q.Consume()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"crashed", "normal"} {
+		m := receive(t, messages)
+		if id := jobID(t, m); id != want {
+			t.Fatalf("job = %s, want %s", id, want)
+		}
+
+		if err = m.Ack(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n, _ := client.XLen(ctx, cfg.Stream+":normal").Result(); n != 0 {
+		t.Fatalf("%d jobs left in the stream, want none", n)
+	}
+}
+
+func TestRedisQ_ClaimLimit(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+
+	defer client.Close()
+
+	cfg := &config.RedisConfig{
+		URL:          "redis://" + mr.Addr(),
+		Stream:       "images:jobs",
+		Group:        "test",
+		Consumer:     "worker",
+		ClaimMinIdle: 50 * time.Millisecond,
+	}
+
+	q, err := queues.NewRedisQ(cfg, &config.QueueConfig{MaxRetries: 1, RetryDelay: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	if err = q.Publish(&queues.Job{ImageJob: &imagedto.ImageProcessJobData{ID: "poison"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the job crashes the consumer that reads it and the one that claims it
+	if err = client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    cfg.Group,
+		Consumer: "crashed",
+		Streams:  []string{cfg.Stream + ":normal", ">"},
+		Count:    1,
+		Block:    -1,
+	}).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(2 * cfg.ClaimMinIdle)
+
+	if err = client.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+		Stream:   cfg.Stream + ":normal",
+		Group:    cfg.Group,
+		MinIdle:  cfg.ClaimMinIdle,
+		Start:    "0-0",
+		Count:    1,
+		Consumer: "crashed again",
+	}).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(2 * cfg.ClaimMinIdle)
+
+	messages, err := q.Consume()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case m := <-messages:
+		t.Fatalf("received %s after its retries were exhausted", jobID(t, m))
+	case <-time.After(4 * cfg.ClaimMinIdle):
+	}
+
+	if dead, _ := client.XLen(ctx, cfg.Stream+":dead").Result(); dead != 1 {
+		t.Fatalf("got %d dead letters, want the poison job", dead)
+	}
+}
+
+func TestRedisQ_PromoteRetries(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+
+	defer client.Close()
+
+	cfg := &config.RedisConfig{URL: "redis://" + mr.Addr(), Stream: "images:jobs", Group: "test", Consumer: "worker"}
+	queueCfg := &config.QueueConfig{MaxRetries: 2, RetryDelay: 10 * time.Millisecond}
+
+	// two consumers compete for the retry
+	for _, consumer := range []string{"first", "second"} {
+		consumerCfg := *cfg
+		consumerCfg.Consumer = consumer
+
+		q, err := queues.NewRedisQ(&consumerCfg, queueCfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer q.Close()
+
+		if consumer == "first" {
+			if err = q.Publish(&queues.Job{ImageJob: &imagedto.ImageProcessJobData{ID: "failing"}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		messages, err := q.Consume()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if consumer == "first" {
+			if err = receive(t, messages).Retry(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if n, _ := client.ZCard(ctx, cfg.Stream+":retry").Result(); n != 0 {
+		t.Fatalf("%d retries left in the set, want none", n)
+	}
+
+	// the retry was promoted once and is pending with one of the consumers
+	pending, err := client.XPending(ctx, cfg.Stream+":normal", cfg.Group).Result()
+	if err != nil || pending.Count != 1 {
+		t.Fatalf("pending = %+v, %v, want the retried job once", pending, err)
+	}
+}
@@ -0,0 +1,64 @@
+package queues
+
+import (
+	"encoding/json"
+
+	"github.com/streadway/amqp"
+
+	"github.com/mikarios/golib/queue"
+
+	"github.com/mikarios/imageresizer/internal/services/config"
+	"github.com/mikarios/imageresizer/pkg/dtos/imagedto"
+)
+
+// ResultQ publishes the reports of finished jobs to the configured result exchange.
+type ResultQ struct {
+	resultQueue *session
+	exchange    string
+	routingKey  string
+}
+
+func ResultPublisher(cfg *config.RabbitMQConfig) (*ResultQ, error) {
+	s, err := newSession(cfg, errResultQueue, func(r *queue.RabbitMQ) error {
+		return declareExchange(r, cfg.ResultExchange)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &ResultQ{resultQueue: s, exchange: cfg.ResultExchange, routingKey: cfg.ResultRoutingKey}, nil
+}
+
+func (i *ResultQ) Publish(report *imagedto.JobReport) error {
+	b, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	r, err := i.resultQueue.get()
+	if err != nil {
+		return err
+	}
+
+	return r.Ch.Publish(
+		i.exchange,
+		i.routingKey,
+		false,
+		false,
+		amqp.Publishing{
+			ContentType:  "application/json",
+			DeliveryMode: amqp.Persistent,
+			MessageId:    report.JobID,
+			Body:         b,
+		},
+	)
+}
+
+// Ready reports whether the queue is connected to the broker.
+func (i *ResultQ) Ready() bool {
+	return i.resultQueue.Ready()
+}
+
+func (i *ResultQ) Close() {
+	i.resultQueue.Close()
+}
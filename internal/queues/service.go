@@ -1,17 +1,84 @@
 package queues
 
 import (
-	"github.com/streadway/amqp"
+	"time"
 
+	"github.com/mikarios/imageresizer/internal/services/config"
 	"github.com/mikarios/imageresizer/pkg/dtos/imagedto"
 )
 
+const (
+	BrokerRabbitMQ = "rabbitmq"
+	BrokerNATS     = "nats"
+	BrokerRedis    = "redis"
+	BrokerSQS      = "sqs"
+	BrokerMemory   = "memory"
+)
+
+const (
+	// by default a failed job is retried once after a minute
+	defaultMaxRetries = 1
+	defaultRetryDelay = time.Minute
+)
+
 type Job struct {
 	ImageJob *imagedto.ImageProcessJobData
+	Priority imagedto.PriorityType
 }
 
+// Message is a job delivered by a broker. Exactly one of Ack, Reject, Retry should be called once it is handled.
+type Message interface {
+	imagedto.QueueMessage
+	Body() []byte
+}
+
+// Q is a queue of image jobs, regardless of the broker behind it.
 type Q interface {
 	Publish(job *Job) error
-	Consume() (<-chan amqp.Delivery, error)
+	Consume() (<-chan Message, error)
+	Ready() bool
+	Close()
+}
+
+// ResultQueue publishes the reports of finished jobs.
+type ResultQueue interface {
+	Publish(report *imagedto.JobReport) error
+	Ready() bool
 	Close()
 }
+
+// WithDefaults returns a copy of cfg with the defaults applied to the settings that are not set. Prefetch defaults to
+// concurrentJobs, the number of jobs processed at the same time, so that every job slot is kept busy without holding
+// more jobs than needed. A negative MaxRetries disables retries and a negative Prefetch lifts the limit.
+func WithDefaults(cfg *config.QueueConfig, concurrentJobs int) *config.QueueConfig {
+	res := *cfg
+
+	switch {
+	case res.Prefetch == 0:
+		res.Prefetch = concurrentJobs
+	case res.Prefetch < 0:
+		res.Prefetch = 0
+	}
+
+	switch {
+	case res.MaxRetries == 0:
+		res.MaxRetries = defaultMaxRetries
+	case res.MaxRetries < 0:
+		res.MaxRetries = 0
+	}
+
+	if res.RetryDelay <= 0 {
+		res.RetryDelay = defaultRetryDelay
+	}
+
+	return &res
+}
+
+var (
+	_ Q           = (*ImageQ)(nil)
+	_ Q           = (*MemoryQ)(nil)
+	_ Q           = (*NATSQ)(nil)
+	_ Q           = (*RedisQ)(nil)
+	_ Q           = (*SQSQ)(nil)
+	_ ResultQueue = (*ResultQ)(nil)
+)
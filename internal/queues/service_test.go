@@ -0,0 +1,33 @@
+package queues_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mikarios/imageresizer/internal/queues"
+	"github.com/mikarios/imageresizer/internal/services/config"
+)
+
+func TestWithDefaults(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		cfg, want config.QueueConfig
+	}{
+		"unset": {want: config.QueueConfig{Prefetch: 4, MaxRetries: 1, RetryDelay: time.Minute}},
+		"negative": {
+			cfg:  config.QueueConfig{Prefetch: -1, MaxRetries: -1},
+			want: config.QueueConfig{RetryDelay: time.Minute},
+		},
+		"set": {
+			cfg:  config.QueueConfig{Prefetch: 2, MaxRetries: 3, RetryDelay: time.Second},
+			want: config.QueueConfig{Prefetch: 2, MaxRetries: 3, RetryDelay: time.Second},
+		},
+	}
+
+	for name, tt := range tests {
+		if got := queues.WithDefaults(&tt.cfg, 4); *got != tt.want {
+			t.Errorf("%s: WithDefaults() = %+v, want %+v", name, *got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package queues
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+
+	"github.com/mikarios/golib/logger"
+	"github.com/mikarios/golib/queue"
+
+	"github.com/mikarios/imageresizer/internal/services/config"
+)
+
+var errBrokerUnavailable = errors.New("rabbitMQ unavailable")
+
+// session keeps a connection and channel to the broker. Whenever either of them closes it reconnects with backoff and
+// runs setup again, so that the topology is declared on the new channel.
+type session struct {
+	cfg   *config.RabbitMQConfig
+	err   error
+	setup func(r *queue.RabbitMQ) error
+
+	mu      sync.RWMutex
+	current *queue.RabbitMQ
+	ready   bool
+	changed chan struct{}
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// newSession connects to the broker and keeps the connection alive until Close. err is used when logging failures.
+func newSession(cfg *config.RabbitMQConfig, err error, setup func(r *queue.RabbitMQ) error) (*session, error) {
+	s := &session{
+		cfg:     cfg,
+		err:     err,
+		setup:   setup,
+		changed: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+
+	r, connErr := s.connect()
+	if connErr != nil {
+		return nil, connErr
+	}
+
+	s.setState(r, true)
+
+	go s.watch(r)
+
+	return s, nil
+}
+
+// get returns the current connection, or errBrokerUnavailable while reconnecting.
+func (s *session) get() (*queue.RabbitMQ, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if !s.ready {
+		return nil, errBrokerUnavailable
+	}
+
+	return s.current, nil
+}
+
+// next blocks until a connection other than prev is available. Returns nil once the session is closed.
+func (s *session) next(prev *queue.RabbitMQ) *queue.RabbitMQ {
+	for {
+		s.mu.RLock()
+		r, ready, changed := s.current, s.ready, s.changed
+		s.mu.RUnlock()
+
+		if ready && r != prev {
+			return r
+		}
+
+		select {
+		case <-changed:
+		case <-s.closed:
+			return nil
+		}
+	}
+}
+
+// Ready reports whether the session is connected to the broker.
+func (s *session) Ready() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.ready
+}
+
+func (s *session) Close() {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+
+		s.mu.Lock()
+		r := s.current
+		s.mu.Unlock()
+
+		s.setState(r, false)
+		closeConnection(r)
+	})
+}
+
+func (s *session) setState(r *queue.RabbitMQ, ready bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.current, s.ready = r, ready
+
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// watch waits for the connection or channel to close and reconnects.
+func (s *session) watch(r *queue.RabbitMQ) {
+	ctx := context.Background()
+
+	for {
+		connClosed := r.Conn.NotifyClose(make(chan *amqp.Error, 1))
+		chClosed := r.Ch.NotifyClose(make(chan *amqp.Error, 1))
+
+		var amqpErr *amqp.Error
+
+		select {
+		case <-s.closed:
+			return
+		case amqpErr = <-connClosed:
+		case amqpErr = <-chClosed:
+		}
+
+		select {
+		case <-s.closed:
+			return
+		default:
+		}
+
+		logger.Error(ctx, s.err, "connection lost, reconnecting", amqpErr)
+		s.setState(r, false)
+		closeConnection(r)
+
+		if r = s.reconnect(ctx); r == nil {
+			return
+		}
+
+		s.setState(r, true)
+		logger.Info(ctx, "reconnected to rabbitMQ")
+	}
+}
+
+// reconnect retries connecting, doubling the delay up to the configured maximum. Returns nil if the session is closed
+// in the meantime.
+func (s *session) reconnect(ctx context.Context) *queue.RabbitMQ {
+	delay := s.cfg.ReconnectDelay
+
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-s.closed:
+			return nil
+		case <-time.After(delay):
+		}
+
+		r, err := s.connect()
+		if err == nil {
+			return r
+		}
+
+		logger.Warning(ctx, fmt.Sprintf("%s: reconnect attempt %d failed", s.err.Error(), attempt), err.Error())
+
+		if delay *= 2; s.cfg.ReconnectMaxDelay > 0 && delay > s.cfg.ReconnectMaxDelay {
+			delay = s.cfg.ReconnectMaxDelay
+		}
+
+		if delay <= 0 {
+			delay = time.Second
+		}
+	}
+}
+
+func (s *session) connect() (*queue.RabbitMQ, error) {
+	r, err := queue.NewQueue(&queue.RabbitMQConf{URL: s.cfg.URL})
+	if err != nil {
+		return nil, err
+	}
+
+	if err = s.setup(r); err != nil {
+		closeConnection(r)
+
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func closeConnection(r *queue.RabbitMQ) {
+	if r == nil {
+		return
+	}
+
+	_ = r.Ch.Close()
+	_ = r.Conn.Close()
+}
@@ -0,0 +1,472 @@
+package queues
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	awssession "github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+
+	"github.com/mikarios/golib/logger"
+
+	"github.com/mikarios/imageresizer/internal/services/config"
+	"github.com/mikarios/imageresizer/pkg/dtos/imagedto"
+)
+
+const (
+	// sqsBatchSize is the most messages SQS receives or deletes at once.
+	sqsBatchSize       = 10
+	sqsDeleteFlush     = 100 * time.Millisecond
+	sqsMaxVisibility   = 12 * time.Hour
+	sqsMaxWaitTime     = 20 * time.Second
+	sqsReadyTimeout    = 2 * time.Second
+	sqsReceiveCountKey = sqs.MessageSystemAttributeNameApproximateReceiveCount
+)
+
+var (
+	errSQSQueue  = errors.New("got error from SQS image queue")
+	errSQSClosed = errors.New("SQS queue closed")
+)
+
+// SQSQ is the image queue on SQS. Urgent jobs are sent to their own queue, which is polled before the long poll of the
+// normal one. Received jobs are kept invisible while processed, acknowledged jobs are deleted in batches and failed
+// jobs become visible again after a delay doubling with every delivery.
+type SQSQ struct {
+	cfg      *config.SQSConfig
+	queueCfg *config.QueueConfig
+	client   sqsiface.SQSAPI
+
+	deletes   chan *sqsDelete
+	deleted   chan struct{}
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+}
+
+type sqsMessage struct {
+	queue    *SQSQ
+	queueURL string
+	msg      *sqs.Message
+
+	settleOnce sync.Once
+	settled    chan struct{}
+	release    func()
+}
+
+// sqsDelete is a message waiting to be deleted along with others of the same queue.
+type sqsDelete struct {
+	queueURL string
+	receipt  *string
+	done     chan error
+}
+
+// NewSQSQ connects to SQS, or to the server at Endpoint if set. Static credentials are used if ID is set, otherwise the
+// default ones of the environment.
+func NewSQSQ(cfg *config.SQSConfig, queueCfg *config.QueueConfig) (*SQSQ, error) {
+	awsCfg := &aws.Config{Region: aws.String(cfg.Region)}
+
+	if cfg.ID != "" {
+		awsCfg.Credentials = credentials.NewStaticCredentials(cfg.ID, cfg.Secret, cfg.Token)
+	}
+
+	if cfg.Endpoint != "" {
+		awsCfg.Endpoint = aws.String(cfg.Endpoint)
+	}
+
+	sess, err := awssession.NewSession(awsCfg)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errSQSQueue, err.Error())
+	}
+
+	return NewSQSQWithClient(sqs.New(sess), cfg, queueCfg), nil
+}
+
+// NewSQSQWithClient returns the queue using the given client.
+func NewSQSQWithClient(client sqsiface.SQSAPI, cfg *config.SQSConfig, queueCfg *config.QueueConfig) *SQSQ {
+	q := &SQSQ{
+		cfg:      cfg,
+		queueCfg: queueCfg,
+		client:   client,
+		deletes:  make(chan *sqsDelete),
+		deleted:  make(chan struct{}),
+	}
+	q.ctx, q.cancel = context.WithCancel(context.Background())
+
+	go q.deleteLoop()
+
+	return q
+}
+
+// Publish sends the job to the queue of its priority.
+func (q *SQSQ) Publish(job *Job) error {
+	b, err := json.Marshal(job.ImageJob)
+	if err != nil {
+		return err
+	}
+
+	_, err = q.client.SendMessageWithContext(q.ctx, &sqs.SendMessageInput{
+		QueueUrl:    aws.String(q.priorityQueue(job.Priority)),
+		MessageBody: aws.String(string(b)),
+	})
+
+	return err
+}
+
+// Consume returns the jobs of both queues, urgent first. At most Prefetch jobs are handed out unsettled. The channel is
+// closed once the queue is closed.
+func (q *SQSQ) Consume() (<-chan Message, error) {
+	out := make(chan Message)
+
+	var inFlight chan struct{}
+	if q.queueCfg.Prefetch > 0 {
+		inFlight = make(chan struct{}, q.queueCfg.Prefetch)
+	}
+
+	go func() {
+		defer close(out)
+
+		for q.ctx.Err() == nil {
+			msgs, err := q.receive()
+			if err != nil {
+				q.logError(err, "could not receive jobs")
+				q.sleep(time.Second)
+			}
+
+			for _, m := range msgs {
+				if inFlight != nil {
+					select {
+					case inFlight <- struct{}{}:
+						m.release = func() { <-inFlight }
+					case <-q.ctx.Done():
+						return
+					}
+				}
+
+				select {
+				case out <- m:
+				case <-q.ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+// receive returns the waiting urgent jobs, or long polls the normal queue if there are none.
+func (q *SQSQ) receive() ([]*sqsMessage, error) {
+	queueURLs := []string{q.cfg.QueueURL}
+	if q.cfg.UrgentQueueURL != "" {
+		queueURLs = []string{q.cfg.UrgentQueueURL, q.cfg.QueueURL}
+	}
+
+	for i, queueURL := range queueURLs {
+		input := &sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(queueURL),
+			MaxNumberOfMessages: aws.Int64(q.batchSize()),
+			AttributeNames:      []*string{aws.String(sqsReceiveCountKey)},
+		}
+
+		if i == len(queueURLs)-1 {
+			input.WaitTimeSeconds = aws.Int64(seconds(q.cfg.WaitTime, sqsMaxWaitTime))
+		}
+
+		if q.cfg.VisibilityTimeout > 0 {
+			input.VisibilityTimeout = aws.Int64(seconds(q.cfg.VisibilityTimeout, sqsMaxVisibility))
+		}
+
+		out, err := q.client.ReceiveMessageWithContext(q.ctx, input)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(out.Messages) == 0 {
+			continue
+		}
+
+		msgs := make([]*sqsMessage, 0, len(out.Messages))
+
+		for _, msg := range out.Messages {
+			m := &sqsMessage{queue: q, queueURL: queueURL, msg: msg, settled: make(chan struct{})}
+			if q.cfg.VisibilityTimeout > 0 {
+				go m.keepInvisible()
+			}
+
+			msgs = append(msgs, m)
+		}
+
+		return msgs, nil
+	}
+
+	return nil, nil
+}
+
+// batchSize receives no more jobs than may be handed out at once, so that the rest stay visible to other consumers.
+func (q *SQSQ) batchSize() int64 {
+	if q.queueCfg.Prefetch > 0 && q.queueCfg.Prefetch < sqsBatchSize {
+		return int64(q.queueCfg.Prefetch)
+	}
+
+	return sqsBatchSize
+}
+
+// deleteLoop deletes the acknowledged messages, in batches per queue, once a batch is full or every sqsDeleteFlush.
+func (q *SQSQ) deleteLoop() {
+	defer close(q.deleted)
+
+	pending := make(map[string][]*sqsDelete)
+	ticker := time.NewTicker(sqsDeleteFlush)
+
+	defer ticker.Stop()
+
+	flush := func(ctx context.Context) {
+		for queueURL, batch := range pending {
+			q.deleteBatch(ctx, queueURL, batch)
+			delete(pending, queueURL)
+		}
+	}
+
+	for {
+		select {
+		case d := <-q.deletes:
+			pending[d.queueURL] = append(pending[d.queueURL], d)
+			if len(pending[d.queueURL]) == sqsBatchSize {
+				q.deleteBatch(q.ctx, d.queueURL, pending[d.queueURL])
+				delete(pending, d.queueURL)
+			}
+		case <-ticker.C:
+			flush(q.ctx)
+		case <-q.ctx.Done():
+			// the queue is closing, delete what is left regardless
+			flush(context.Background())
+
+			return
+		}
+	}
+}
+
+func (q *SQSQ) deleteBatch(ctx context.Context, queueURL string, batch []*sqsDelete) {
+	entries := make([]*sqs.DeleteMessageBatchRequestEntry, len(batch))
+	for i, d := range batch {
+		entries[i] = &sqs.DeleteMessageBatchRequestEntry{Id: aws.String(strconv.Itoa(i)), ReceiptHandle: d.receipt}
+	}
+
+	out, err := q.client.DeleteMessageBatchWithContext(ctx, &sqs.DeleteMessageBatchInput{
+		QueueUrl: aws.String(queueURL),
+		Entries:  entries,
+	})
+	if err != nil {
+		for _, d := range batch {
+			d.done <- err
+		}
+
+		return
+	}
+
+	failed := make(map[string]error, len(out.Failed))
+	for _, f := range out.Failed {
+		failed[aws.StringValue(f.Id)] = fmt.Errorf("%w: %s", errSQSQueue, aws.StringValue(f.Message))
+	}
+
+	for i, d := range batch {
+		d.done <- failed[strconv.Itoa(i)]
+	}
+}
+
+// Ready reports whether the queue can be reached.
+func (q *SQSQ) Ready() bool {
+	ctx, cancel := context.WithTimeout(q.ctx, sqsReadyTimeout)
+	defer cancel()
+
+	_, err := q.client.GetQueueAttributesWithContext(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl:       aws.String(q.cfg.QueueURL),
+		AttributeNames: []*string{aws.String(sqs.QueueAttributeNameApproximateNumberOfMessages)},
+	})
+
+	return err == nil
+}
+
+// Close stops consuming and waits for the pending deletions.
+func (q *SQSQ) Close() {
+	q.closeOnce.Do(func() {
+		q.cancel()
+		<-q.deleted
+	})
+}
+
+func (q *SQSQ) priorityQueue(priority imagedto.PriorityType) string {
+	if priority == imagedto.PriorityUrgent && q.cfg.UrgentQueueURL != "" {
+		return q.cfg.UrgentQueueURL
+	}
+
+	return q.cfg.QueueURL
+}
+
+func (q *SQSQ) sleep(d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-q.ctx.Done():
+	}
+}
+
+func (q *SQSQ) logError(err error, msgs ...interface{}) {
+	if q.ctx.Err() == nil {
+		logger.Error(q.ctx, err, msgs...)
+	}
+}
+
+func (m *sqsMessage) Body() []byte {
+	return []byte(aws.StringValue(m.msg.Body))
+}
+
+// Ack deletes the job along with the other jobs acknowledged meanwhile.
+func (m *sqsMessage) Ack() error {
+	return m.settle(func() error {
+		d := &sqsDelete{queueURL: m.queueURL, receipt: m.msg.ReceiptHandle, done: make(chan error, 1)}
+
+		select {
+		case m.queue.deletes <- d:
+			return <-d.done
+		case <-m.queue.ctx.Done():
+			return errSQSClosed
+		}
+	})
+}
+
+// Reject moves the job to the dead letter queue, or drops it if there is none.
+func (m *sqsMessage) Reject() error {
+	return m.settle(m.reject)
+}
+
+func (m *sqsMessage) reject() error {
+	ctx := context.Background()
+
+	if m.queue.cfg.DeadLetterQueueURL != "" {
+		if _, err := m.queue.client.SendMessageWithContext(ctx, &sqs.SendMessageInput{
+			QueueUrl:    aws.String(m.queue.cfg.DeadLetterQueueURL),
+			MessageBody: m.msg.Body,
+		}); err != nil {
+			return fmt.Errorf("could not dead letter message: %w", err)
+		}
+	}
+
+	_, err := m.queue.client.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(m.queueURL),
+		ReceiptHandle: m.msg.ReceiptHandle,
+	})
+
+	return err
+}
+
+// Retry makes the job visible again after a delay doubling with every delivery, or dead letters it once the retries
+// are exhausted.
+func (m *sqsMessage) Retry() error {
+	return m.settle(func() error {
+		attempt, _ := strconv.Atoi(aws.StringValue(m.msg.Attributes[sqsReceiveCountKey]))
+		if attempt < 1 {
+			attempt = 1
+		}
+
+		if attempt > m.queue.queueCfg.MaxRetries {
+			return m.reject()
+		}
+
+		return m.changeVisibility(retryDelay(m.queue.queueCfg, attempt))
+	})
+}
+
+// settle stops extending the visibility of the job and runs fn. Only the first call has any effect.
+func (m *sqsMessage) settle(fn func() error) error {
+	err := errMessageSettled
+
+	m.settleOnce.Do(func() {
+		close(m.settled)
+
+		err = fn()
+
+		if m.release != nil {
+			m.release()
+		}
+	})
+
+	return err
+}
+
+// keepInvisible extends the visibility timeout of the job halfway through, until the job is settled.
+func (m *sqsMessage) keepInvisible() {
+	ticker := time.NewTicker(m.queue.cfg.VisibilityTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := m.changeVisibility(m.queue.cfg.VisibilityTimeout); err != nil {
+				m.queue.logError(err, "could not extend visibility timeout", aws.StringValue(m.msg.MessageId))
+			}
+		case <-m.settled:
+			return
+		case <-m.queue.ctx.Done():
+			return
+		}
+	}
+}
+
+func (m *sqsMessage) changeVisibility(timeout time.Duration) error {
+	_, err := m.queue.client.ChangeMessageVisibilityWithContext(context.Background(), &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(m.queueURL),
+		ReceiptHandle:     m.msg.ReceiptHandle,
+		VisibilityTimeout: aws.Int64(seconds(timeout, sqsMaxVisibility)),
+	})
+
+	return err
+}
+
+// seconds converts d to the whole seconds SQS expects, capped to limit.
+func seconds(d, limit time.Duration) int64 {
+	if d > limit {
+		d = limit
+	}
+
+	return int64(d / time.Second)
+}
+
+// sqsResultQ sends the reports of finished jobs to a queue, with the client of the image queue.
+type sqsResultQ struct {
+	queue    *SQSQ
+	queueURL string
+}
+
+// ResultQueue returns a queue sending the reports of finished jobs to the given queue.
+func (q *SQSQ) ResultQueue(queueURL string) ResultQueue {
+	return &sqsResultQ{queue: q, queueURL: queueURL}
+}
+
+func (r *sqsResultQ) Publish(report *imagedto.JobReport) error {
+	b, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.queue.client.SendMessageWithContext(r.queue.ctx, &sqs.SendMessageInput{
+		QueueUrl:    aws.String(r.queueURL),
+		MessageBody: aws.String(string(b)),
+	})
+
+	return err
+}
+
+func (r *sqsResultQ) Ready() bool {
+	return r.queue.Ready()
+}
+
+// Close is a no-op, the client is shared with the image queue.
+func (r *sqsResultQ) Close() {}
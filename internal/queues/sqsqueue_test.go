@@ -0,0 +1,203 @@
+package queues_test
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+
+	"github.com/mikarios/imageresizer/internal/queues"
+	"github.com/mikarios/imageresizer/internal/services/config"
+)
+
+func newSQSBroker(t *testing.T, queueCfg *config.QueueConfig) (queues.Q, func() [][]byte) {
+	t.Helper()
+
+	fake := newFakeSQS()
+	cfg := &config.SQSConfig{
+		QueueURL:           "normal",
+		UrgentQueueURL:     "urgent",
+		DeadLetterQueueURL: "dead",
+		VisibilityTimeout:  time.Minute,
+	}
+
+	q := queues.NewSQSQWithClient(fake, cfg, queueCfg)
+	t.Cleanup(q.Close)
+
+	return q, func() [][]byte {
+		if n := fake.len("urgent") + fake.len("normal"); n != 0 {
+			t.Fatalf("%d jobs left, want none", n)
+		}
+
+		dead := make([][]byte, 0)
+		for _, body := range fake.bodies("dead") {
+			dead = append(dead, []byte(body))
+		}
+
+		return dead
+	}
+}
+
+// fakeSQS is an in-process stand-in for the SQS calls of the queue. Receipt handles are the message ids.
+type fakeSQS struct {
+	sqsiface.SQSAPI
+
+	mu     sync.Mutex
+	nextID int
+	queues map[string][]*fakeSQSMessage
+}
+
+type fakeSQSMessage struct {
+	id        string
+	body      string
+	received  int
+	visibleAt time.Time
+}
+
+func newFakeSQS() *fakeSQS {
+	return &fakeSQS{queues: make(map[string][]*fakeSQSMessage)}
+}
+
+func (f *fakeSQS) SendMessageWithContext(
+	_ aws.Context,
+	in *sqs.SendMessageInput,
+	_ ...request.Option,
+) (*sqs.SendMessageOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.nextID++
+	id := strconv.Itoa(f.nextID)
+	url := aws.StringValue(in.QueueUrl)
+	f.queues[url] = append(f.queues[url], &fakeSQSMessage{id: id, body: aws.StringValue(in.MessageBody)})
+
+	return &sqs.SendMessageOutput{MessageId: aws.String(id)}, nil
+}
+
+func (f *fakeSQS) ReceiveMessageWithContext(
+	ctx aws.Context,
+	in *sqs.ReceiveMessageInput,
+	_ ...request.Option,
+) (*sqs.ReceiveMessageOutput, error) {
+	if out := f.receive(in); len(out.Messages) > 0 || aws.Int64Value(in.WaitTimeSeconds) == 0 {
+		return out, nil
+	}
+
+	// a short wait stands in for long polling
+	select {
+	case <-time.After(10 * time.Millisecond):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	return f.receive(in), nil
+}
+
+func (f *fakeSQS) receive(in *sqs.ReceiveMessageInput) *sqs.ReceiveMessageOutput {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	out := &sqs.ReceiveMessageOutput{}
+	now := time.Now()
+
+	for _, m := range f.queues[aws.StringValue(in.QueueUrl)] {
+		if int64(len(out.Messages)) == aws.Int64Value(in.MaxNumberOfMessages) {
+			break
+		}
+
+		if m.visibleAt.After(now) {
+			continue
+		}
+
+		m.received++
+		m.visibleAt = now.Add(time.Duration(aws.Int64Value(in.VisibilityTimeout)) * time.Second)
+		out.Messages = append(out.Messages, &sqs.Message{
+			MessageId:     aws.String(m.id),
+			ReceiptHandle: aws.String(m.id),
+			Body:          aws.String(m.body),
+			Attributes: map[string]*string{
+				sqs.MessageSystemAttributeNameApproximateReceiveCount: aws.String(strconv.Itoa(m.received)),
+			},
+		})
+	}
+
+	return out
+}
+
+func (f *fakeSQS) ChangeMessageVisibilityWithContext(
+	_ aws.Context,
+	in *sqs.ChangeMessageVisibilityInput,
+	_ ...request.Option,
+) (*sqs.ChangeMessageVisibilityOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, m := range f.queues[aws.StringValue(in.QueueUrl)] {
+		if m.id == aws.StringValue(in.ReceiptHandle) {
+			m.visibleAt = time.Now().Add(time.Duration(aws.Int64Value(in.VisibilityTimeout)) * time.Second)
+		}
+	}
+
+	return &sqs.ChangeMessageVisibilityOutput{}, nil
+}
+
+func (f *fakeSQS) DeleteMessageWithContext(
+	_ aws.Context,
+	in *sqs.DeleteMessageInput,
+	_ ...request.Option,
+) (*sqs.DeleteMessageOutput, error) {
+	f.delete(aws.StringValue(in.QueueUrl), aws.StringValue(in.ReceiptHandle))
+
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+func (f *fakeSQS) DeleteMessageBatchWithContext(
+	_ aws.Context,
+	in *sqs.DeleteMessageBatchInput,
+	_ ...request.Option,
+) (*sqs.DeleteMessageBatchOutput, error) {
+	out := &sqs.DeleteMessageBatchOutput{}
+
+	for _, e := range in.Entries {
+		f.delete(aws.StringValue(in.QueueUrl), aws.StringValue(e.ReceiptHandle))
+		out.Successful = append(out.Successful, &sqs.DeleteMessageBatchResultEntry{Id: e.Id})
+	}
+
+	return out, nil
+}
+
+func (f *fakeSQS) delete(url, receipt string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, m := range f.queues[url] {
+		if m.id == receipt {
+			f.queues[url] = append(f.queues[url][:i], f.queues[url][i+1:]...)
+			return
+		}
+	}
+}
+
+func (f *fakeSQS) len(url string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return len(f.queues[url])
+}
+
+func (f *fakeSQS) bodies(url string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	bodies := make([]string, 0, len(f.queues[url]))
+	for _, m := range f.queues[url] {
+		bodies = append(bodies, m.body)
+	}
+
+	return bodies
+}
@@ -1,18 +1,23 @@
 package queues
 
 import (
-	"context"
 	"errors"
+	"fmt"
+	"time"
 
 	"github.com/streadway/amqp"
 
-	"github.com/mikarios/golib/logger"
 	"github.com/mikarios/golib/queue"
 
 	"github.com/mikarios/imageresizer/internal/services/config"
 )
 
-var errImageQueue = errors.New("got error from rabbitMQ image queue")
+var (
+	errImageQueue  = errors.New("got error from rabbitMQ image queue")
+	errResultQueue = errors.New("got error from rabbitMQ result queue")
+	// errStaleDelivery is returned when settling a delivery whose channel closed, the broker redelivers it.
+	errStaleDelivery = errors.New("delivery channel closed")
+)
 
 func declareExchange(q *queue.RabbitMQ, exchangeName string) error {
 	return q.
@@ -23,26 +28,158 @@ func declareExchange(q *queue.RabbitMQ, exchangeName string) error {
 		Declare()
 }
 
-func declareQueue(q *queue.RabbitMQ, queueName string) (amqp.Queue, error) {
+const (
+	headerAttempt      = "x-retry-attempt"
+	deadLetterSuffix   = ".dead"
+	deadLetterExSuffix = ".dlx"
+	retrySuffix        = ".retry"
+)
+
+// declareQueue declares the priority queue together with its dead letter exchange and queue, where rejected messages
+// are parked, and one retry queue per configured retry. Messages published to a retry queue wait for its ttl to expire
+// and are then dead lettered back to the queue through exchangeName and key. Since the arguments of an existing queue
+// cannot change, queueName must not be used by a queue declared with other arguments, see imageQueueName.
+func declareQueue(
+	q *queue.RabbitMQ,
+	cfg *config.QueueConfig,
+	queueName,
+	exchangeName,
+	key string,
+) (amqp.Queue, error) {
+	deadLetterExchange := queueName + deadLetterExSuffix
+
+	if err := declareExchange(q, deadLetterExchange); err != nil {
+		return amqp.Queue{}, err
+	}
+
+	if _, err := q.Queue().Name(queueName + deadLetterSuffix).Durable(true).Declare(); err != nil {
+		return amqp.Queue{}, err
+	}
+
+	if err := bindQueue(q, queueName+deadLetterSuffix, key, deadLetterExchange); err != nil {
+		return amqp.Queue{}, err
+	}
+
+	if err := declareRetryQueues(q, cfg, queueName, exchangeName, key); err != nil {
+		return amqp.Queue{}, err
+	}
+
 	return q.Queue().
 		Name(queueName).
 		Durable(true).
+		Arguments(amqp.Table{
+			"x-dead-letter-exchange":    deadLetterExchange,
+			"x-dead-letter-routing-key": key,
+			"x-max-priority":            maxPriority,
+		}).
 		Declare()
 }
 
-func bindQueue(q *queue.RabbitMQ, queueName, key, exchangeName string) error {
-	return q.Ch.QueueBind(queueName, key, exchangeName, false, nil)
-}
+func declareRetryQueues(q *queue.RabbitMQ, cfg *config.QueueConfig, queueName, exchangeName, key string) error {
+	if err := declareExchange(q, queueName+retrySuffix); err != nil {
+		return err
+	}
+
+	for attempt := 1; attempt <= cfg.MaxRetries; attempt++ {
+		delay := retryDelay(cfg, attempt)
+		name := retryQueueName(queueName, delay)
 
-func panicOnError(ch <-chan *amqp.Error, err error) {
-	cfg := config.GetInstance()
-	ctx := context.Background()
+		if _, err := q.Queue().
+			Name(name).
+			Durable(true).
+			Arguments(amqp.Table{
+				"x-message-ttl":             delay.Milliseconds(),
+				"x-dead-letter-exchange":    exchangeName,
+				"x-dead-letter-routing-key": key,
+			}).
+			Declare(); err != nil {
+			return err
+		}
 
-	for errCh := range ch {
-		if cfg.DEV {
-			logger.Error(ctx, err, errCh)
-		} else {
-			logger.Panic(context.Background(), err, errCh)
+		if err := bindQueue(q, name, name, queueName+retrySuffix); err != nil {
+			return err
 		}
 	}
+
+	return nil
+}
+
+// retryDelay returns the delay before the given attempt, doubling for every attempt.
+func retryDelay(cfg *config.QueueConfig, attempt int) time.Duration {
+	return cfg.RetryDelay << (attempt - 1)
+}
+
+// retryQueueName includes the delay so that changing it declares new queues instead of conflicting with the ttl of the
+// existing ones.
+func retryQueueName(queueName string, delay time.Duration) string {
+	return fmt.Sprintf("%s%s.%dms", queueName, retrySuffix, delay.Milliseconds())
+}
+
+// retry publishes the delivery to the retry queue of its next attempt, or parks it in the dead letter queue once the
+// configured retries are exhausted. The delivery is acknowledged if it was rescheduled.
+func retry(q *queue.RabbitMQ, cfg *config.QueueConfig, queueName string, d *amqp.Delivery) error {
+	attempt := attemptOf(d) + 1
+	if attempt > cfg.MaxRetries {
+		return d.Nack(false, false)
+	}
+
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+
+	headers[headerAttempt] = int32(attempt)
+
+	if err := q.Ch.Publish(
+		queueName+retrySuffix,
+		retryQueueName(queueName, retryDelay(cfg, attempt)),
+		false,
+		false,
+		amqp.Publishing{
+			ContentType:  d.ContentType,
+			DeliveryMode: amqp.Persistent,
+			Priority:     d.Priority,
+			Headers:      headers,
+			Body:         d.Body,
+		},
+	); err != nil {
+		_ = d.Nack(false, true)
+
+		return fmt.Errorf("could not schedule retry %d: %w", attempt, err)
+	}
+
+	return d.Ack(false)
+}
+
+// attemptOf returns the number of retries the delivery has already been through.
+func attemptOf(d *amqp.Delivery) int {
+	switch v := d.Headers[headerAttempt].(type) {
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case int:
+		return v
+	default:
+		return 0
+	}
+}
+
+// queueExists reports whether the queue is declared. The check runs on a channel of its own, since the broker closes
+// the channel of a passive declaration of a missing queue.
+func queueExists(q *queue.RabbitMQ, queueName string) bool {
+	ch, err := q.Conn.Channel()
+	if err != nil {
+		return false
+	}
+
+	defer ch.Close()
+
+	_, err = ch.QueueDeclarePassive(queueName, true, false, false, false, nil)
+
+	return err == nil
+}
+
+func bindQueue(q *queue.RabbitMQ, queueName, key, exchangeName string) error {
+	return q.Ch.QueueBind(queueName, key, exchangeName, false, nil)
 }
@@ -0,0 +1,26 @@
+package healthroute
+
+import (
+	"net/http"
+
+	"github.com/mikarios/imageresizer/internal/httphelper"
+	"github.com/mikarios/imageresizer/pkg/queueservice"
+)
+
+type readyResp struct {
+	Ready  bool `json:"ready"`
+	Broker bool `json:"broker"`
+}
+
+// Ready serves GET /ready. It responds with 503 while the broker is unreachable so that no traffic is routed to the
+// instance until it reconnects.
+func Ready(w http.ResponseWriter, r *http.Request) {
+	broker := queueservice.GetInstance().Ready()
+	code := http.StatusOK
+
+	if !broker {
+		code = http.StatusServiceUnavailable
+	}
+
+	httphelper.RespondJSON(r.Context(), w, code, &readyResp{Ready: broker, Broker: broker})
+}
@@ -0,0 +1,43 @@
+package imageroute
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/mikarios/imageresizer/internal/exceptions"
+	"github.com/mikarios/imageresizer/internal/httphelper"
+	"github.com/mikarios/imageresizer/internal/services/cdnservice"
+	"github.com/mikarios/imageresizer/internal/services/config"
+	"github.com/mikarios/imageresizer/pkg/dtos/imagedto"
+)
+
+// DeleteImages removes every file under the requested paths and responds with their keys. With dryRun nothing is
+// removed, which is the way to check what a deleteImages entry of a job resolves to.
+func DeleteImages(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if !authorised(r) {
+		httphelper.LogAndRespondErr(ctx, w, exceptions.ErrUnauthorised, exceptions.ErrUnauthorised, "unauthorised")
+		return
+	}
+
+	defer r.Body.Close()
+
+	req := &imagedto.DeleteImagesReq{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		httphelper.LogAndRespondErr(ctx, w, err, err, "could not decode json")
+		return
+	}
+
+	keys, err := cdnservice.GetInstance().Delete(ctx, "", req.DeleteImages, req.DryRun)
+	if err != nil {
+		httphelper.LogAndRespondErr(ctx, w, err, err, "could not delete images", req.DeleteImages)
+		return
+	}
+
+	httphelper.RespondJSON(ctx, w, http.StatusOK, &imagedto.DeleteImagesResp{
+		Keys:    keys,
+		DryRun:  req.DryRun,
+		Trashed: config.GetInstance().CDN.TrashFolder != "",
+	})
+}
@@ -0,0 +1,41 @@
+package imageroute
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/mikarios/imageresizer/internal/exceptions"
+	"github.com/mikarios/imageresizer/internal/httphelper"
+	"github.com/mikarios/imageresizer/internal/imagehelper"
+	"github.com/mikarios/imageresizer/internal/services/cdnservice"
+	"github.com/mikarios/imageresizer/internal/services/config"
+	"github.com/mikarios/imageresizer/pkg/dtos/imagedto"
+)
+
+// CollectGarbage deletes, or only reports if dryRun is set, every image of a shop that is not in the desired set.
+func CollectGarbage(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if !authorised(r) {
+		httphelper.LogAndRespondErr(ctx, w, exceptions.ErrUnauthorised, exceptions.ErrUnauthorised, "unauthorised")
+		return
+	}
+
+	defer r.Body.Close()
+
+	req := &imagedto.ImageGCReq{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		httphelper.LogAndRespondErr(ctx, w, err, err, "could not decode json")
+		return
+	}
+
+	cfg := config.GetInstance()
+
+	resp, err := imagehelper.CollectGarbage(ctx, cdnservice.GetInstance(), cfg.CDN.ImagesFolder, req)
+	if err != nil {
+		httphelper.LogAndRespondErr(ctx, w, err, err, "could not collect garbage for shop", req.ShopID)
+		return
+	}
+
+	httphelper.RespondJSON(ctx, w, http.StatusOK, resp)
+}
@@ -1,25 +1,32 @@
 package imageroute
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
-
-	"github.com/streadway/amqp"
+	"net/url"
 
 	"github.com/mikarios/imageresizer/internal/exceptions"
 	"github.com/mikarios/imageresizer/internal/httphelper"
+	"github.com/mikarios/imageresizer/internal/imagehelper"
 	"github.com/mikarios/imageresizer/internal/services/config"
 	"github.com/mikarios/imageresizer/internal/services/imageservice"
 	"github.com/mikarios/imageresizer/pkg/dtos/imagedto"
 	"github.com/mikarios/imageresizer/pkg/queueservice"
 )
 
+const (
+	// headerIdempotencyKey identifies a submission, so that a retried request returns the job it already scheduled.
+	headerIdempotencyKey = "Idempotency-Key"
+	// headerIdempotentReplayed is set on the response when the job was scheduled by an earlier request.
+	headerIdempotentReplayed = "Idempotent-Replayed"
+)
+
 func AddImageScaleJob(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	cfg := config.GetInstance()
 
-	if r.Header.Get("user") != cfg.ImageConfig.ImageServerUser &&
-		r.Header.Get("pass") != cfg.ImageConfig.ImageServerPass {
+	if !authorised(r) {
 		httphelper.LogAndRespondErr(ctx, w, exceptions.ErrUnauthorised, exceptions.ErrUnauthorised, "unauthorised")
 		return
 	}
@@ -32,31 +39,113 @@ func AddImageScaleJob(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	switch job.Priority {
-	case imagedto.PriorityUrgent:
-		imageQueueJob := &imagedto.ImageProcessJob{
-			Data:     job.Job,
-			QueueJob: amqp.Delivery{},
-		}
+	if job.Job == nil {
+		httphelper.LogAndRespondErr(ctx, w, exceptions.ErrInvalidJob, exceptions.ErrInvalidJob, "missing job")
+		return
+	}
 
-		go imageservice.AddImageJob(imageQueueJob)
-	case imagedto.PriorityNormal:
-		q := queueservice.GetInstance()
-		if err := q.ImagePublish(job.Job); err != nil {
-			httphelper.LogAndRespondErr(ctx, w, err, err, "could not queue message")
-			return
-		}
-	default:
-		httphelper.LogAndRespondErr(
-			ctx,
-			w,
-			exceptions.ErrInvalidJobPriority,
-			exceptions.ErrInvalidJobPriority,
-			"invalid priority: "+job.Priority,
-		)
+	if job.Job.CallbackURL == "" {
+		job.Job.CallbackURL = job.CallbackURL
+	}
 
+	status, replayed, err := scheduleJob(r, job.Job, job.Priority)
+	if err != nil {
+		httphelper.LogAndRespondErr(ctx, w, err, err, "could not schedule job", job.Priority)
 		return
 	}
 
-	httphelper.RespondJSON(ctx, w, http.StatusOK, nil)
+	if replayed {
+		w.Header().Set(headerIdempotentReplayed, "true")
+	}
+
+	httphelper.RespondJSON(ctx, w, http.StatusOK, status)
+}
+
+// scheduleJob registers the job, so that its status can be queried, and queues it. Urgent jobs overtake the normal ones
+// waiting in the queue. The Idempotency-Key header of the request, if set, overrides the key of the job. If a job was
+// already scheduled with the same key its status is returned instead and replayed is true, or
+// exceptions.ErrIdempotencyKeyReused if that job had a different payload. Jobs exceeding the daily quotas of the shop
+// are rejected with exceptions.ErrQuotaExceeded.
+func scheduleJob(
+	r *http.Request,
+	job *imagedto.ImageProcessJobData,
+	priority imagedto.PriorityType,
+) (status *imagedto.JobStatus, replayed bool, err error) {
+	if err = validateJob(job, priority); err != nil {
+		return nil, false, err
+	}
+
+	if status, replayed, err = registerJob(r, job, priority); err != nil || replayed {
+		return status, replayed, err
+	}
+
+	return status, false, publishJob(r.Context(), job, priority)
+}
+
+// validateJob returns the error scheduleJob would reject the job with before registering it.
+func validateJob(job *imagedto.ImageProcessJobData, priority imagedto.PriorityType) error {
+	if priority != imagedto.PriorityUrgent && priority != imagedto.PriorityNormal {
+		return exceptions.ErrInvalidJobPriority
+	}
+
+	if job.CallbackURL != "" {
+		if u, err := url.Parse(job.CallbackURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%w: invalid callback url %q", exceptions.ErrInvalidJob, job.CallbackURL)
+		}
+	}
+
+	return imagehelper.ValidateJob(job)
+}
+
+// registerJob registers the validated job and reserves its quota, see scheduleJob. Unless it was replayed the job has
+// to be queued with publishJob or dropped with abandonJob.
+func registerJob(
+	r *http.Request,
+	job *imagedto.ImageProcessJobData,
+	priority imagedto.PriorityType,
+) (status *imagedto.JobStatus, replayed bool, err error) {
+	ctx := r.Context()
+
+	if key := r.Header.Get(headerIdempotencyKey); key != "" {
+		job.IdempotencyKey = key
+	}
+
+	status, registered, err := imageservice.RegisterJob(ctx, job, priority)
+	if err != nil || !registered {
+		return status, err == nil, err
+	}
+
+	// reserved once the job is registered, so that replays are answered even if the quota was used up since
+	if err = imageservice.ReserveQuota(ctx, job); err != nil {
+		imageservice.ForgetJob(ctx, job)
+
+		return nil, false, err
+	}
+
+	return status, false, nil
+}
+
+// publishJob queues the registered job, which is abandoned if that fails.
+func publishJob(ctx context.Context, job *imagedto.ImageProcessJobData, priority imagedto.PriorityType) error {
+	if err := queueservice.GetInstance().ImagePublish(job, priority); err != nil {
+		abandonJob(ctx, job)
+
+		return fmt.Errorf("could not queue message: %w", err)
+	}
+
+	return nil
+}
+
+// abandonJob releases the quota of the registered job and forgets it, so that it can be submitted again.
+func abandonJob(ctx context.Context, job *imagedto.ImageProcessJobData) {
+	imageservice.ReleaseQuota(ctx, job.ID)
+	imageservice.ForgetJob(ctx, job)
+}
+
+// authorised reports whether the request carries both the configured username and password.
+func authorised(r *http.Request) bool {
+	cfg := config.GetInstance()
+
+	return r.Header.Get("user") == cfg.ImageConfig.ImageServerUser &&
+		r.Header.Get("pass") == cfg.ImageConfig.ImageServerPass
 }
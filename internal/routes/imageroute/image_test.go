@@ -0,0 +1,106 @@
+// nolint:testpackage // access to internal functions needed
+package imageroute
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/mikarios/imageresizer/internal/constants"
+	"github.com/mikarios/imageresizer/internal/services/config"
+	"github.com/mikarios/imageresizer/pkg/dtos/imagedto"
+)
+
+func TestMain(m *testing.M) {
+	_ = os.Setenv("DEV", "true")
+	_ = os.Setenv("IMG_USERNAME", "user")
+	_ = os.Setenv("IMG_PASSWORD", "pass")
+	_ = os.Setenv("IMG_IDEMPOTENCY_WINDOW", "1h")
+	_ = os.Setenv("QUEUE_BROKER", "memory")
+	_ = os.Setenv("IMG_MAX_UPLOAD_SIZE", strconv.Itoa(testMaxUploadSize))
+	config.Init("", constants.ServerTypes.ImageResizer)
+
+	os.Exit(m.Run())
+}
+
+func TestAuthorised(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		user, pass string
+		want       bool
+	}{
+		"both correct":   {user: "user", pass: "pass", want: true},
+		"wrong password": {user: "user", pass: "nope", want: false},
+		"wrong user":     {user: "nope", pass: "pass", want: false},
+		"none":           {want: false},
+	}
+
+	for name, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r.Header.Set("user", tt.user)
+		r.Header.Set("pass", tt.pass)
+
+		if got := authorised(r); got != tt.want {
+			t.Errorf("%s: authorised() = %v, want %v", name, got, tt.want)
+		}
+	}
+}
+
+func TestAddImageScaleJob_Idempotency(t *testing.T) {
+	t.Parallel()
+
+	job := `{"priority": "normal", "job": {"shopID": 1, "images": [{"name": "a.jpg", "url": "https://a.test/a.jpg"}]}}`
+	other := strings.Replace(job, "a.jpg", "b.jpg", 2)
+
+	first := addJob(t, "idempotency", job)
+	if first.Code != http.StatusOK || first.Header().Get(headerIdempotentReplayed) != "" {
+		t.Fatalf("first request = %d %v, want a new job", first.Code, first.Header())
+	}
+
+	retried := addJob(t, "idempotency", job)
+	if retried.Code != http.StatusOK || retried.Header().Get(headerIdempotentReplayed) != "true" {
+		t.Fatalf("retried request = %d %v, want the job replayed", retried.Code, retried.Header())
+	}
+
+	if want, got := jobID(t, first), jobID(t, retried); got != want {
+		t.Errorf("retried request returned job %s, want %s", got, want)
+	}
+
+	if reused := addJob(t, "idempotency", other); reused.Code != http.StatusUnprocessableEntity {
+		t.Errorf("request with a reused key = %d, want %d", reused.Code, http.StatusUnprocessableEntity)
+	}
+
+	if unrelated := addJob(t, "other", other); unrelated.Header().Get(headerIdempotentReplayed) != "" {
+		t.Error("request with another key was replayed, want a new job")
+	}
+}
+
+func addJob(t *testing.T, key, body string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/job", strings.NewReader(body))
+	r.Header.Set("user", "user")
+	r.Header.Set("pass", "pass")
+	r.Header.Set(headerIdempotencyKey, key)
+
+	w := httptest.NewRecorder()
+	AddImageScaleJob(w, r)
+
+	return w
+}
+
+func jobID(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+
+	status := &imagedto.JobStatus{}
+	if err := json.Unmarshal(w.Body.Bytes(), status); err != nil {
+		t.Fatal(err)
+	}
+
+	return status.ID
+}
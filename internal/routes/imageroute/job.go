@@ -0,0 +1,84 @@
+package imageroute
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"github.com/mikarios/imageresizer/internal/exceptions"
+	"github.com/mikarios/imageresizer/internal/httphelper"
+	"github.com/mikarios/imageresizer/internal/services/imageservice"
+	"github.com/mikarios/imageresizer/pkg/dtos/imagedto"
+)
+
+// GetJob serves GET /api/v1/job/{id} with the status of the job.
+func GetJob(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if !authorised(r) {
+		httphelper.LogAndRespondErr(ctx, w, exceptions.ErrUnauthorised, exceptions.ErrUnauthorised, "unauthorised")
+		return
+	}
+
+	status, err := imageservice.GetJob(mux.Vars(r)["id"])
+	if err != nil {
+		httphelper.LogAndRespondErr(ctx, w, err, err, "could not get job")
+		return
+	}
+
+	httphelper.RespondJSON(ctx, w, http.StatusOK, status)
+}
+
+// CancelJob serves DELETE /api/v1/job/{id}. Running jobs stop once the images in progress finish, so the returned
+// status may still be running, or cancelRequested if the job is queued or running on another instance.
+func CancelJob(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if !authorised(r) {
+		httphelper.LogAndRespondErr(ctx, w, exceptions.ErrUnauthorised, exceptions.ErrUnauthorised, "unauthorised")
+		return
+	}
+
+	status, err := imageservice.CancelJob(ctx, mux.Vars(r)["id"])
+	if err != nil {
+		httphelper.LogAndRespondErr(ctx, w, err, err, "could not cancel job")
+		return
+	}
+
+	httphelper.RespondJSON(ctx, w, http.StatusAccepted, status)
+}
+
+// ListJobs serves GET /api/v1/jobs, optionally filtered by the shopID and state query parameters.
+func ListJobs(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if !authorised(r) {
+		httphelper.LogAndRespondErr(ctx, w, exceptions.ErrUnauthorised, exceptions.ErrUnauthorised, "unauthorised")
+		return
+	}
+
+	query := r.URL.Query()
+	shopID := 0
+
+	if v := query.Get("shopID"); v != "" {
+		var err error
+		if shopID, err = strconv.Atoi(v); err != nil {
+			err = fmt.Errorf("%w: %s", exceptions.ErrInvalidShopID, v)
+			httphelper.LogAndRespondErr(ctx, w, err, err, "could not list jobs")
+
+			return
+		}
+	}
+
+	state := imagedto.JobState(query.Get("state"))
+	if state != "" && !state.Valid() {
+		err := fmt.Errorf("%w: %s", exceptions.ErrInvalidJobState, state)
+		httphelper.LogAndRespondErr(ctx, w, err, err, "could not list jobs")
+
+		return
+	}
+
+	httphelper.RespondJSON(ctx, w, http.StatusOK, imageservice.ListJobs(shopID, state))
+}
@@ -0,0 +1,105 @@
+package imageroute
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/gorilla/mux"
+
+	"github.com/mikarios/imageresizer/internal/exceptions"
+	"github.com/mikarios/imageresizer/internal/httphelper"
+	"github.com/mikarios/imageresizer/internal/imagehelper"
+	"github.com/mikarios/imageresizer/internal/services/cdnservice"
+	"github.com/mikarios/imageresizer/internal/services/config"
+	"github.com/mikarios/imageresizer/pkg/urlsigner"
+)
+
+const onDemandCacheControl = "public, max-age=86400"
+
+// ResizeOnDemand serves GET /img/{options}/{key}: it reads the original stored under key, applies the options (see
+// imagehelper.ParseTransformation) and streams the result. If IMG_ON_DEMAND_FOLDER is set the result is also stored
+// there and later requests are redirected to the cdn. Only URLs signed by one of IMG_ON_DEMAND_SIGNING_KEYS are served,
+// see urlsigner.
+func ResizeOnDemand(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	cfg := config.GetInstance()
+	cdn := cdnservice.GetInstance()
+	vars := mux.Vars(r)
+
+	if !cfg.ImageConfig.OnDemandEnabled {
+		httphelper.LogAndRespondErr(ctx, w, exceptions.ErrNotFound, exceptions.ErrNotFound, "on demand resizing disabled")
+		return
+	}
+
+	if err := verifySignature(r, cfg.ImageConfig.OnDemandSigningKeys); err != nil {
+		httphelper.LogAndRespondErr(ctx, w, exceptions.ErrUnauthorised, err, "invalid on demand signature", r.URL.Path)
+		return
+	}
+
+	key := strings.TrimPrefix(path.Clean("/"+vars["key"]), "/")
+	if !strings.HasPrefix(key, strings.Trim(cfg.CDN.ImagesFolder, "/")+"/") {
+		httphelper.LogAndRespondErr(ctx, w, exceptions.ErrNotFound, exceptions.ErrNotFound, "key outside images", key)
+		return
+	}
+
+	transformation, err := imagehelper.ParseTransformation(vars["options"], cfg.ImageConfig.OnDemandMaxDimension)
+	if err != nil {
+		httphelper.LogAndRespondErr(ctx, w, err, err, "invalid options", vars["options"])
+		return
+	}
+
+	storedKey := ""
+	if cfg.ImageConfig.OnDemandFolder != "" {
+		storedKey = path.Join(cfg.ImageConfig.OnDemandFolder, transformation.String(), key)
+
+		if cdn.FileExists(ctx, "", storedKey) {
+			http.Redirect(w, r, cdn.PublicURL(storedKey), http.StatusFound)
+			return
+		}
+	}
+
+	original, err := cdn.GetFile(ctx, "", key)
+	if err != nil {
+		if errors.Is(err, cdnservice.ErrFileNotFound) {
+			err = exceptions.ErrNotFound
+		}
+
+		httphelper.LogAndRespondErr(ctx, w, err, err, "could not read original", key)
+
+		return
+	}
+
+	output, err := imagehelper.Transform(original, transformation)
+	if err != nil {
+		httphelper.LogAndRespondErr(ctx, w, err, err, "could not transform", key, transformation.String())
+
+		return
+	}
+
+	contentType := mimetype.Detect(output).String()
+
+	if storedKey != "" {
+		if err = cdn.StoreFile(ctx, "", storedKey, bytes.NewReader(output), contentType); err != nil {
+			httphelper.LogAndRespondErr(ctx, w, err, err, "could not store on demand image", storedKey)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", onDemandCacheControl)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(output))
+}
+
+func verifySignature(r *http.Request, keys map[string]string) error {
+	verifier, err := urlsigner.NewVerifier(keys)
+	if err != nil {
+		return err
+	}
+
+	return verifier.Verify(r.URL.Path, r.URL.Query(), time.Now())
+}
@@ -0,0 +1,252 @@
+package imageroute
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/gabriel-vasile/mimetype"
+
+	"github.com/mikarios/imageresizer/internal/exceptions"
+	"github.com/mikarios/imageresizer/internal/httphelper"
+	"github.com/mikarios/imageresizer/internal/imagehelper"
+	"github.com/mikarios/imageresizer/internal/services/cdnservice"
+	"github.com/mikarios/imageresizer/internal/services/config"
+	"github.com/mikarios/imageresizer/pkg/dtos/imagedto"
+)
+
+const (
+	uploadMaxMemory = 32 << 20
+	// defaultMaxUploadSize applies if IMG_MAX_UPLOAD_SIZE is not set.
+	defaultMaxUploadSize = 32 << 20
+)
+
+// UploadImage accepts an image as multipart/form-data, stores it as the original and schedules its variants. The job is
+// validated and registered before the original is stored, so a rejected upload stores nothing and a replayed one
+// returns the job of the earlier upload.
+// Form fields:
+//
+//	file                                        the image
+//	shopID, productID, name                     name defaults to the name of the uploaded file
+//	imageExtension, pathTemplate, callbackURL   as in the job
+//	priority                                    urgent or normal, defaults to normal
+//	scaleDimensionMax                           comma separated, e.g. 300,600
+//	cropDimensions, minXMaxY, minYMaxX          comma separated, e.g. 100x100,200x150
+func UploadImage(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	cfg := config.GetInstance()
+
+	if !authorised(r) {
+		httphelper.LogAndRespondErr(ctx, w, exceptions.ErrUnauthorised, exceptions.ErrUnauthorised, "unauthorised")
+		return
+	}
+
+	maxUploadSize := cfg.ImageConfig.MaxUploadSize
+	if maxUploadSize == 0 {
+		maxUploadSize = defaultMaxUploadSize
+	}
+
+	if maxUploadSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	}
+
+	defer r.Body.Close()
+
+	if err := r.ParseMultipartForm(uploadMaxMemory); err != nil {
+		err = fmt.Errorf("%w: %s", exceptions.ErrInvalidUpload, err.Error())
+		httphelper.LogAndRespondErr(ctx, w, err, err, "could not parse multipart form")
+
+		return
+	}
+
+	priority := imagedto.PriorityType(r.FormValue("priority"))
+	if priority == "" {
+		priority = imagedto.PriorityNormal
+	}
+
+	job, img, err := parseUpload(r)
+	if err != nil {
+		httphelper.LogAndRespondErr(ctx, w, err, err, "invalid upload")
+		return
+	}
+
+	tmpl, err := imagehelper.ResolvePathTemplate(job.PathTemplate)
+	if err != nil {
+		httphelper.LogAndRespondErr(ctx, w, err, err, "invalid path template", job.PathTemplate)
+		return
+	}
+
+	imageStruct := job.Images[0]
+	imageJob := &imagehelper.ImageJob{ImageStruct: imageStruct, ShopID: job.ShopID, PathTemplate: job.PathTemplate}
+	original := imageJob.OriginalKey(cfg.CDN.ImagesFolder)
+
+	// the variants are generated from the stored original, again if it replaced an earlier one
+	imageStruct.URL = original
+	job.Overwrite = true
+
+	if err = validateJob(job, priority); err != nil {
+		httphelper.LogAndRespondErr(ctx, w, err, err, "invalid upload job")
+		return
+	}
+
+	status, replayed, err := registerJob(r, job, priority)
+	if err != nil {
+		httphelper.LogAndRespondErr(ctx, w, err, err, "could not schedule variants of", original)
+		return
+	}
+
+	if replayed {
+		w.Header().Set(headerIdempotentReplayed, "true")
+		respondUpload(w, r, status, imageJob, original)
+
+		return
+	}
+
+	if _, err = imagehelper.UploadMainProductImageToCDN(
+		ctx,
+		cdnservice.GetInstance(),
+		tmpl,
+		&job.ShopID,
+		imageStruct.ProductID,
+		imageStruct.Name,
+		cfg.CDN.ImagesFolder,
+		"",
+		img,
+		nil,
+	); err != nil {
+		abandonJob(ctx, job)
+		httphelper.LogAndRespondErr(ctx, w, err, err, "could not store original", original)
+
+		return
+	}
+
+	if err = publishJob(ctx, job, priority); err != nil {
+		httphelper.LogAndRespondErr(ctx, w, err, err, "could not schedule variants of", original)
+		return
+	}
+
+	respondUpload(w, r, status, imageJob, original)
+}
+
+func respondUpload(
+	w http.ResponseWriter,
+	r *http.Request,
+	status *imagedto.JobStatus,
+	imageJob *imagehelper.ImageJob,
+	original string,
+) {
+	httphelper.RespondJSON(r.Context(), w, http.StatusOK, &imagedto.UploadImageResp{
+		JobID:    status.ID,
+		Original: original,
+		Variants: imageJob.VariantKeys(config.GetInstance().CDN.ImagesFolder),
+	})
+}
+
+func parseUpload(r *http.Request) (job *imagedto.ImageProcessJobData, img []byte, err error) {
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: missing file: %s", exceptions.ErrInvalidUpload, err.Error())
+	}
+
+	defer file.Close()
+
+	if img, err = io.ReadAll(file); err != nil {
+		return nil, nil, fmt.Errorf("%w: %s", exceptions.ErrInvalidUpload, err.Error())
+	}
+
+	if !mimetype.Detect(img).Is("image/jpeg") && !mimetype.Detect(img).Is("image/png") &&
+		!mimetype.Detect(img).Is("image/webp") {
+		return nil, nil, fmt.Errorf("%w: unsupported file type %s", exceptions.ErrInvalidUpload, mimetype.Detect(img))
+	}
+
+	imageStruct := &imagedto.ImageStruct{
+		Name:      r.FormValue("name"),
+		ProductID: r.FormValue("productID"),
+	}
+
+	if imageStruct.Name == "" {
+		imageStruct.Name = path.Base(header.Filename)
+	}
+
+	if err = imagehelper.ValidateImage(0, imageStruct); err != nil {
+		return nil, nil, fmt.Errorf("%w: %s", exceptions.ErrInvalidUpload, err.Error())
+	}
+
+	job = &imagedto.ImageProcessJobData{
+		ImageExtension: r.FormValue("imageExtension"),
+		Images:         []*imagedto.ImageStruct{imageStruct},
+		PathTemplate:   r.FormValue("pathTemplate"),
+		CallbackURL:    r.FormValue("callbackURL"),
+	}
+
+	if job.ShopID, err = strconv.Atoi(r.FormValue("shopID")); err != nil || job.ShopID <= 0 {
+		return nil, nil, fmt.Errorf("%w: %q", exceptions.ErrInvalidShopID, r.FormValue("shopID"))
+	}
+
+	if imageStruct.ScaleDimensionMax, err = parseScaleDimensions(r.FormValue("scaleDimensionMax")); err != nil {
+		return nil, nil, err
+	}
+
+	if imageStruct.CropDimensions, err = parseDimensions(r.FormValue("cropDimensions")); err != nil {
+		return nil, nil, err
+	}
+
+	if imageStruct.MinXMaxY, err = parseDimensions(r.FormValue("minXMaxY")); err != nil {
+		return nil, nil, err
+	}
+
+	if imageStruct.MinYMaxX, err = parseDimensions(r.FormValue("minYMaxX")); err != nil {
+		return nil, nil, err
+	}
+
+	return job, img, nil
+}
+
+func parseScaleDimensions(value string) ([]*int, error) {
+	res := make([]*int, 0)
+
+	for _, s := range splitList(value) {
+		dim, err := strconv.Atoi(s)
+		if err != nil || dim <= 0 {
+			return nil, fmt.Errorf("%w: %q", exceptions.ErrInvalidImageSize, s)
+		}
+
+		res = append(res, &dim)
+	}
+
+	return res, nil
+}
+
+func parseDimensions(value string) ([]*imagedto.Dimensions, error) {
+	res := make([]*imagedto.Dimensions, 0)
+
+	for _, s := range splitList(value) {
+		xStr, yStr, _ := strings.Cut(strings.ToLower(s), "x")
+
+		x, errX := strconv.Atoi(xStr)
+		y, errY := strconv.Atoi(yStr)
+
+		if errX != nil || errY != nil || x <= 0 || y <= 0 {
+			return nil, fmt.Errorf("%w: %q", exceptions.ErrInvalidImageSize, s)
+		}
+
+		res = append(res, &imagedto.Dimensions{X: x, Y: y})
+	}
+
+	return res, nil
+}
+
+func splitList(value string) []string {
+	res := make([]string, 0)
+
+	for _, s := range strings.Split(value, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			res = append(res, s)
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,111 @@
+// nolint:testpackage // access to internal functions needed
+package imageroute
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const testMaxUploadSize = 64 << 10
+
+// TestUploadImage_Rejected checks the uploads rejected before the original is stored. No cdn is set up, so storing
+// would panic.
+func TestUploadImage_Rejected(t *testing.T) {
+	t.Parallel()
+
+	img := &bytes.Buffer{}
+	if err := png.Encode(img, image.NewRGBA(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+
+	valid := map[string]string{"shopID": "7", "productID": "p1", "scaleDimensionMax": "300"}
+
+	with := func(key, value string) map[string]string {
+		fields := map[string]string{key: value}
+		for k, v := range valid {
+			if k != key {
+				fields[k] = v
+			}
+		}
+
+		return fields
+	}
+
+	// registers a job of the shop with the key used by the upload below
+	job := `{"priority": "normal", "job": {"shopID": 7, "images": [{"name": "a.jpg", "url": "https://a.test/a.jpg"}]}}`
+	if w := addJob(t, "upload", job); w.Code != http.StatusOK {
+		t.Fatalf("first job = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	tests := map[string]struct {
+		fields map[string]string
+		file   []byte
+		key    string
+		noAuth bool
+		want   int
+	}{
+		"unauthorised":     {fields: valid, file: img.Bytes(), noAuth: true, want: http.StatusUnauthorized},
+		"too large":        {fields: valid, file: make([]byte, testMaxUploadSize+1), want: http.StatusBadRequest},
+		"not an image":     {fields: valid, file: []byte("hello"), want: http.StatusBadRequest},
+		"missing file":     {fields: valid, want: http.StatusBadRequest},
+		"invalid shop":     {fields: with("shopID", "0"), file: img.Bytes(), want: http.StatusBadRequest},
+		"invalid size":     {fields: with("cropDimensions", "100"), file: img.Bytes(), want: http.StatusBadRequest},
+		"invalid priority": {fields: with("priority", "soon"), file: img.Bytes(), want: http.StatusBadRequest},
+		"invalid callback": {
+			fields: with("callbackURL", "ftp://hooks.test"),
+			file:   img.Bytes(),
+			want:   http.StatusBadRequest,
+		},
+		"reused key": {fields: valid, file: img.Bytes(), key: "upload", want: http.StatusUnprocessableEntity},
+	}
+
+	for name, tt := range tests {
+		tt := tt
+
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			body := &bytes.Buffer{}
+			form := multipart.NewWriter(body)
+
+			for k, v := range tt.fields {
+				_ = form.WriteField(k, v)
+			}
+
+			if tt.file != nil {
+				file, err := form.CreateFormFile("file", "a.png")
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				_, _ = file.Write(tt.file)
+			}
+
+			_ = form.Close()
+
+			r := httptest.NewRequest(http.MethodPost, "/api/v1/upload", body)
+			r.Header.Set("Content-Type", form.FormDataContentType())
+
+			if !tt.noAuth {
+				r.Header.Set("user", "user")
+				r.Header.Set("pass", "pass")
+			}
+
+			if tt.key != "" {
+				r.Header.Set(headerIdempotencyKey, tt.key)
+			}
+
+			w := httptest.NewRecorder()
+			UploadImage(w, r)
+
+			if w.Code != tt.want {
+				t.Errorf("UploadImage() = %d %s, want %d", w.Code, w.Body, tt.want)
+			}
+		})
+	}
+}
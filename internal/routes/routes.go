@@ -7,6 +7,7 @@ import (
 
 	"github.com/mikarios/golib/routerwrapper"
 
+	"github.com/mikarios/imageresizer/internal/routes/healthroute"
 	"github.com/mikarios/imageresizer/internal/routes/imageroute"
 )
 
@@ -19,5 +20,45 @@ func SetupRoutes() *mux.Router {
 		Methods(http.MethodPost).
 		Create()
 
+	routerwrapper.New(unprotected, nil).
+		HandleFunc("/job/{id}", imageroute.GetJob).
+		Methods(http.MethodGet).
+		Create()
+
+	routerwrapper.New(unprotected, nil).
+		HandleFunc("/job/{id}", imageroute.CancelJob).
+		Methods(http.MethodDelete).
+		Create()
+
+	routerwrapper.New(unprotected, nil).
+		HandleFunc("/jobs", imageroute.ListJobs).
+		Methods(http.MethodGet).
+		Create()
+
+	routerwrapper.New(unprotected, nil).
+		HandleFunc("/gc", imageroute.CollectGarbage).
+		Methods(http.MethodPost).
+		Create()
+
+	routerwrapper.New(unprotected, nil).
+		HandleFunc("/images/delete", imageroute.DeleteImages).
+		Methods(http.MethodPost).
+		Create()
+
+	routerwrapper.New(unprotected, nil).
+		HandleFunc("/upload", imageroute.UploadImage).
+		Methods(http.MethodPost).
+		Create()
+
+	routerwrapper.New(router, nil).
+		HandleFunc("/img/{options}/{key:.+}", imageroute.ResizeOnDemand).
+		Methods(http.MethodGet).
+		Create()
+
+	routerwrapper.New(router, nil).
+		HandleFunc("/ready", healthroute.Ready).
+		Methods(http.MethodGet).
+		Create()
+
 	return router
 }
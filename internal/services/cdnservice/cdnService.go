@@ -2,7 +2,9 @@ package cdnservice
 
 import (
 	"errors"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
@@ -16,9 +18,14 @@ var (
 	errCdnMoreThanOne = errors.New("cdn returned more than one item")
 )
 
+// defaultListingTTL applies if CDN_LISTING_CACHE_TTL is not set.
+const defaultListingTTL = 5 * time.Minute
+
 type CdnStruct struct {
 	s3            *s3.S3
 	defaultBucket *string
+	publicURL     string
+	listings      *listingCache
 }
 
 func GetInstance() *CdnStruct {
@@ -29,9 +36,23 @@ func GetInstance() *CdnStruct {
 	return instance
 }
 
-func Init(bucket, key, secret, endpoint, region string) *CdnStruct {
+// Init creates the cdn instance. publicURL is the base URL the files are served from, if empty the virtual hosted style
+// URL of the bucket is used. Listings are cached for listingTTL, 5m if zero, a negative one disables the cache.
+func Init(bucket, key, secret, endpoint, region, publicURL string, listingTTL time.Duration) *CdnStruct {
 	once.Do(func() {
-		instance = &CdnStruct{defaultBucket: aws.String(bucket)}
+		if publicURL == "" {
+			publicURL = "https://" + bucket + "." + endpoint
+		}
+
+		if listingTTL == 0 {
+			listingTTL = defaultListingTTL
+		}
+
+		instance = &CdnStruct{
+			defaultBucket: aws.String(bucket),
+			publicURL:     strings.TrimSuffix(publicURL, "/"),
+			listings:      newListingCache(listingTTL),
+		}
 		s3Config := &aws.Config{
 			Credentials: credentials.NewStaticCredentials(key, secret, ""),
 			Endpoint:    aws.String("https://" + endpoint),
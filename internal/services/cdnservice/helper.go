@@ -5,9 +5,12 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/s3"
 
 	"github.com/mikarios/golib/logger"
@@ -16,34 +19,124 @@ import (
 	"github.com/mikarios/imageresizer/internal/services/config"
 )
 
-var ErrDeletingImages = errors.New("could not delete images")
+var (
+	ErrDeletingImages = errors.New("could not delete images")
+	ErrFileNotFound   = errors.New("file not found")
+	// ErrVersionConflict is returned by StoreFileIfVersion if the file changed since it was read.
+	ErrVersionConflict = errors.New("file was modified concurrently")
+)
+
+// defaultMaxDeleteObjects applies if CDN_MAX_DELETE_OBJECTS is not set.
+const defaultMaxDeleteObjects = 1000
 
-func (cdn *CdnStruct) Delete(bucket string, imagePaths []string) error {
+// Delete removes the given files and returns their keys. A path ending with a slash is a folder and everything under
+// it is removed, any other path is the key of a single file, so that "static/12" never matches "static/120". If dryRun
+// is set nothing is removed. Paths resolving to more files than the configured maximum are rejected. If a trash folder
+// is configured the files are moved there instead of being deleted, see PurgeTrash.
+func (cdn *CdnStruct) Delete(ctx context.Context, bucket string, imagePaths []string, dryRun bool) ([]string, error) {
 	if bucket == "" {
 		bucket = *cdn.defaultBucket
 	}
 
-	objectIdentifiers := make([]*s3.ObjectIdentifier, 0)
+	cdnConfig := config.GetInstance().CDN
+	keys := make([]string, 0)
 
 	for _, imagePath := range imagePaths {
 		imagePathCheck := strings.TrimSuffix(imagePath, "/")
 
-		if imagePathCheck == config.GetInstance().CDN.ImagesFolder || imagePathCheck == "" {
-			return fmt.Errorf("%w: you should not delete root path! %s", exceptions.ErrNotImplemented, imagePath)
+		if imagePathCheck == cdnConfig.ImagesFolder || imagePathCheck == "" {
+			return nil, fmt.Errorf("%w: you should not delete root path! %s", exceptions.ErrNotImplemented, imagePath)
+		}
+
+		if inFolder(imagePathCheck, cdnConfig.TrashFolder) {
+			return nil, fmt.Errorf("%w: trash can only be purged: %s", exceptions.ErrNotImplemented, imagePath)
+		}
+
+		files, err := cdn.ListFiles(ctx, bucket, imagePath)
+		if err != nil {
+			return nil, err
+		}
+
+		if strings.HasSuffix(imagePath, "/") {
+			keys = append(keys, files...)
+			continue
 		}
 
-		files, err := cdn.ListFiles(bucket, imagePath)
+		key, err := exactKey(imagePath, files)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		for j := range files {
-			f := files[j]
+		if key != "" {
+			keys = append(keys, key)
+		}
+	}
+
+	if err := CheckDeleteLimit(len(keys)); err != nil {
+		return keys, err
+	}
+
+	if dryRun {
+		return keys, nil
+	}
+
+	return keys, cdn.DeleteKeys(ctx, bucket, keys)
+}
+
+// exactKey returns imagePath if it is one of the listed files, or an empty string if it is not. Files listed under
+// imagePath as a folder are an error, since folders have to end with a slash.
+func exactKey(imagePath string, files []string) (string, error) {
+	for _, file := range files {
+		if file == imagePath {
+			return file, nil
+		}
+	}
 
-			objectIdentifiers = append(objectIdentifiers, &s3.ObjectIdentifier{Key: &f})
+	for _, file := range files {
+		if strings.HasPrefix(file, imagePath+"/") {
+			return "", fmt.Errorf("%w: %s is a folder, add a trailing slash", exceptions.ErrInvalidDeletePath, imagePath)
 		}
 	}
 
+	return "", nil
+}
+
+// CheckDeleteLimit returns ErrTooManyObjects if deleting count objects at once exceeds the configured maximum.
+func CheckDeleteLimit(count int) error {
+	limit := config.GetInstance().CDN.MaxDeleteObjects
+	if limit == 0 {
+		limit = defaultMaxDeleteObjects
+	}
+
+	if limit > 0 && count > limit {
+		return fmt.Errorf("%w: %d objects requested, at most %d allowed", exceptions.ErrTooManyObjects, count, limit)
+	}
+
+	return nil
+}
+
+// DeleteKeys removes exactly the given keys. If a trash folder is configured the files are moved there instead of
+// being deleted. If bucket is not set then the default one is used.
+func (cdn *CdnStruct) DeleteKeys(ctx context.Context, bucket string, keys []string) error {
+	if bucket == "" {
+		bucket = *cdn.defaultBucket
+	}
+
+	if trashFolder := config.GetInstance().CDN.TrashFolder; trashFolder != "" {
+		return cdn.moveToTrash(ctx, bucket, trashFolder, keys)
+	}
+
+	return cdn.deleteKeys(ctx, bucket, keys)
+}
+
+// deleteKeys hard deletes the given keys, in chunks of 1000 which is the maximum allowed per request.
+func (cdn *CdnStruct) deleteKeys(ctx context.Context, bucket string, keys []string) error {
+	objectIdentifiers := make([]*s3.ObjectIdentifier, len(keys))
+
+	for i := range keys {
+		objectIdentifiers[i] = &s3.ObjectIdentifier{Key: aws.String(keys[i])}
+	}
+
 	deleteErrors := make([]string, 0)
 
 	for i, end := 0, 1000; i < len(objectIdentifiers); i, end = i+1000, end+1000 {
@@ -61,8 +154,18 @@ func (cdn *CdnStruct) Delete(bucket string, imagePaths []string) error {
 			},
 		}
 
-		if _, err := cdn.s3.DeleteObjects(input); err != nil {
+		output, err := cdn.s3.DeleteObjectsWithContext(ctx, input)
+		if err != nil {
 			deleteErrors = append(deleteErrors, err.Error())
+			continue
+		}
+
+		for _, deleted := range output.Deleted {
+			cdn.listings.remove(bucket, aws.StringValue(deleted.Key))
+		}
+
+		for _, e := range output.Errors {
+			deleteErrors = append(deleteErrors, aws.StringValue(e.Key)+": "+aws.StringValue(e.Message))
 		}
 	}
 
@@ -75,7 +178,7 @@ func (cdn *CdnStruct) Delete(bucket string, imagePaths []string) error {
 
 // FileExists checks for the existence of a file. Returns false if there is a problem OR if more than one
 // item are found in cdn. If bucket is not set then the default one is used.
-func (cdn *CdnStruct) FileExists(bucket, filePath string) bool {
+func (cdn *CdnStruct) FileExists(ctx context.Context, bucket, filePath string) bool {
 	input := &s3.ListObjectsV2Input{
 		Bucket: aws.String(bucket),
 		Prefix: aws.String(filePath),
@@ -85,21 +188,21 @@ func (cdn *CdnStruct) FileExists(bucket, filePath string) bool {
 		input.Bucket = cdn.defaultBucket
 	}
 
-	objects, err := cdn.s3.ListObjectsV2(input)
+	objects, err := cdn.s3.ListObjectsV2WithContext(ctx, input)
 	if err != nil {
-		logger.Error(context.Background(), err, "could not list objects from cdn", input)
+		logger.Error(ctx, err, "could not list objects from cdn", input)
 		return false
 	}
 
 	if len(objects.Contents) > 1 {
-		logger.Warning(context.Background(), errCdnMoreThanOne, input, objects.Contents)
+		logger.Warning(ctx, errCdnMoreThanOne, input, objects.Contents)
 		return false
 	}
 
 	return len(objects.Contents) == 1
 }
 
-func (cdn *CdnStruct) ListFiles(bucket, filePath string) ([]string, error) {
+func (cdn *CdnStruct) ListFiles(ctx context.Context, bucket, filePath string) ([]string, error) {
 	input := &s3.ListObjectsV2Input{
 		Bucket: aws.String(bucket),
 		Prefix: aws.String(filePath),
@@ -119,9 +222,9 @@ func (cdn *CdnStruct) ListFiles(bucket, filePath string) ([]string, error) {
 			input.ContinuationToken = objects.NextContinuationToken
 		}
 
-		objects, err = cdn.s3.ListObjectsV2(input)
+		objects, err = cdn.s3.ListObjectsV2WithContext(ctx, input)
 		if err != nil {
-			logger.Error(context.Background(), err, "could not list objects from cdn", input)
+			logger.Error(ctx, err, "could not list objects from cdn", input)
 			return res, err
 		}
 
@@ -133,16 +236,22 @@ func (cdn *CdnStruct) ListFiles(bucket, filePath string) ([]string, error) {
 	return res, nil
 }
 
-func (cdn *CdnStruct) ListFilesToMap(bucket, filePath string) (map[string]interface{}, error) {
+// ListFilesToMap returns the keys under the given prefix. The result is served from the listing cache when possible.
+// If bucket is not set then the default one is used.
+func (cdn *CdnStruct) ListFilesToMap(ctx context.Context, bucket, filePath string) (map[string]interface{}, error) {
+	if bucket == "" {
+		bucket = *cdn.defaultBucket
+	}
+
+	if res, ok := cdn.listings.get(bucket, filePath); ok {
+		return res, nil
+	}
+
 	input := &s3.ListObjectsV2Input{
 		Bucket: aws.String(bucket),
 		Prefix: aws.String(filePath),
 	}
 
-	if bucket == "" {
-		input.Bucket = cdn.defaultBucket
-	}
-
 	res := make(map[string]interface{})
 	objects := &s3.ListObjectsV2Output{NextContinuationToken: aws.String("")}
 
@@ -153,9 +262,9 @@ func (cdn *CdnStruct) ListFilesToMap(bucket, filePath string) (map[string]interf
 			input.ContinuationToken = objects.NextContinuationToken
 		}
 
-		objects, err = cdn.s3.ListObjectsV2(input)
+		objects, err = cdn.s3.ListObjectsV2WithContext(ctx, input)
 		if err != nil {
-			logger.Error(context.Background(), err, "could not list objects from cdn", input)
+			logger.Error(ctx, err, "could not list objects from cdn", input)
 			return res, err
 		}
 
@@ -164,11 +273,57 @@ func (cdn *CdnStruct) ListFilesToMap(bucket, filePath string) (map[string]interf
 		}
 	}
 
+	cdn.listings.set(bucket, filePath, res)
+
 	return res, nil
 }
 
 // StoreFile stores the given data to the path provided. If bucket is not set then the default one is used.
-func (cdn *CdnStruct) StoreFile(bucket, filePath string, file io.ReadSeeker, contentType string) error {
+func (cdn *CdnStruct) StoreFile(
+	ctx context.Context,
+	bucket,
+	filePath string,
+	file io.ReadSeeker,
+	contentType string,
+) error {
+	return cdn.storeFile(ctx, bucket, filePath, file, contentType)
+}
+
+// StoreFileIfVersion stores the file like StoreFile, but only if the stored file still has the given version, as
+// returned by GetFileVersion, or if version is empty, only if the file does not exist yet. ErrVersionConflict is
+// returned if the file was written in between.
+func (cdn *CdnStruct) StoreFileIfVersion(
+	ctx context.Context,
+	bucket,
+	filePath string,
+	file io.ReadSeeker,
+	contentType,
+	version string,
+) error {
+	header := map[string]string{"If-None-Match": "*"}
+	if version != "" {
+		header = map[string]string{"If-Match": version}
+	}
+
+	err := cdn.storeFile(ctx, bucket, filePath, file, contentType, request.WithSetRequestHeaders(header))
+
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) &&
+		(reqErr.StatusCode() == http.StatusPreconditionFailed || reqErr.StatusCode() == http.StatusConflict) {
+		return fmt.Errorf("%w: %s", ErrVersionConflict, filePath)
+	}
+
+	return err
+}
+
+func (cdn *CdnStruct) storeFile(
+	ctx context.Context,
+	bucket,
+	filePath string,
+	file io.ReadSeeker,
+	contentType string,
+	opts ...request.Option,
+) error {
 	object := s3.PutObjectInput{
 		ACL:    aws.String(s3.ObjectCannedACLPublicRead),
 		Body:   file,
@@ -184,7 +339,56 @@ func (cdn *CdnStruct) StoreFile(bucket, filePath string, file io.ReadSeeker, con
 		object.Bucket = cdn.defaultBucket
 	}
 
-	_, err := cdn.s3.PutObject(&object)
+	if _, err := cdn.s3.PutObjectWithContext(ctx, &object, opts...); err != nil {
+		return err
+	}
 
-	return err
+	cdn.listings.add(*object.Bucket, filePath)
+
+	return nil
+}
+
+// GetFile returns the contents of the given file. If bucket is not set then the default one is used. ErrFileNotFound is
+// returned if the file does not exist.
+func (cdn *CdnStruct) GetFile(ctx context.Context, bucket, filePath string) ([]byte, error) {
+	data, _, err := cdn.GetFileVersion(ctx, bucket, filePath)
+
+	return data, err
+}
+
+// GetFileVersion returns the contents of the given file like GetFile, along with its current version (ETag) to be
+// passed to StoreFileIfVersion.
+func (cdn *CdnStruct) GetFileVersion(ctx context.Context, bucket, filePath string) ([]byte, string, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(filePath),
+	}
+
+	if bucket == "" {
+		input.Bucket = cdn.defaultBucket
+	}
+
+	object, err := cdn.s3.GetObjectWithContext(ctx, input)
+	if err != nil {
+		var awsErr awserr.Error
+		if errors.As(err, &awsErr) && awsErr.Code() == s3.ErrCodeNoSuchKey {
+			return nil, "", fmt.Errorf("%w: %s", ErrFileNotFound, filePath)
+		}
+
+		return nil, "", err
+	}
+
+	defer object.Body.Close()
+
+	data, err := io.ReadAll(object.Body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return data, aws.StringValue(object.ETag), nil
+}
+
+// PublicURL returns the URL the given file is served from.
+func (cdn *CdnStruct) PublicURL(filePath string) string {
+	return cdn.publicURL + "/" + strings.TrimPrefix(filePath, "/")
 }
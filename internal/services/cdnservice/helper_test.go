@@ -0,0 +1,302 @@
+// nolint:testpackage // access to internal functions needed
+package cdnservice
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/mikarios/imageresizer/internal/constants"
+	"github.com/mikarios/imageresizer/internal/exceptions"
+	"github.com/mikarios/imageresizer/internal/services/config"
+)
+
+const testBucket = "bucket"
+
+func TestMain(m *testing.M) {
+	_ = os.Setenv("DEV", "true")
+	_ = os.Setenv("CDN_IMAGES_FOLDER", "static")
+	config.Init("", constants.ServerTypes.ImageResizer)
+
+	os.Exit(m.Run())
+}
+
+// fakeS3 serves the S3 requests the cdn makes from memory: listing, putting, copying and deleting objects.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]time.Time
+	lists   int
+}
+
+func newTestCdn(t *testing.T, listingTTL time.Duration, keys ...string) (*CdnStruct, *fakeS3) {
+	t.Helper()
+
+	fake := &fakeS3{objects: make(map[string]time.Time)}
+	fake.put(time.Now(), keys...)
+
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	sess, err := session.NewSession(&aws.Config{
+		Credentials:      credentials.NewStaticCredentials("key", "secret", ""),
+		Endpoint:         aws.String(srv.URL),
+		Region:           aws.String("us-east-1"),
+		S3ForcePathStyle: aws.Bool(true),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &CdnStruct{
+		s3:            s3.New(sess),
+		defaultBucket: aws.String(testBucket),
+		publicURL:     srv.URL,
+		listings:      newListingCache(listingTTL),
+	}, fake
+}
+
+func (f *fakeS3) put(modified time.Time, keys ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, key := range keys {
+		f.objects[key] = modified
+	}
+}
+
+func (f *fakeS3) keys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	keys := make([]string, 0, len(f.objects))
+	for key := range f.objects {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := strings.TrimPrefix(r.URL.Path, "/"+testBucket+"/")
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2":
+		f.lists++
+		f.list(w, r.URL.Query().Get("prefix"))
+	case r.Method == http.MethodPost && r.URL.Query().Has("delete"):
+		f.delete(w, r)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		source, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+		if _, ok := f.objects[strings.TrimPrefix(source, testBucket+"/")]; err != nil || !ok {
+			http.Error(w, "no such source", http.StatusNotFound)
+			return
+		}
+
+		f.objects[key] = time.Now()
+		_, _ = io.WriteString(w, "<CopyObjectResult><ETag>\"1\"</ETag></CopyObjectResult>")
+	case r.Method == http.MethodPut:
+		f.objects[key] = time.Now()
+	default:
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, prefix string) {
+	type content struct {
+		Key          string
+		LastModified time.Time
+	}
+
+	res := struct {
+		XMLName  xml.Name `xml:"ListBucketResult"`
+		Contents []content
+	}{}
+
+	for key, modified := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			res.Contents = append(res.Contents, content{Key: key, LastModified: modified})
+		}
+	}
+
+	sort.Slice(res.Contents, func(i, j int) bool { return res.Contents[i].Key < res.Contents[j].Key })
+
+	_ = xml.NewEncoder(w).Encode(res)
+}
+
+func (f *fakeS3) delete(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Object []struct{ Key string }
+	}{}
+
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	res := struct {
+		XMLName xml.Name `xml:"DeleteResult"`
+		Deleted []struct{ Key string }
+	}{}
+
+	for _, object := range req.Object {
+		delete(f.objects, object.Key)
+		res.Deleted = append(res.Deleted, struct{ Key string }{Key: object.Key})
+	}
+
+	_ = xml.NewEncoder(w).Encode(res)
+}
+
+// nolint:paralleltest // changes the cdn config
+func TestDelete(t *testing.T) {
+	cfg := &config.GetInstance().CDN
+	objects := []string{
+		"static/12/a b+c.jpg",
+		"static/12/b.jpg",
+		"static/120/a.jpg",
+		"static/12x.jpg",
+		"static/13/a.jpg",
+		"trash/static/11/a.jpg",
+	}
+
+	tests := map[string]struct {
+		paths       []string
+		dryRun      bool
+		trash       string
+		maxDelete   int
+		want        []string
+		wantErr     error
+		wantDeleted []string
+		wantTrashed []string
+	}{
+		"folder": {
+			paths:       []string{"static/12/"},
+			want:        []string{"static/12/a b+c.jpg", "static/12/b.jpg"},
+			wantDeleted: []string{"static/12/a b+c.jpg", "static/12/b.jpg"},
+		},
+		"exact key": {
+			paths:       []string{"static/12x.jpg"},
+			want:        []string{"static/12x.jpg"},
+			wantDeleted: []string{"static/12x.jpg"},
+		},
+		"missing key":          {paths: []string{"static/14.jpg"}, want: []string{}},
+		"folder without slash": {paths: []string{"static/12"}, wantErr: exceptions.ErrInvalidDeletePath},
+		"root":                 {paths: []string{"static/"}, wantErr: exceptions.ErrNotImplemented},
+		"trash": {
+			paths:   []string{"trash/static/11/"},
+			trash:   "trash",
+			wantErr: exceptions.ErrNotImplemented,
+		},
+		"over the limit": {
+			paths:     []string{"static/12/", "static/13/"},
+			maxDelete: 2,
+			want:      []string{"static/12/a b+c.jpg", "static/12/b.jpg", "static/13/a.jpg"},
+			wantErr:   exceptions.ErrTooManyObjects,
+		},
+		"dry run": {
+			paths:  []string{"static/12/"},
+			dryRun: true,
+			want:   []string{"static/12/a b+c.jpg", "static/12/b.jpg"},
+		},
+		"moved to trash": {
+			paths:       []string{"static/12/"},
+			trash:       "trash",
+			want:        []string{"static/12/a b+c.jpg", "static/12/b.jpg"},
+			wantDeleted: []string{"static/12/a b+c.jpg", "static/12/b.jpg"},
+			wantTrashed: []string{"trash/static/12/a b+c.jpg", "trash/static/12/b.jpg"},
+		},
+	}
+
+	for name, tt := range tests {
+		cfg.TrashFolder, cfg.MaxDeleteObjects = tt.trash, tt.maxDelete
+
+		cdn, fake := newTestCdn(t, 0, objects...)
+
+		got, err := cdn.Delete(context.Background(), "", tt.paths, tt.dryRun)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: Delete() error = %v, want %v", name, err, tt.wantErr)
+		}
+
+		if tt.want != nil && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Delete() = %v, want %v", name, got, tt.want)
+		}
+
+		want := remaining(objects, tt.wantDeleted, tt.wantTrashed)
+		if stored := fake.keys(); !reflect.DeepEqual(stored, want) {
+			t.Errorf("%s: stored %v, want %v", name, stored, want)
+		}
+	}
+
+	cfg.TrashFolder, cfg.MaxDeleteObjects = "", 0
+}
+
+// nolint:paralleltest // changes the cdn config
+func TestCheckDeleteLimit(t *testing.T) {
+	cfg := &config.GetInstance().CDN
+
+	tests := map[string]struct {
+		maxDelete, count int
+		wantErr          error
+	}{
+		"default":             {count: defaultMaxDeleteObjects},
+		"over the default":    {count: defaultMaxDeleteObjects + 1, wantErr: exceptions.ErrTooManyObjects},
+		"configured":          {maxDelete: 5, count: 5},
+		"over the configured": {maxDelete: 5, count: 6, wantErr: exceptions.ErrTooManyObjects},
+		"unlimited":           {maxDelete: -1, count: defaultMaxDeleteObjects + 1},
+	}
+
+	for name, tt := range tests {
+		cfg.MaxDeleteObjects = tt.maxDelete
+
+		if err := CheckDeleteLimit(tt.count); !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: CheckDeleteLimit() = %v, want %v", name, err, tt.wantErr)
+		}
+	}
+
+	cfg.MaxDeleteObjects = 0
+}
+
+// remaining returns the objects left after deleting deleted and adding added, sorted.
+func remaining(objects, deleted, added []string) []string {
+	res := append([]string{}, added...)
+
+	for _, key := range objects {
+		if !contains(deleted, key) {
+			res = append(res, key)
+		}
+	}
+
+	sort.Strings(res)
+
+	return res
+}
+
+func contains(keys []string, key string) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,102 @@
+package cdnservice
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// listingCache keeps the result of ListFilesToMap per bucket and prefix for ttl. Entries are updated in place when files
+// are stored or deleted through this instance, changes made by others become visible once the entry expires.
+type listingCache struct {
+	mu      sync.RWMutex
+	ttl     time.Duration
+	entries map[listingKey]*listing
+}
+
+type listingKey struct {
+	bucket string
+	prefix string
+}
+
+type listing struct {
+	files     map[string]interface{}
+	fetchedAt time.Time
+}
+
+func newListingCache(ttl time.Duration) *listingCache {
+	return &listingCache{ttl: ttl, entries: make(map[listingKey]*listing)}
+}
+
+// get returns a copy of the cached listing, callers are free to keep it around while the cache changes.
+func (c *listingCache) get(bucket, prefix string) (map[string]interface{}, bool) {
+	if c.ttl <= 0 {
+		return nil, false
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	l, ok := c.entries[listingKey{bucket: bucket, prefix: prefix}]
+	if !ok || time.Since(l.fetchedAt) > c.ttl {
+		return nil, false
+	}
+
+	files := make(map[string]interface{}, len(l.files))
+	for k, v := range l.files {
+		files[k] = v
+	}
+
+	return files, true
+}
+
+func (c *listingCache) set(bucket, prefix string, files map[string]interface{}) {
+	if c.ttl <= 0 {
+		return
+	}
+
+	l := &listing{files: make(map[string]interface{}, len(files)), fetchedAt: time.Now()}
+	for k, v := range files {
+		l.files[k] = v
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, entry := range c.entries {
+		if time.Since(entry.fetchedAt) > c.ttl {
+			delete(c.entries, key)
+		}
+	}
+
+	c.entries[listingKey{bucket: bucket, prefix: prefix}] = l
+}
+
+func (c *listingCache) add(bucket string, keys ...string) {
+	c.update(bucket, keys, func(files map[string]interface{}, key string) { files[key] = nil })
+}
+
+func (c *listingCache) remove(bucket string, keys ...string) {
+	c.update(bucket, keys, func(files map[string]interface{}, key string) { delete(files, key) })
+}
+
+func (c *listingCache) update(bucket string, keys []string, apply func(files map[string]interface{}, key string)) {
+	if c.ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for entryKey, entry := range c.entries {
+		if entryKey.bucket != bucket {
+			continue
+		}
+
+		for _, key := range keys {
+			if strings.HasPrefix(key, entryKey.prefix) {
+				apply(entry.files, key)
+			}
+		}
+	}
+}
@@ -0,0 +1,115 @@
+// nolint:testpackage // access to internal functions needed
+package cdnservice
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestListingCache(t *testing.T) {
+	t.Parallel()
+
+	files := func(keys ...string) map[string]interface{} {
+		res := make(map[string]interface{}, len(keys))
+		for _, key := range keys {
+			res[key] = nil
+		}
+
+		return res
+	}
+
+	tests := map[string]struct {
+		ttl    time.Duration
+		update func(c *listingCache)
+		want   map[string]interface{}
+	}{
+		"cached":   {ttl: time.Minute, want: files("static/1/a")},
+		"disabled": {ttl: -1},
+		"expired": {
+			ttl: time.Minute,
+			update: func(c *listingCache) {
+				c.entries[listingKey{bucket: "b1", prefix: "static/1/"}].fetchedAt = time.Now().Add(-2 * time.Minute)
+			},
+		},
+		"added and removed": {
+			ttl: time.Minute,
+			update: func(c *listingCache) {
+				c.add("b1", "static/1/b", "static/1/c", "static/10/a", "static/2/a")
+				c.remove("b1", "static/1/a", "static/1/c")
+			},
+			want: files("static/1/b"),
+		},
+		"other bucket": {
+			ttl: time.Minute,
+			update: func(c *listingCache) {
+				c.add("b2", "static/1/b")
+				c.remove("b2", "static/1/a")
+			},
+			want: files("static/1/a"),
+		},
+		"copy returned": {
+			ttl: time.Minute,
+			update: func(c *listingCache) {
+				res, _ := c.get("b1", "static/1/")
+				res["static/1/b"] = nil
+			},
+			want: files("static/1/a"),
+		},
+	}
+
+	for name, tt := range tests {
+		tt := tt
+
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			c := newListingCache(tt.ttl)
+			c.set("b1", "static/1/", files("static/1/a"))
+			c.set("b2", "static/1/", files("static/1/a"))
+
+			if tt.update != nil {
+				tt.update(c)
+			}
+
+			got, ok := c.get("b1", "static/1/")
+			if ok != (tt.want != nil) || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("get() = %v, %v, want %v", got, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestListFilesToMap_Cached(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	cdn, fake := newTestCdn(t, time.Minute, "static/1/a", "static/10/a")
+
+	if _, err := cdn.ListFilesToMap(ctx, "", "static/1/"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cdn.StoreFile(ctx, "", "static/1/b", bytes.NewReader(nil), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cdn.DeleteKeys(ctx, "", []string{"static/1/a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := cdn.ListFilesToMap(ctx, "", "static/1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := map[string]interface{}{"static/1/b": nil}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ListFilesToMap() = %v, want %v", got, want)
+	}
+
+	if fake.lists != 1 {
+		t.Errorf("listed %d times, want the second listing served from the cache", fake.lists)
+	}
+}
@@ -0,0 +1,122 @@
+package cdnservice
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// moveToTrash copies every key under the trash folder, keeping its full path so it can be restored, and deletes the
+// originals that were copied successfully.
+func (cdn *CdnStruct) moveToTrash(ctx context.Context, bucket, trashFolder string, keys []string) error {
+	moved := make([]string, 0, len(keys))
+	copyErrors := make([]string, 0)
+
+	for _, key := range keys {
+		input := &s3.CopyObjectInput{
+			Bucket:     aws.String(bucket),
+			CopySource: aws.String(copySource(bucket, key)),
+			Key:        aws.String(path.Join(trashFolder, key)),
+		}
+
+		if _, err := cdn.s3.CopyObjectWithContext(ctx, input); err != nil {
+			copyErrors = append(copyErrors, fmt.Sprintf("%s: %v", key, err))
+			continue
+		}
+
+		moved = append(moved, key)
+		cdn.listings.add(bucket, *input.Key)
+	}
+
+	if err := cdn.deleteKeys(ctx, bucket, moved); err != nil {
+		return err
+	}
+
+	if len(copyErrors) > 0 {
+		return fmt.Errorf("%w: could not move to trash: %s", ErrDeletingImages, strings.Join(copyErrors, " | "))
+	}
+
+	return nil
+}
+
+// PurgeTrash permanently deletes the files that have been in the trash folder for longer than retention and returns
+// their keys. A retention of zero or less keeps the trash forever. If dryRun is set nothing is deleted. If bucket is
+// not set then the default one is used.
+func (cdn *CdnStruct) PurgeTrash(
+	ctx context.Context,
+	bucket,
+	trashFolder string,
+	retention time.Duration,
+	dryRun bool,
+) ([]string, error) {
+	if bucket == "" {
+		bucket = *cdn.defaultBucket
+	}
+
+	if strings.Trim(trashFolder, "/") == "" {
+		return nil, fmt.Errorf("%w: no trash folder configured", ErrDeletingImages)
+	}
+
+	if retention <= 0 {
+		return []string{}, nil
+	}
+
+	objects, err := cdn.listObjects(ctx, bucket, strings.TrimSuffix(trashFolder, "/")+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	threshold := time.Now().Add(-retention)
+	expired := make([]string, 0)
+
+	for _, object := range objects {
+		if object.LastModified != nil && object.LastModified.Before(threshold) {
+			expired = append(expired, *object.Key)
+		}
+	}
+
+	if dryRun || len(expired) == 0 {
+		return expired, nil
+	}
+
+	return expired, cdn.deleteKeys(ctx, bucket, expired)
+}
+
+func (cdn *CdnStruct) listObjects(ctx context.Context, bucket, prefix string) ([]*s3.Object, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}
+
+	res := make([]*s3.Object, 0)
+
+	err := cdn.s3.ListObjectsV2PagesWithContext(ctx, input, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		res = append(res, page.Contents...)
+		return true
+	})
+
+	return res, err
+}
+
+// copySource returns the url encoded source of a copy request, escaping every segment of the key but keeping the
+// separators.
+func copySource(bucket, key string) string {
+	segments := strings.Split(bucket+"/"+key, "/")
+	for i := range segments {
+		segments[i] = url.PathEscape(segments[i])
+	}
+
+	return strings.Join(segments, "/")
+}
+
+func inFolder(filePath, folder string) bool {
+	folder = strings.Trim(folder, "/")
+
+	return folder != "" && (filePath == folder || strings.HasPrefix(filePath, folder+"/"))
+}
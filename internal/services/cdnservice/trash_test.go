@@ -0,0 +1,77 @@
+// nolint:testpackage // access to internal functions needed
+package cdnservice
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPurgeTrash(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		trash     string
+		retention time.Duration
+		dryRun    bool
+		want      []string
+		wantErr   error
+		wantKept  []string
+	}{
+		"expired": {
+			trash:     "trash/",
+			retention: time.Hour,
+			want:      []string{"trash/static/1/old.jpg"},
+			wantKept:  []string{"static/1/old.jpg", "trash/static/1/new.jpg", "trashed/static/1/old.jpg"},
+		},
+		"dry run": {
+			trash:     "trash",
+			retention: time.Hour,
+			dryRun:    true,
+			want:      []string{"trash/static/1/old.jpg"},
+		},
+		"no retention": {trash: "trash", want: []string{}},
+		"no trash":     {trash: "/", retention: time.Hour, wantErr: ErrDeletingImages},
+	}
+
+	for name, tt := range tests {
+		tt := tt
+
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			cdn, fake := newTestCdn(t, 0, "trash/static/1/new.jpg")
+			fake.put(time.Now().Add(-2*time.Hour), "trash/static/1/old.jpg", "trashed/static/1/old.jpg", "static/1/old.jpg")
+
+			all := fake.keys()
+
+			got, err := cdn.PurgeTrash(context.Background(), "", tt.trash, tt.retention, tt.dryRun)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("PurgeTrash() error = %v, want %v", err, tt.wantErr)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) && tt.wantErr == nil {
+				t.Errorf("PurgeTrash() = %v, want %v", got, tt.want)
+			}
+
+			wantKept := tt.wantKept
+			if wantKept == nil {
+				wantKept = all
+			}
+
+			if kept := fake.keys(); !reflect.DeepEqual(kept, wantKept) {
+				t.Errorf("stored %v, want %v", kept, wantKept)
+			}
+		})
+	}
+}
+
+func TestCopySource(t *testing.T) {
+	t.Parallel()
+
+	if got, want := copySource("bucket", "static/1/a b+c?.jpg"), "bucket/static/1/a%20b+c%3F.jpg"; got != want {
+		t.Errorf("copySource() = %q, want %q", got, want)
+	}
+}
@@ -1,12 +1,21 @@
 package config
 
+import (
+	"time"
+)
+
 // Config holds the main config for all servers.
 type Config struct {
 	DEV            bool `servers:"imageresizer" envconfig:"DEV" required:"true"`
 	LOG            LogConfig
 	HTTP           HTTPConfig
 	CDN            CDNConfig
+	QueueConfig    QueueConfig
 	RabbitMQConfig RabbitMQConfig
+	NATSConfig     NATSConfig
+	RedisConfig    RedisConfig
+	SQSConfig      SQSConfig
+	StateConfig    StateConfig
 	ImageConfig    ImageConfig
 	LambdaConfig   LambdaConfig
 }
@@ -23,6 +32,62 @@ type ImageConfig struct {
 	NumberOfWorkers int    `servers:"imageresizer" optional:"true" envconfig:"IMG_WORKERS_NUMBER"`
 	ImageServerUser string `servers:"imageresizer" envconfig:"IMG_USERNAME"`
 	ImageServerPass string `servers:"imageresizer" envconfig:"IMG_PASSWORD"`
+	PathTemplate    string `servers:"imageresizer" optional:"true" envconfig:"IMG_PATH_TEMPLATE"`
+	FileSourcesDir  string `servers:"imageresizer" optional:"true" envconfig:"IMG_FILE_SOURCES_DIR"`
+
+	// MaxUploadSize limits the request body of an upload in bytes, 32MiB by default and unlimited if negative.
+	MaxUploadSize int64 `servers:"imageresizer" optional:"true" envconfig:"IMG_MAX_UPLOAD_SIZE"`
+
+	// S3Sources lists the comma separated bucket/prefix entries s3:// and key sources may be read from, a bare bucket
+	// allowing all of it. Defaults to the images folder of the cdn bucket.
+	S3Sources []string `servers:"imageresizer" optional:"true" envconfig:"IMG_S3_SOURCES"`
+
+	// MaxConcurrentJobs is how many jobs are processed at the same time, sharing the workers. Defaults to the number of
+	// workers.
+	MaxConcurrentJobs int `servers:"imageresizer" optional:"true" envconfig:"IMG_MAX_CONCURRENT_JOBS"`
+
+	// Shops take turns for the workers in proportion to their weight in ShopWeights, given as shopID:weight pairs, and
+	// 1 if not set. A shop uses at most ShopMaxWorkers workers at a time. Zero does not limit them.
+	ShopWeights    map[int]int `servers:"imageresizer" optional:"true" envconfig:"IMG_SHOP_WEIGHTS"`
+	ShopMaxWorkers int         `servers:"imageresizer" optional:"true" envconfig:"IMG_SHOP_MAX_WORKERS"`
+	// Jobs are rejected once a shop processed ShopDailyImages images or stored ShopDailyBytes bytes in a day (UTC).
+	// Usage is kept in the state store: the images of a job are reserved once it is accepted and released if it fails
+	// or is cancelled. Zero disables them.
+	ShopDailyImages int   `servers:"imageresizer" optional:"true" envconfig:"IMG_SHOP_DAILY_IMAGES"`
+	ShopDailyBytes  int64 `servers:"imageresizer" optional:"true" envconfig:"IMG_SHOP_DAILY_BYTES"`
+
+	// Finished jobs are forgotten after JobStatusRetention, 24h by default, and unfinished ones, e.g. consumed by another
+	// instance, after JobStatusMaxAge, 7 days by default.
+	JobStatusRetention time.Duration `servers:"imageresizer" optional:"true" envconfig:"IMG_JOB_STATUS_RETENTION"`
+	JobStatusMaxAge    time.Duration `servers:"imageresizer" optional:"true" envconfig:"IMG_JOB_STATUS_MAX_AGE"`
+	// IdempotencyWindow is how long idempotency keys are remembered, in the state store so that every instance knows
+	// them. Zero disables them.
+	IdempotencyWindow time.Duration `servers:"imageresizer" optional:"true" envconfig:"IMG_IDEMPOTENCY_WINDOW"`
+
+	// JobTimeout limits the jobs without a deadline and ImageTimeout every image of a job that does not set its own.
+	// Zero disables them.
+	JobTimeout   time.Duration `servers:"imageresizer" optional:"true" envconfig:"IMG_JOB_TIMEOUT"`
+	ImageTimeout time.Duration `servers:"imageresizer" optional:"true" envconfig:"IMG_IMAGE_TIMEOUT"`
+
+	// Jobs accepted through the API are recorded in the journal at JournalPath, if set, and the unfinished ones are
+	// processed again on start. Only supported with the memory broker, the other brokers redeliver unfinished jobs
+	// themselves so they would be processed twice. Finished jobs are removed from the journal every
+	// JournalCompactInterval.
+	JournalPath            string        `servers:"imageresizer" optional:"true" envconfig:"IMG_JOURNAL_PATH"`
+	JournalCompactInterval time.Duration `servers:"imageresizer" optional:"true" envconfig:"IMG_JOURNAL_COMPACT_INTERVAL"`
+
+	// Callbacks are attempted WebhookMaxAttempts times, 4 by default, waiting WebhookBackoff (2s by default) before the
+	// second one and twice as long before every further one. Each attempt times out after WebhookTimeout, 10s by default.
+	WebhookSecret      string        `servers:"imageresizer" optional:"true" envconfig:"IMG_WEBHOOK_SECRET"`
+	WebhookMaxAttempts int           `servers:"imageresizer" optional:"true" envconfig:"IMG_WEBHOOK_MAX_ATTEMPTS"`
+	WebhookBackoff     time.Duration `servers:"imageresizer" optional:"true" envconfig:"IMG_WEBHOOK_BACKOFF"`
+	WebhookTimeout     time.Duration `servers:"imageresizer" optional:"true" envconfig:"IMG_WEBHOOK_TIMEOUT"`
+
+	OnDemandEnabled      bool   `servers:"imageresizer" optional:"true" envconfig:"IMG_ON_DEMAND_ENABLED"`
+	OnDemandFolder       string `servers:"imageresizer" optional:"true" envconfig:"IMG_ON_DEMAND_FOLDER"`
+	OnDemandMaxDimension int    `servers:"imageresizer" optional:"true" envconfig:"IMG_ON_DEMAND_MAX_DIMENSION"`
+	// OnDemandSigningKeys holds the active keys as comma separated id:secret pairs, e.g. "2023:secret1,2024:secret2".
+	OnDemandSigningKeys map[string]string `servers:"imageresizer" optional:"true" envconfig:"IMG_ON_DEMAND_SIGNING_KEYS"`
 }
 
 type CDNConfig struct {
@@ -32,6 +97,16 @@ type CDNConfig struct {
 	Bucket       string `servers:"imageresizer" envconfig:"CDN_BUCKET"`
 	Region       string `servers:"imageresizer" envconfig:"CDN_REGION"`
 	ImagesFolder string `servers:"imageresizer" envconfig:"CDN_IMAGES_FOLDER"`
+	PublicURL    string `servers:"imageresizer" optional:"true" envconfig:"CDN_PUBLIC_URL"`
+
+	// Deleted files are moved to TrashFolder, if set, and purged once they have been there for TrashRetention. A delete
+	// removes at most MaxDeleteObjects files, 1000 by default and unlimited if negative.
+	TrashFolder      string        `servers:"imageresizer" optional:"true" envconfig:"CDN_TRASH_FOLDER"`
+	TrashRetention   time.Duration `servers:"imageresizer" optional:"true" envconfig:"CDN_TRASH_RETENTION"`
+	MaxDeleteObjects int           `servers:"imageresizer" optional:"true" envconfig:"CDN_MAX_DELETE_OBJECTS"`
+
+	// Listings are cached for ListingCacheTTL, 5m by default and not at all if negative.
+	ListingCacheTTL time.Duration `servers:"imageresizer" optional:"true" envconfig:"CDN_LISTING_CACHE_TTL"`
 }
 
 type LogConfig struct {
@@ -48,6 +123,79 @@ type HTTPConfig struct {
 	KeyFile  string `servers:"imageresizer" optional:"true" envconfig:"HTTPS_KEY"`
 }
 
+// QueueConfig holds the settings common to every broker. Broker is one of rabbitmq (the default), nats, redis, sqs or
+// memory, which keeps the jobs in process and is meant for development and tests.
+type QueueConfig struct {
+	Broker string `servers:"imageresizer" optional:"true" envconfig:"QUEUE_BROKER"`
+	// Prefetch is the number of unacknowledged jobs a consumer holds, IMG_MAX_CONCURRENT_JOBS by default and unlimited
+	// if negative. It should not be lower than IMG_MAX_CONCURRENT_JOBS.
+	Prefetch int `servers:"imageresizer" optional:"true" envconfig:"QUEUE_PREFETCH"`
+	// Failed jobs are retried MaxRetries times after RetryDelay, doubling every time, and then dead lettered. Without
+	// them a job is retried once after a minute, a negative MaxRetries disables retries.
+	MaxRetries int           `servers:"imageresizer" optional:"true" envconfig:"QUEUE_MAX_RETRIES"`
+	RetryDelay time.Duration `servers:"imageresizer" optional:"true" envconfig:"QUEUE_RETRY_DELAY"`
+}
+
+// NATSConfig configures the NATS JetStream broker. Jobs are reported in progress every half AckWait while they are
+// processed, those of a consumer that stopped doing so, e.g. because it crashed, are redelivered after AckWait.
+type NATSConfig struct {
+	URL           string        `servers:"imageresizer" optional:"true" envconfig:"NATS_URL"`
+	Stream        string        `servers:"imageresizer" optional:"true" envconfig:"NATS_STREAM"`
+	Subject       string        `servers:"imageresizer" optional:"true" envconfig:"NATS_SUBJECT"`
+	Durable       string        `servers:"imageresizer" optional:"true" envconfig:"NATS_DURABLE"`
+	AckWait       time.Duration `servers:"imageresizer" optional:"true" envconfig:"NATS_ACK_WAIT"`
+	ResultSubject string        `servers:"imageresizer" optional:"true" envconfig:"NATS_RESULT_SUBJECT"`
+}
+
+// RedisConfig configures the Redis Streams broker. Every replica should use its own Consumer, the host name by
+// default. Jobs left pending by a consumer for longer than ClaimMinIdle are claimed by another one, so it should exceed
+// the time a job takes. Zero disables claiming.
+type RedisConfig struct {
+	URL          string        `servers:"imageresizer" optional:"true" envconfig:"REDIS_URL"`
+	Stream       string        `servers:"imageresizer" optional:"true" envconfig:"REDIS_STREAM"`
+	Group        string        `servers:"imageresizer" optional:"true" envconfig:"REDIS_GROUP"`
+	Consumer     string        `servers:"imageresizer" optional:"true" envconfig:"REDIS_CONSUMER"`
+	ClaimMinIdle time.Duration `servers:"imageresizer" optional:"true" envconfig:"REDIS_CLAIM_MIN_IDLE"`
+	ResultStream string        `servers:"imageresizer" optional:"true" envconfig:"REDIS_RESULT_STREAM"`
+}
+
+// SQSConfig configures the SQS broker. Urgent jobs go to UrgentQueueURL if set and rejected jobs to
+// DeadLetterQueueURL, or are dropped if it is not set. Endpoint points to a local SQS compatible server instead of
+// AWS. Received jobs are kept invisible to other consumers for VisibilityTimeout, extended while they are processed.
+type SQSConfig struct {
+	QueueURL           string        `servers:"imageresizer" optional:"true" envconfig:"SQS_QUEUE_URL"`
+	UrgentQueueURL     string        `servers:"imageresizer" optional:"true" envconfig:"SQS_URGENT_QUEUE_URL"`
+	DeadLetterQueueURL string        `servers:"imageresizer" optional:"true" envconfig:"SQS_DEAD_LETTER_QUEUE_URL"`
+	ResultQueueURL     string        `servers:"imageresizer" optional:"true" envconfig:"SQS_RESULT_QUEUE_URL"`
+	Endpoint           string        `servers:"imageresizer" optional:"true" envconfig:"SQS_ENDPOINT"`
+	ID                 string        `servers:"imageresizer" optional:"true" envconfig:"SQS_ID"`
+	Secret             string        `servers:"imageresizer" optional:"true" envconfig:"SQS_SECRET"`
+	Token              string        `servers:"imageresizer" optional:"true" envconfig:"SQS_TOKEN"`
+	Region             string        `servers:"imageresizer" optional:"true" envconfig:"SQS_REGION"`
+	WaitTime           time.Duration `servers:"imageresizer" optional:"true" envconfig:"SQS_WAIT_TIME"`
+	VisibilityTimeout  time.Duration `servers:"imageresizer" optional:"true" envconfig:"SQS_VISIBILITY_TIMEOUT"`
+}
+
+// StateConfig configures where the state the instances share is kept, e.g. the idempotency keys, the cancellations and
+// the quota usage. Without RedisURL it is kept in process, which is only correct with a single instance. Keys are
+// prefixed with Prefix, imageresizer: by default.
+type StateConfig struct {
+	RedisURL string `servers:"imageresizer" optional:"true" envconfig:"STATE_REDIS_URL"`
+	Prefix   string `servers:"imageresizer" optional:"true" envconfig:"STATE_PREFIX"`
+}
+
 type RabbitMQConfig struct {
-	URL string `servers:"imageresizer" envconfig:"RABBITMQ_URL"`
+	// URL is required by the rabbitmq broker.
+	URL string `servers:"imageresizer" optional:"true" envconfig:"RABBITMQ_URL"`
+	// Lost connections are retried after ReconnectDelay, doubling every time up to ReconnectMaxDelay.
+	ReconnectDelay    time.Duration `servers:"imageresizer" optional:"true" envconfig:"RABBITMQ_RECONNECT_DELAY"`
+	ReconnectMaxDelay time.Duration `servers:"imageresizer" optional:"true" envconfig:"RABBITMQ_RECONNECT_MAX_DELAY"`
+	// ResultExchange is where the reports of finished jobs are published. Nothing is published if not set.
+	ResultExchange   string `servers:"imageresizer" optional:"true" envconfig:"RABBITMQ_RESULT_EXCHANGE"`
+	ResultRoutingKey string `servers:"imageresizer" optional:"true" envconfig:"RABBITMQ_RESULT_ROUTING_KEY"`
+
+	// Deprecated: use QUEUE_PREFETCH, QUEUE_MAX_RETRIES and QUEUE_RETRY_DELAY, these only apply if those are not set.
+	Prefetch   int           `servers:"imageresizer" optional:"true" envconfig:"RABBITMQ_PREFETCH"`
+	MaxRetries int           `servers:"imageresizer" optional:"true" envconfig:"RABBITMQ_MAX_RETRIES"`
+	RetryDelay time.Duration `servers:"imageresizer" optional:"true" envconfig:"RABBITMQ_RETRY_DELAY"`
 }
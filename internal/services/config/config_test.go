@@ -9,6 +9,7 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/mikarios/golib/slices"
 
@@ -132,3 +133,40 @@ func validateTags(field *reflect.StructField) error {
 
 	return nil
 }
+
+func TestCheckBroker(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		broker, url string
+		wantErr     bool
+	}{
+		"default without url":  {wantErr: true},
+		"rabbitmq without url": {broker: "rabbitmq", wantErr: true},
+		"rabbitmq with url":    {broker: "rabbitmq", url: "amqp://localhost"},
+		"other broker":         {broker: "nats"},
+	}
+
+	for name, tt := range tests {
+		instance := &Config{QueueConfig: QueueConfig{Broker: tt.broker}, RabbitMQConfig: RabbitMQConfig{URL: tt.url}}
+
+		if err := checkBroker(instance); (err != nil) != tt.wantErr {
+			t.Errorf("%s: checkBroker() error = %v, want error %v", name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestApplyDeprecated(t *testing.T) {
+	t.Parallel()
+
+	instance := &Config{
+		QueueConfig:    QueueConfig{Prefetch: 5},
+		RabbitMQConfig: RabbitMQConfig{Prefetch: 1, MaxRetries: 2, RetryDelay: time.Second},
+	}
+
+	applyDeprecated(instance)
+
+	if want := (QueueConfig{Prefetch: 5, MaxRetries: 2, RetryDelay: time.Second}); instance.QueueConfig != want {
+		t.Errorf("applyDeprecated() = %+v, want %+v", instance.QueueConfig, want)
+	}
+}
@@ -2,6 +2,7 @@ package config
 
 import (
 	"context"
+	"runtime"
 	"sync"
 
 	"github.com/joho/godotenv"
@@ -28,11 +29,48 @@ func GetInstance() *Config {
 	return instance
 }
 
+// Workers returns how many images are processed at the same time, IMG_WORKERS_NUMBER or twice the number of CPUs.
+func (c *ImageConfig) Workers() int {
+	if c.NumberOfWorkers > 0 {
+		return c.NumberOfWorkers
+	}
+
+	return 2 * runtime.GOMAXPROCS(0)
+}
+
+// ConcurrentJobs returns how many jobs are processed at the same time, IMG_MAX_CONCURRENT_JOBS or the number of
+// workers.
+func (c *ImageConfig) ConcurrentJobs() int {
+	if c.MaxConcurrentJobs > 0 {
+		return c.MaxConcurrentJobs
+	}
+
+	return c.Workers()
+}
+
+// applyDeprecated falls back to the deprecated variables for the settings that are not set.
+func applyDeprecated(instance *Config) {
+	queueCfg, rabbitCfg := &instance.QueueConfig, &instance.RabbitMQConfig
+
+	if queueCfg.Prefetch == 0 {
+		queueCfg.Prefetch = rabbitCfg.Prefetch
+	}
+
+	if queueCfg.MaxRetries == 0 {
+		queueCfg.MaxRetries = rabbitCfg.MaxRetries
+	}
+
+	if queueCfg.RetryDelay == 0 {
+		queueCfg.RetryDelay = rabbitCfg.RetryDelay
+	}
+}
+
 func Init(prefix string, serverType constants.ServerType) *Config {
 	once.Do(func() {
 		instance = &Config{}
 		if err := envconfig.Process(prefix, instance); err == nil && !instance.DEV {
 			validateEnvironment(instance, serverType)
+			validateBroker(instance)
 		} else {
 			_ = godotenv.Load(serverToConfig[serverType])
 
@@ -40,6 +78,8 @@ func Init(prefix string, serverType constants.ServerType) *Config {
 				logger.Panic(context.Background(), err)
 			}
 		}
+
+		applyDeprecated(instance)
 	})
 
 	return instance
@@ -20,7 +20,7 @@ const (
 )
 
 func validateEnvironment(instance *Config, serverType constants.ServerType) {
-	instanceType := reflect.TypeOf(instance)
+	instanceType := reflect.TypeOf(instance).Elem()
 
 	missingValues := make([]string, 0)
 
@@ -43,6 +43,22 @@ func validateEnvironment(instance *Config, serverType constants.ServerType) {
 	}
 }
 
+// validateBroker panics if the settings required by the selected broker are missing.
+func validateBroker(instance *Config) {
+	if err := checkBroker(instance); err != nil {
+		logger.Panic(context.Background(), err)
+	}
+}
+
+func checkBroker(instance *Config) error {
+	// rabbitmq is the default broker
+	if broker := instance.QueueConfig.Broker; (broker == "" || broker == "rabbitmq") && instance.RabbitMQConfig.URL == "" {
+		return fmt.Errorf("%w: RABBITMQ_URL is required by the rabbitmq broker", exceptions.ErrIncompleteEnvironment)
+	}
+
+	return nil
+}
+
 func validateStructVariable(configType reflect.Type, serverType constants.ServerType, missingValues *[]string) {
 	for i := 0; i < configType.NumField(); i++ {
 		field := configType.Field(i)
@@ -0,0 +1,143 @@
+package imageservice
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mikarios/golib/logger"
+
+	"github.com/mikarios/imageresizer/internal/services/config"
+	"github.com/mikarios/imageresizer/pkg/dtos/imagedto"
+	"github.com/mikarios/imageresizer/pkg/webhooksigner"
+)
+
+const (
+	// defaultWebhookMaxAttempts, defaultWebhookTimeout and defaultWebhookBackoff apply if IMG_WEBHOOK_MAX_ATTEMPTS,
+	// IMG_WEBHOOK_TIMEOUT or IMG_WEBHOOK_BACKOFF are not set.
+	defaultWebhookMaxAttempts = 4
+	defaultWebhookTimeout     = 10 * time.Second
+	defaultWebhookBackoff     = 2 * time.Second
+	// callbackShutdownTimeout bounds how long Destroy waits for the deliveries in progress.
+	callbackShutdownTimeout = 30 * time.Second
+)
+
+var (
+	errCallbackRejected = errors.New("callback rejected")
+	errCallbackFailed   = errors.New("could not deliver callback")
+
+	// callbacks tracks the deliveries in progress so that Destroy can wait for them.
+	callbacks sync.WaitGroup
+)
+
+// notifyCallback posts the report of the finished job to its callback url in the background.
+func notifyCallback(ctx context.Context, callbackURL string, report *imagedto.JobReport) {
+	if callbackURL == "" {
+		return
+	}
+
+	body, err := json.Marshal(report)
+	if err != nil {
+		logger.Error(ctx, err, "could not encode job callback", report.JobID)
+		return
+	}
+
+	callbacks.Add(1)
+
+	go func() {
+		defer callbacks.Done()
+
+		deliverCallback(ctx, &config.GetInstance().ImageConfig, report.JobID, callbackURL, body)
+	}()
+}
+
+// deliverCallback posts body to url until it is accepted or the attempts are exhausted, doubling the wait between
+// attempts. Every attempt is recorded to the status of the job.
+func deliverCallback(ctx context.Context, cfg *config.ImageConfig, jobID, url string, body []byte) {
+	maxAttempts, backoff, timeout := cfg.WebhookMaxAttempts, cfg.WebhookBackoff, cfg.WebhookTimeout
+	if maxAttempts <= 0 {
+		maxAttempts = defaultWebhookMaxAttempts
+	}
+
+	if backoff <= 0 {
+		backoff = defaultWebhookBackoff
+	}
+
+	if timeout <= 0 {
+		timeout = defaultWebhookTimeout
+	}
+
+	client := &http.Client{Timeout: timeout}
+
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		record := &imagedto.CallbackAttempt{At: time.Now().UTC()}
+
+		statusCode, err := postCallback(ctx, client, cfg.WebhookSecret, url, body)
+		if record.StatusCode = statusCode; err != nil {
+			record.Error = err.Error()
+		}
+
+		recordCallbackAttempt(jobID, record)
+
+		if err == nil {
+			return
+		}
+
+		logger.Warning(ctx, fmt.Sprintf("callback attempt %d/%d of job %s failed", attempt, maxAttempts, jobID), err.Error())
+
+		if attempt < maxAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+
+	logger.Error(ctx, errCallbackFailed, "giving up on callback of job", jobID, url)
+}
+
+// waitForCallbacks waits for the deliveries in progress for at most timeout and reports whether all of them finished.
+func waitForCallbacks(timeout time.Duration) bool {
+	done := make(chan struct{})
+
+	go func() {
+		callbacks.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func postCallback(ctx context.Context, client *http.Client, secret, url string, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	if secret != "" {
+		webhooksigner.SignRequest(req, secret, body, time.Now())
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return resp.StatusCode, fmt.Errorf("%w: %s", errCallbackRejected, resp.Status)
+	}
+
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,72 @@
+// nolint:testpackage // access to internal functions needed
+package imageservice
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mikarios/imageresizer/internal/services/config"
+	"github.com/mikarios/imageresizer/pkg/dtos/imagedto"
+)
+
+func TestDeliverCallback(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		failures    int32
+		maxAttempts int
+		want        int
+	}{
+		"retried until accepted":  {failures: 2, want: 3},
+		"default attempts":        {failures: 100, want: defaultWebhookMaxAttempts},
+		"configured attempts":     {failures: 100, maxAttempts: 2, want: 2},
+		"accepted the first time": {want: 1},
+	}
+
+	for name, tt := range tests {
+		tt := tt
+
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			var calls int32
+
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt32(&calls, 1) <= tt.failures {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			defer srv.Close()
+
+			ctx := context.Background()
+			data := &imagedto.ImageProcessJobData{ShopID: 1}
+
+			status, _, err := RegisterJob(ctx, data, imagedto.PriorityNormal)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			cfg := &config.ImageConfig{WebhookMaxAttempts: tt.maxAttempts, WebhookBackoff: time.Millisecond}
+			deliverCallback(ctx, cfg, status.ID, srv.URL, []byte(`{}`))
+
+			if got := int(atomic.LoadInt32(&calls)); got != tt.want {
+				t.Errorf("callback posted %d times, want %d", got, tt.want)
+			}
+
+			if status, err = GetJob(status.ID); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := len(status.CallbackAttempts); got != tt.want {
+				t.Errorf("%d attempts recorded, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -3,10 +3,13 @@ package imageservice
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"path"
-	"reflect"
 	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -14,26 +17,31 @@ import (
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/lambda"
-	"github.com/streadway/amqp"
 
 	"github.com/mikarios/golib/logger"
 
 	"github.com/mikarios/imageresizer/internal/imagehelper"
+	"github.com/mikarios/imageresizer/internal/pathtemplate"
 	"github.com/mikarios/imageresizer/internal/services/cdnservice"
 	"github.com/mikarios/imageresizer/internal/services/config"
 	"github.com/mikarios/imageresizer/pkg/dtos/imagedto"
+	"github.com/mikarios/imageresizer/pkg/queueservice"
 )
 
 var (
 	once         sync.Once
 	jobChan      chan *imagedto.ImageProcessJob
-	imageJobChan chan *imageJob
+	images       *scheduler
 	noOfWorkers  int
 	finishedChan chan interface{}
 )
 
+var errLambdaFunction = errors.New("processimage lambda failed")
+
 type imageJob struct {
 	*imagehelper.ImageJob
+	ctx       context.Context
+	data      *imagedto.ImageProcessJobData
 	errorChan chan []error
 }
 
@@ -48,123 +56,266 @@ func Init() <-chan *imagedto.ImageProcessJob {
 		cfg := config.GetInstance()
 
 		maxProcesses := runtime.GOMAXPROCS(0)
-		noOfWorkers = 2 * maxProcesses
-
-		if cfg.ImageConfig.NumberOfWorkers > 0 {
-			noOfWorkers = cfg.ImageConfig.NumberOfWorkers
-		}
+		noOfWorkers = cfg.ImageConfig.Workers()
 
 		logger.Debug(context.Background(), fmt.Sprintf("found %v threads, spawning %v workers", maxProcesses, noOfWorkers))
 
+		if _, err := imagehelper.ResolvePathTemplate(""); err != nil {
+			logger.Panic(context.Background(), err, "invalid IMG_PATH_TEMPLATE")
+		}
+
 		jobChan = make(chan *imagedto.ImageProcessJob)
-		imageJobChan = make(chan *imageJob)
+		images = newScheduler(cfg.ImageConfig.ShopWeights, cfg.ImageConfig.ShopMaxWorkers)
 		finishedChan = make(chan interface{})
 
 		for i := 0; i < noOfWorkers; i++ {
 			go spawnWorker(cfg)
 		}
 
-		go listenForJobs()
+		go listenForJobs(cfg.ImageConfig.ConcurrentJobs())
+
+		openJournal(&cfg.ImageConfig, cfg.QueueConfig.Broker)
 	})
 
 	return jobChan
 }
 
 func Destroy() {
+	stopJournal()
 	close(jobChan)
 
 	for i := 0; i < noOfWorkers; i++ {
 		<-finishedChan
 	}
+
+	if !waitForCallbacks(callbackShutdownTimeout) {
+		logger.Warning(context.Background(), "giving up on the callbacks still being delivered")
+	}
+
+	closeJournal()
 }
 
-func listenForJobs() {
+// listenForJobs receives jobs while fewer than the configured maximum are in flight and processes each of them in the
+// background. Once jobChan is closed it waits for the jobs in flight and releases the workers.
+func listenForJobs(maxJobs int) {
 	cfg := config.GetInstance()
 	cdn := cdnservice.GetInstance()
+	slots := make(chan struct{}, maxJobs)
+
+	var inFlight sync.WaitGroup
+
+	for {
+		// a slot is taken before receiving, so that jobs over the limit stay in the queue
+		slots <- struct{}{}
+
+		job, ok := <-jobChan
+		if !ok {
+			break
+		}
+
+		inFlight.Add(1)
+
+		go func() {
+			defer func() {
+				<-slots
+				inFlight.Done()
+			}()
+
+			handleJob(cfg, cdn, job)
+		}()
+	}
+
+	inFlight.Wait()
+	images.close()
+}
+
+// handleJob processes the job, reports its outcome and settles its message.
+func handleJob(cfg *config.Config, cdn *cdnservice.CdnStruct, job *imagedto.ImageProcessJob) {
 	ctx := context.Background()
 
-	for job := range jobChan {
-		var err error
+	if duplicateJob(ctx, job.Data) {
+		logger.Info(ctx, "dropping duplicate job", job.Data.ShopID, job.Data.IdempotencyKey, job.Data.ID)
 
-		logger.Debug(ctx, "received new job for shop ID", job.Data.ShopID)
+		if job.QueueJob != nil {
+			_ = job.QueueJob.Ack()
+		}
 
-		now := time.Now()
-		errorChannel := make(chan []error)
-		collectedErrors := make([]error, 0)
-		listOfFiles := make(map[string]interface{})
+		return
+	}
 
-		if job.Data.ShopID != 0 {
-			start := time.Now()
-			baseImagePath := imagehelper.ImageSubPath("", &job.Data.ShopID, "", nil, nil, nil, nil, "")
+	jobCtx, cancel := imagehelper.WithJobDeadline(ctx, job.Data)
 
-			listOfFiles, err = cdn.ListFilesToMap("", path.Join(cfg.CDN.ImagesFolder, baseImagePath))
-			if err != nil {
-				listOfFiles = nil
-			}
+	if !jobStarted(ctx, job, cancel) {
+		cancel()
+		logger.Info(ctx, "dropping cancelled or running job", job.Data.ShopID, job.Data.ID)
 
-			logger.Debug(ctx, fmt.Sprintf("LIST: %v finished. Took: %v", baseImagePath, time.Since(start)))
+		if job.QueueJob != nil {
+			_ = job.QueueJob.Ack()
 		}
 
-		go func() {
-			for _, imgJob := range job.Data.Images {
-				newImageJob := imageJob{
-					ImageJob: &imagehelper.ImageJob{
-						ImageStruct:    imgJob,
-						ShopID:         job.Data.ShopID,
-						ImageExtension: job.Data.ImageExtension,
-						ImagesOnCdn:    &listOfFiles,
-					},
-					errorChan: errorChannel,
-				}
-
-				imageJobChan <- &newImageJob
-			}
-
-			deleteImageJob := imageJob{
-				ImageJob: &imagehelper.ImageJob{
-					DeleteImages: job.Data.DeleteImages,
-				},
-				errorChan: errorChannel,
-			}
-			imageJobChan <- &deleteImageJob
-		}()
+		return
+	}
+
+	logger.Debug(ctx, "received new job for shop ID", job.Data.ShopID, job.Data.ID)
+
+	go watchCancel(jobCtx, job.Data.ID, cancel)
 
-		for i := 0; i < len(job.Data.Images)+1; i++ {
-			if imageErrors := <-errorChannel; len(imageErrors) > 0 {
-				collectedErrors = append(collectedErrors, imageErrors...)
-			}
+	reserveStarted(ctx, job.Data)
+
+	now := time.Now()
+	result := processJob(jobCtx, cfg, cdn, job)
+	result.cancelled = errors.Is(jobCtx.Err(), context.Canceled)
+
+	cancel()
+	jobFinished(ctx, job.Data.ID, result)
+	recordBytes(ctx, job.Data.ShopID, result.storedBytes)
+
+	if status, err := GetJob(job.Data.ID); err == nil {
+		journalError(journal.Finished(status.ID, status.State), status.ID)
+
+		// failed and cancelled jobs do not count, retries reserve their images again once started
+		if status.State == imagedto.JobStateFailed || status.State == imagedto.JobStateCancelled {
+			ReleaseQuota(ctx, status.ID)
 		}
+	}
 
-		close(errorChannel)
-		logger.Debug(ctx, fmt.Sprintf("job for shop ID: %v finished. Took: %v", job.Data.ShopID, time.Since(now)))
+	reportJob(ctx, job.Data.ID, job.Data.CallbackURL)
+	logger.Debug(ctx, fmt.Sprintf("job for shop ID: %v finished. Took: %v", job.Data.ShopID, time.Since(now)))
 
-		if len(collectedErrors) > 0 {
-			for _, err = range collectedErrors {
-				logger.Error(ctx, err, "unable to process job", job.Data.ShopID)
-			}
+	// If job is not received from a queue there is nothing to settle
+	if job.QueueJob == nil {
+		return
+	}
 
-			// imageProcessErrorsNotification(ctx, collectedErrors, job)
-			// If job is added from API call do not respond to queue
-			if reflect.DeepEqual(job.QueueJob, amqp.Delivery{}) {
-				continue
-			}
+	// cancelled jobs and jobs past their deadline are not retried
+	if len(result.errors) > 0 && !result.cancelled && !pastDeadline(job.Data) {
+		for _, err := range result.errors {
+			logger.Error(ctx, err, "unable to process job", job.Data.ShopID, job.Data.ID)
+		}
 
-			go func() {
-				time.Sleep(time.Minute)
+		if err := job.QueueJob.Retry(); err != nil {
+			logger.Error(ctx, err, "could not retry job", job.Data.ShopID, job.Data.ID)
+		}
 
-				_ = job.QueueJob.Nack(false, !job.QueueJob.Redelivered)
-			}()
-		} else {
-			// If job is added from API call do not respond to queue
-			if reflect.DeepEqual(job.QueueJob, amqp.Delivery{}) {
-				continue
-			}
+		return
+	}
+
+	_ = job.QueueJob.Ack()
+}
+
+// reportJob sends the report of the finished job to its callback url and to the result exchange.
+func reportJob(ctx context.Context, id, callbackURL string) {
+	report, err := jobReport(id)
+	if err != nil {
+		logger.Error(ctx, err, "could not report job", id)
+		return
+	}
+
+	notifyCallback(ctx, callbackURL, report)
+
+	if err = queueservice.GetInstance().ResultPublish(report); err != nil {
+		logger.Error(ctx, err, "could not publish job result", id)
+	}
+}
+
+// processJob fans out the images of the job to the workers and returns the outcome once all of them finish. Images
+// not started by the time ctx is cancelled are skipped.
+func processJob(
+	ctx context.Context,
+	cfg *config.Config,
+	cdn *cdnservice.CdnStruct,
+	job *imagedto.ImageProcessJob,
+) *jobResult {
+	result := &jobResult{items: len(job.Data.Images), producedKeys: make([]string, 0)}
+	if len(job.Data.DeleteImages) > 0 {
+		result.items++
+	}
+
+	tmpl, err := imagehelper.ResolvePathTemplate(job.Data.PathTemplate)
+	if err != nil {
+		result.errors, result.failedItems = []error{err}, result.items
+
+		return result
+	}
+
+	errorChannel := make(chan []error)
+
+	// without a listing every variant is generated again
+	var imagesOnCdn *map[string]interface{}
+
+	if job.Data.ShopID != 0 && !job.Data.Overwrite {
+		listOfFiles := listImagesOnCdn(ctx, cdn, cfg.CDN.ImagesFolder, tmpl, job.Data)
+		imagesOnCdn = &listOfFiles
+	}
+
+	imageJobs := make([]*imageJob, 0, len(job.Data.Images)+1)
 
-			_ = job.QueueJob.Ack(false)
+	for _, j := range imagehelper.NewImageJobs(job.Data, tmpl.String(), imagesOnCdn) {
+		imageJobs = append(imageJobs, &imageJob{ImageJob: j, ctx: ctx, data: job.Data, errorChan: errorChannel})
+	}
+
+	images.add(job.Data.ShopID, imageJobs)
+
+	for range imageJobs {
+		if imageErrors := <-errorChannel; len(imageErrors) > 0 {
+			result.errors = append(result.errors, imageErrors...)
+			result.failedItems++
+		}
+	}
+
+	close(errorChannel)
+
+	for _, j := range imageJobs {
+		result.producedKeys = append(result.producedKeys, j.StoredKeys...)
+		result.storedBytes += j.StoredBytes
+	}
+
+	return result
+}
+
+// listImagesOnCdn lists the folders of the products referenced in the job, or the folder of the whole shop if the
+// template does not separate products. Returns nil if any listing fails so that nothing is skipped.
+func listImagesOnCdn(
+	ctx context.Context,
+	cdn *cdnservice.CdnStruct,
+	imagesFolder string,
+	tmpl *pathtemplate.Template,
+	data *imagedto.ImageProcessJobData,
+) map[string]interface{} {
+	shopID := strconv.Itoa(data.ShopID)
+	prefixes := make([]string, 0, len(data.Images))
+
+	for _, img := range data.Images {
+		prefix := tmpl.Prefix(&pathtemplate.Vars{ShopID: shopID, ProductID: img.ProductID})
+		prefixes = append(prefixes, path.Join(imagesFolder, prefix)+"/")
+	}
+
+	sort.Strings(prefixes)
+
+	listOfFiles := make(map[string]interface{})
+
+	for i, prefix := range prefixes {
+		// sorted, so a prefix covered by a shorter one directly follows it or one of its duplicates
+		if i > 0 && strings.HasPrefix(prefix, prefixes[i-1]) {
+			prefixes[i] = prefixes[i-1]
+			continue
 		}
+
+		start := time.Now()
+
+		files, err := cdn.ListFilesToMap(ctx, "", prefix)
+		if err != nil {
+			return nil
+		}
+
+		for k, v := range files {
+			listOfFiles[k] = v
+		}
+
+		logger.Debug(ctx, fmt.Sprintf("LIST: %v finished. Took: %v", prefix, time.Since(start)))
 	}
 
-	close(imageJobChan)
+	return listOfFiles
 }
 
 func spawnWorker(cfg *config.Config) {
@@ -172,22 +323,108 @@ func spawnWorker(cfg *config.Config) {
 		finishedChan <- struct{}{}
 	}()
 
-	ctx := context.Background()
+	for {
+		job, ok := images.next()
+		if !ok {
+			return
+		}
 
-	for job := range imageJobChan {
-		if cfg.LambdaConfig.Function != "" {
-			if err := callLambdaProcessJob(job.ImageJob, &cfg.LambdaConfig); err != nil {
-				job.errorChan <- []error{err}
-			} else {
-				job.errorChan <- nil
-			}
-		} else {
-			job.errorChan <- imagehelper.ProcessJobImage(ctx, job.ImageJob)
+		ctx, cancel := imagehelper.WithImageTimeout(job.ctx, job.data)
+		errs, abandoned := processImage(ctx, cfg, job)
+
+		cancel()
+
+		job.errorChan <- errs
+
+		// the worker stays taken until the processing really returns, so that abandoned processing is bounded by the
+		// number of workers
+		if abandoned != nil {
+			<-abandoned
+			logger.Debug(context.Background(), "abandoned processing returned", job.data.ShopID, job.data.ID)
 		}
+
+		images.done(job.data.ShopID)
 	}
 }
 
-func callLambdaProcessJob(job *imagehelper.ImageJob, lambdaConfig *config.LambdaConfig) error {
+// processImage processes the image in the background, so that the image is reported once ctx is done even if a decode
+// or a call that ignores ctx does not return. The image is then reported as interrupted, whatever the abandoned
+// processing stores is not reported and the returned channel receives once it returns.
+func processImage(ctx context.Context, cfg *config.Config, job *imageJob) ([]error, <-chan []error) {
+	// the abandoned processing works on its own copy so that it does not race with the job
+	imgJob := *job.ImageJob
+	done := make(chan []error, 1)
+
+	go func() {
+		if cfg.LambdaConfig.Function == "" {
+			done <- imagehelper.ProcessJobImage(ctx, &imgJob)
+			return
+		}
+
+		errs, err := callLambdaProcessJob(ctx, &imgJob, &cfg.LambdaConfig)
+		if err != nil {
+			done <- []error{err}
+			return
+		}
+
+		done <- errs
+	}()
+
+	select {
+	case errs := <-done:
+		job.StoredKeys, job.StoredBytes = imgJob.StoredKeys, imgJob.StoredBytes
+		return errs, nil
+	case <-ctx.Done():
+	}
+
+	// prefer the result if the processing finished just in time
+	select {
+	case errs := <-done:
+		job.StoredKeys, job.StoredBytes = imgJob.StoredKeys, imgJob.StoredBytes
+		return errs, nil
+	default:
+	}
+
+	imageURL := ""
+	if job.ImageStruct != nil {
+		imageURL = job.URL
+	}
+
+	return []error{&imagedto.ProcessImageError{
+		URL: imageURL,
+		Err: imagehelper.Interrupted(ctx).Error(),
+		Msg: ctx.Err().Error(),
+	}}, done
+}
+
+// pastDeadline reports whether the deadline of the job has passed, so retrying it would fail again.
+func pastDeadline(data *imagedto.ImageProcessJobData) bool {
+	return data.Deadline != nil && time.Now().After(*data.Deadline)
+}
+
+// onCdn reports whether the image at imagePath was already stored when the job started.
+func onCdn(job *imagehelper.ImageJob, imagesFolder, imagePath string) bool {
+	if job.ImagesOnCdn == nil {
+		return false
+	}
+
+	_, ok := (*job.ImagesOnCdn)[path.Join(imagesFolder, imagePath)]
+
+	return ok
+}
+
+// callLambdaProcessJob processes the variants of job that are not on the cdn yet with the processimage lambda. It
+// fills the StoredKeys and StoredBytes of job and returns the errors the lambda collected, or an error if the lambda
+// could not be called.
+func callLambdaProcessJob(
+	ctx context.Context,
+	job *imagehelper.ImageJob,
+	lambdaConfig *config.LambdaConfig,
+) ([]error, error) {
+	if interrupted := imagehelper.Interrupted(ctx); interrupted != nil {
+		return nil, fmt.Errorf("%w: %s", interrupted, ctx.Err().Error())
+	}
+
 	cdnConfig := config.GetInstance().CDN
 	scale := make([]*int, 0)
 	crop := make([]*imagedto.Dimensions, 0)
@@ -195,37 +432,37 @@ func callLambdaProcessJob(job *imagehelper.ImageJob, lambdaConfig *config.Lambda
 	minYMaxX := make([]*imagedto.Dimensions, 0)
 
 	for _, scaleDimension := range job.ScaleDimensionMax {
-		imagePath := imagehelper.ImageSubPath("", &job.ShopID, job.ProductID, scaleDimension, nil, nil, nil, job.Name)
-		if _, ok := (*job.ImagesOnCdn)[path.Join(cdnConfig.ImagesFolder, imagePath)]; !ok {
+		imagePath := job.SubPath(scaleDimension, nil, nil, nil)
+		if !onCdn(job, cdnConfig.ImagesFolder, imagePath) {
 			scale = append(scale, scaleDimension)
 		}
 	}
 
 	for _, cropDimension := range job.CropDimensions {
-		imagePath := imagehelper.ImageSubPath("", &job.ShopID, job.ProductID, nil, cropDimension, nil, nil, job.Name)
-		if _, ok := (*job.ImagesOnCdn)[path.Join(cdnConfig.ImagesFolder, imagePath)]; !ok {
+		imagePath := job.SubPath(nil, cropDimension, nil, nil)
+		if !onCdn(job, cdnConfig.ImagesFolder, imagePath) {
 			crop = append(crop, cropDimension)
 		}
 	}
 
 	for _, v := range job.MinXMaxY {
-		imagePath := imagehelper.ImageSubPath("", &job.ShopID, job.ProductID, nil, nil, v, nil, job.Name)
-		if _, ok := (*job.ImagesOnCdn)[path.Join(cdnConfig.ImagesFolder, imagePath)]; !ok {
+		imagePath := job.SubPath(nil, nil, v, nil)
+		if !onCdn(job, cdnConfig.ImagesFolder, imagePath) {
 			minXMaxY = append(minXMaxY, v)
 		}
 	}
 
 	for _, v := range job.MinYMaxX {
-		imagePath := imagehelper.ImageSubPath("", &job.ShopID, job.ProductID, nil, nil, nil, v, job.Name)
-		if _, ok := (*job.ImagesOnCdn)[path.Join(cdnConfig.ImagesFolder, imagePath)]; !ok {
+		imagePath := job.SubPath(nil, nil, nil, v)
+		if !onCdn(job, cdnConfig.ImagesFolder, imagePath) {
 			minYMaxX = append(minYMaxX, v)
 		}
 	}
 
 	job.ScaleDimensionMax, job.CropDimensions, job.MinXMaxY, job.MinYMaxX = scale, crop, minXMaxY, minYMaxX
 
-	if len(scale) == 0 && len(crop) == 0 && len(minXMaxY) == 0 && len(minXMaxY) == 0 {
-		return nil
+	if len(scale) == 0 && len(crop) == 0 && len(minXMaxY) == 0 && len(minYMaxX) == 0 {
+		return nil, nil
 	}
 
 	sess := session.Must(session.NewSessionWithOptions(session.Options{SharedConfigState: session.SharedConfigEnable}))
@@ -239,13 +476,33 @@ func callLambdaProcessJob(job *imagehelper.ImageJob, lambdaConfig *config.Lambda
 
 	payload, err := json.Marshal(job)
 	if err != nil {
-		return fmt.Errorf("error marshalling processimage lambda request: %w", err)
+		return nil, fmt.Errorf("error marshalling processimage lambda request: %w", err)
+	}
+
+	out, err := client.InvokeWithContext(ctx, &lambda.InvokeInput{FunctionName: &lambdaConfig.Function, Payload: payload})
+	if interrupted := imagehelper.Interrupted(ctx); err != nil && interrupted != nil {
+		return nil, fmt.Errorf("%w: error calling processimage lambda: %s", interrupted, err.Error())
 	}
 
-	_, err = client.Invoke(&lambda.InvokeInput{FunctionName: &lambdaConfig.Function, Payload: payload})
 	if err != nil {
-		return fmt.Errorf("error calling processimage lambda: %w", err)
+		return nil, fmt.Errorf("error calling processimage lambda: %w", err)
 	}
 
-	return nil
+	return lambdaResult(job, out)
+}
+
+// lambdaResult records what the processimage lambda stored for job and returns the errors it collected.
+func lambdaResult(job *imagehelper.ImageJob, out *lambda.InvokeOutput) ([]error, error) {
+	if out.FunctionError != nil {
+		return nil, fmt.Errorf("%w: %s: %s", errLambdaFunction, *out.FunctionError, out.Payload)
+	}
+
+	res := &imagehelper.ProcessResult{}
+	if err := json.Unmarshal(out.Payload, res); err != nil {
+		return nil, fmt.Errorf("error decoding processimage lambda response: %w", err)
+	}
+
+	job.StoredKeys, job.StoredBytes = res.StoredKeys, res.StoredBytes
+
+	return res.Errs(), nil
 }
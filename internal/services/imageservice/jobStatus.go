@@ -0,0 +1,600 @@
+package imageservice
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mikarios/golib/logger"
+
+	"github.com/mikarios/imageresizer/internal/exceptions"
+	"github.com/mikarios/imageresizer/internal/services/config"
+	"github.com/mikarios/imageresizer/internal/services/stateservice"
+	"github.com/mikarios/imageresizer/pkg/dtos/imagedto"
+)
+
+const (
+	defaultJobStatusRetention = 24 * time.Hour
+	defaultJobStatusMaxAge    = 7 * 24 * time.Hour
+
+	// idempotencyKeyPrefix prefixes the idempotency keys in the state store, jobStatePrefix the states of the jobs and
+	// cancelPrefix their cancellations.
+	idempotencyKeyPrefix = "idempotency:"
+	jobStatePrefix       = "job:"
+	cancelPrefix         = "cancel:"
+
+	// A cancellation is cancelReported if the cancelling instance reported the job as cancelled already, or
+	// cancelRequested if the instance receiving or running the job has to.
+	cancelReported  = "reported"
+	cancelRequested = "requested"
+	// cancelPollInterval is how often running jobs check whether another instance cancelled them.
+	cancelPollInterval = 2 * time.Second
+)
+
+// jobs holds the status of the jobs seen by this instance. Finished jobs are forgotten after IMG_JOB_STATUS_RETENTION
+// and unfinished ones after IMG_JOB_STATUS_MAX_AGE. The idempotency keys are kept in the state store instead, so that
+// every instance knows them.
+var jobs = &jobRegistry{
+	jobs:    make(map[string]*imagedto.JobStatus),
+	cancels: make(map[string]context.CancelFunc),
+}
+
+type jobRegistry struct {
+	mu   sync.RWMutex
+	jobs map[string]*imagedto.JobStatus
+	// cancels holds the cancel functions of the running jobs
+	cancels map[string]context.CancelFunc
+}
+
+// idempotencyKey maps an idempotency key to the job first scheduled with it and the hash of its payload.
+type idempotencyKey struct {
+	JobID   string `json:"jobID"`
+	Payload string `json:"payload"`
+}
+
+// jobResult is the outcome of processJob.
+type jobResult struct {
+	errors       []error
+	items        int
+	failedItems  int
+	producedKeys []string
+	storedBytes  int64
+	cancelled    bool
+}
+
+// RegisterJob assigns an ID to the job, if it does not have one, and records it as queued, in the journal as well if
+// enabled. If a job of the same shop was already registered with the same idempotency key, by any instance, the status
+// of that job is returned instead and false. Only the ID is known of the jobs registered by other instances. Returns
+// exceptions.ErrIdempotencyKeyReused if that job had a different payload.
+func RegisterJob(
+	ctx context.Context,
+	data *imagedto.ImageProcessJobData,
+	priority imagedto.PriorityType,
+) (*imagedto.JobStatus, bool, error) {
+	if data.ID == "" {
+		data.ID = newJobID()
+	}
+
+	id, claimed, err := claimKey(ctx, data)
+	if err != nil {
+		return nil, false, err
+	}
+
+	jobs.mu.Lock()
+
+	if !claimed {
+		defer jobs.mu.Unlock()
+
+		if status, ok := jobs.jobs[id]; ok {
+			return copyStatus(status), false, nil
+		}
+
+		return &imagedto.JobStatus{ID: id}, false, nil
+	}
+
+	status := newStatus(data, priority)
+
+	jobs.prune(time.Now())
+	jobs.jobs[status.ID] = status
+	jobs.mu.Unlock()
+
+	shareState(ctx, status.ID, status.State)
+	journalError(journal.Record(data, priority), status.ID)
+
+	return copyStatus(status), true, nil
+}
+
+// ForgetJob removes the job from the registry and releases its idempotency key, e.g. because it could not be
+// scheduled.
+func ForgetJob(ctx context.Context, data *imagedto.ImageProcessJobData) {
+	jobs.mu.Lock()
+	delete(jobs.jobs, data.ID)
+	jobs.mu.Unlock()
+
+	if data.IdempotencyKey != "" {
+		if err := stateservice.GetInstance().Delete(ctx, idempotencyKeyPrefix+scopedKey(data)); err != nil {
+			logger.Error(ctx, err, "could not release idempotency key", data.ShopID, data.IdempotencyKey)
+		}
+	}
+
+	journalError(journal.Remove(data.ID), data.ID)
+}
+
+// GetJob returns the status of the job with the given ID.
+func GetJob(id string) (*imagedto.JobStatus, error) {
+	jobs.mu.RLock()
+	defer jobs.mu.RUnlock()
+
+	status, ok := jobs.jobs[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: job %s", exceptions.ErrNotFound, id)
+	}
+
+	return copyStatus(status), nil
+}
+
+// ListJobs returns the jobs of the given shop in the given state, newest first. Zero values match every shop or state.
+func ListJobs(shopID int, state imagedto.JobState) []*imagedto.JobStatus {
+	jobs.mu.RLock()
+	defer jobs.mu.RUnlock()
+
+	res := make([]*imagedto.JobStatus, 0)
+
+	for _, status := range jobs.jobs {
+		if (shopID == 0 || status.ShopID == shopID) && (state == "" || status.State == state) {
+			res = append(res, copyStatus(status))
+		}
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].CreatedAt.Equal(res[j].CreatedAt) {
+			return res[i].ID < res[j].ID
+		}
+
+		return res[i].CreatedAt.After(res[j].CreatedAt)
+	})
+
+	return res
+}
+
+// duplicateJob reports whether the job repeats another one with the same idempotency key, in which case it should be
+// dropped. A job is not a duplicate of itself unless it already succeeded, so that failed jobs can be retried. Jobs
+// without an ID, e.g. published to the queue by other services, are assigned one derived from their key, so that
+// redeliveries of the same message are recognised. If the idempotency keys cannot be checked the job is processed.
+func duplicateJob(ctx context.Context, data *imagedto.ImageProcessJobData) bool {
+	if data.ID == "" {
+		data.ID = newJobID()
+
+		if data.IdempotencyKey != "" {
+			sum := sha256.Sum256([]byte(scopedKey(data)))
+			data.ID = hex.EncodeToString(sum[:16])
+		}
+	}
+
+	id, claimed, err := claimKey(ctx, data)
+
+	switch {
+	case errors.Is(err, exceptions.ErrIdempotencyKeyReused):
+		return true
+	case err != nil:
+		logger.Error(ctx, err, "could not check idempotency key", data.ShopID, data.IdempotencyKey)
+
+		return false
+	case claimed:
+		return false
+	case id != data.ID:
+		return true
+	}
+
+	jobs.mu.RLock()
+	defer jobs.mu.RUnlock()
+
+	status, ok := jobs.jobs[id]
+
+	return ok && status.State == imagedto.JobStateSucceeded
+}
+
+// CancelJob cancels the job with the given ID, on whichever instance it is. Queued jobs registered by this instance are
+// reported as cancelled right away and dropped once received. Running jobs skip their remaining images and are
+// reported as cancelled once the images in progress finish. The jobs queued or running elsewhere are cancel requested
+// until the instance receiving or running them cancels them, within cancelPollInterval for running jobs.
+func CancelJob(ctx context.Context, id string) (*imagedto.JobStatus, error) {
+	state, err := sharedState(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs.mu.Lock()
+
+	status, ok := jobs.jobs[id]
+	if ok && status.State.Finished() {
+		state = status.State
+	}
+
+	if !ok && state == "" {
+		jobs.mu.Unlock()
+
+		return nil, fmt.Errorf("%w: job %s", exceptions.ErrNotFound, id)
+	}
+
+	if state.Finished() {
+		jobs.mu.Unlock()
+
+		return nil, fmt.Errorf("%w: job %s already %s", exceptions.ErrInvalidJobState, id, state)
+	}
+
+	if cancel, running := jobs.cancels[id]; running {
+		cancel()
+
+		defer jobs.mu.Unlock()
+
+		return copyStatus(status), nil
+	}
+
+	// queued here, as far as the other instances know
+	if ok && state != imagedto.JobStateRunning {
+		now := time.Now().UTC()
+		status.State, status.FinishedAt = imagedto.JobStateCancelled, &now
+		res := copyStatus(status)
+		jobs.mu.Unlock()
+
+		if err = requestCancel(ctx, id, cancelReported); err != nil {
+			return nil, err
+		}
+
+		shareState(ctx, id, imagedto.JobStateCancelled)
+		ReleaseQuota(ctx, id)
+		journalError(journal.Finished(id, imagedto.JobStateCancelled), id)
+		// the callback outlives the request that cancelled the job
+		reportJob(context.Background(), id, res.CallbackURL)
+
+		return res, nil
+	}
+
+	res := &imagedto.JobStatus{ID: id, State: imagedto.JobStateCancelRequested}
+	if ok {
+		status.State = imagedto.JobStateCancelRequested
+		res = copyStatus(status)
+	}
+
+	jobs.mu.Unlock()
+
+	if err = requestCancel(ctx, id, cancelRequested); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// jobStarted marks the job as running, with cancel stopping it. Jobs not registered yet, e.g. published to the queue
+// by other services or instances, are registered first. Returns false if the job was cancelled or is already running,
+// e.g. because its message was redelivered while it was being processed. Jobs cancelled on another instance are
+// reported as cancelled here, unless that instance did so already.
+func jobStarted(ctx context.Context, job *imagedto.ImageProcessJob, cancel context.CancelFunc) bool {
+	if job.Data.ID == "" {
+		job.Data.ID = newJobID()
+	}
+
+	cancelled := cancellation(ctx, job.Data.ID)
+
+	jobs.mu.Lock()
+
+	status, ok := jobs.jobs[job.Data.ID]
+	if !ok {
+		jobs.prune(time.Now())
+
+		status = newStatus(job.Data, "")
+		jobs.jobs[status.ID] = status
+	}
+
+	if cancelled != "" && !status.State.Finished() {
+		now := time.Now().UTC()
+		status.State, status.FinishedAt = imagedto.JobStateCancelled, &now
+		jobs.mu.Unlock()
+
+		ReleaseQuota(ctx, job.Data.ID)
+
+		if cancelled == cancelRequested {
+			shareState(ctx, job.Data.ID, imagedto.JobStateCancelled)
+			journalError(journal.Finished(job.Data.ID, imagedto.JobStateCancelled), job.Data.ID)
+			reportJob(ctx, job.Data.ID, job.Data.CallbackURL)
+		}
+
+		return false
+	}
+
+	if status.State == imagedto.JobStateCancelled || status.State == imagedto.JobStateRunning {
+		jobs.mu.Unlock()
+
+		return false
+	}
+
+	jobs.cancels[status.ID] = cancel
+	now := time.Now().UTC()
+	status.State, status.StartedAt, status.FinishedAt = imagedto.JobStateRunning, &now, nil
+	status.ProducedKeys, status.Errors = make([]string, 0), make([]*imagedto.ProcessImageError, 0)
+	jobs.mu.Unlock()
+
+	shareState(ctx, job.Data.ID, imagedto.JobStateRunning)
+	journalError(journal.Started(job.Data.ID), job.Data.ID)
+
+	return true
+}
+
+// watchCancel cancels the running job once another instance requests it. Returns once ctx is done.
+func watchCancel(ctx context.Context, id string, cancel context.CancelFunc) {
+	ticker := time.NewTicker(cancelPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if cancellation(ctx, id) != "" {
+				cancel()
+				return
+			}
+		}
+	}
+}
+
+// jobFinished records the outcome of the job.
+func jobFinished(ctx context.Context, id string, result *jobResult) {
+	jobs.mu.Lock()
+
+	delete(jobs.cancels, id)
+
+	status, ok := jobs.jobs[id]
+	if !ok {
+		jobs.mu.Unlock()
+
+		return
+	}
+
+	now := time.Now().UTC()
+	status.FinishedAt = &now
+	status.ProducedKeys = append(status.ProducedKeys, result.producedKeys...)
+
+	for _, err := range result.errors {
+		var processErr *imagedto.ProcessImageError
+		if !errors.As(err, &processErr) {
+			processErr = &imagedto.ProcessImageError{Err: err.Error()}
+		}
+
+		status.Errors = append(status.Errors, processErr)
+	}
+
+	switch {
+	case result.cancelled:
+		status.State = imagedto.JobStateCancelled
+	case len(result.errors) == 0:
+		status.State = imagedto.JobStateSucceeded
+	case result.failedItems >= result.items:
+		status.State = imagedto.JobStateFailed
+	default:
+		status.State = imagedto.JobStatePartiallyFailed
+	}
+
+	state := status.State
+	jobs.mu.Unlock()
+
+	shareState(ctx, id, state)
+}
+
+// jobReport returns the report of the job with the given ID.
+func jobReport(id string) (*imagedto.JobReport, error) {
+	status, err := GetJob(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &imagedto.JobReport{
+		JobID:        status.ID,
+		ShopID:       status.ShopID,
+		State:        status.State,
+		FinishedAt:   status.FinishedAt,
+		ProducedKeys: status.ProducedKeys,
+		Errors:       status.Errors,
+	}, nil
+}
+
+// recordCallbackAttempt appends the delivery attempt to the status of the job.
+func recordCallbackAttempt(id string, attempt *imagedto.CallbackAttempt) {
+	jobs.mu.Lock()
+	defer jobs.mu.Unlock()
+
+	if status, ok := jobs.jobs[id]; ok {
+		status.CallbackAttempts = append(status.CallbackAttempts, attempt)
+	}
+}
+
+// claimKey maps the idempotency key of data, if any, to its job for the configured window unless it is mapped already.
+// Returns the ID of the job the key is mapped to and whether it was mapped now, or exceptions.ErrIdempotencyKeyReused
+// if the key is mapped to a job with a different payload. Jobs without a key are always claimed.
+func claimKey(ctx context.Context, data *imagedto.ImageProcessJobData) (string, bool, error) {
+	window := config.GetInstance().ImageConfig.IdempotencyWindow
+	if data.IdempotencyKey == "" || window <= 0 {
+		return data.ID, true, nil
+	}
+
+	key := &idempotencyKey{JobID: data.ID, Payload: payloadHash(data)}
+
+	value, err := json.Marshal(key)
+	if err != nil {
+		return "", false, err
+	}
+
+	stored, claimed, err := stateservice.GetInstance().SetNX(
+		ctx,
+		idempotencyKeyPrefix+scopedKey(data),
+		string(value),
+		window,
+	)
+	if err != nil || claimed {
+		return data.ID, claimed, err
+	}
+
+	mapped := &idempotencyKey{}
+	if err = json.Unmarshal([]byte(stored), mapped); err != nil {
+		return "", false, fmt.Errorf("invalid idempotency key %s: %w", scopedKey(data), err)
+	}
+
+	if mapped.Payload != key.Payload {
+		return "", false, fmt.Errorf(
+			"%w: %s was used for job %s with a different payload",
+			exceptions.ErrIdempotencyKeyReused,
+			data.IdempotencyKey,
+			mapped.JobID,
+		)
+	}
+
+	return mapped.JobID, false, nil
+}
+
+// payloadHash returns the hash of the job, regardless of its ID and idempotency key.
+func payloadHash(data *imagedto.ImageProcessJobData) string {
+	payload := *data
+	payload.ID, payload.IdempotencyKey = "", ""
+
+	b, err := json.Marshal(&payload)
+	if err != nil {
+		return ""
+	}
+
+	sum := sha256.Sum256(b)
+
+	return hex.EncodeToString(sum[:])
+}
+
+// shareState records the state of the job in the state store, so that every instance can cancel it. The state is kept
+// as long as the status of the job.
+func shareState(ctx context.Context, id string, state imagedto.JobState) {
+	retention, maxAge := statusTTLs()
+
+	ttl := maxAge
+	if state.Finished() {
+		ttl = retention
+	}
+
+	if err := stateservice.GetInstance().Set(ctx, jobStatePrefix+id, string(state), ttl); err != nil {
+		logger.Error(ctx, err, "could not share job state", id, state)
+	}
+}
+
+// sharedState returns the state of the job in the state store, empty if no instance knows it.
+func sharedState(ctx context.Context, id string) (imagedto.JobState, error) {
+	state, _, err := stateservice.GetInstance().Get(ctx, jobStatePrefix+id)
+	if err != nil {
+		return "", fmt.Errorf("could not get state of job %s: %w", id, err)
+	}
+
+	return imagedto.JobState(state), nil
+}
+
+// requestCancel records the cancellation of the job, see cancelReported and cancelRequested.
+func requestCancel(ctx context.Context, id, how string) error {
+	_, maxAge := statusTTLs()
+
+	if err := stateservice.GetInstance().Set(ctx, cancelPrefix+id, how, maxAge); err != nil {
+		return fmt.Errorf("could not cancel job %s: %w", id, err)
+	}
+
+	return nil
+}
+
+// cancellation returns how the job was cancelled, empty if it was not or the cancellations cannot be checked.
+func cancellation(ctx context.Context, id string) string {
+	how, _, err := stateservice.GetInstance().Get(ctx, cancelPrefix+id)
+	if err != nil {
+		logger.Error(ctx, err, "could not check whether job was cancelled", id)
+	}
+
+	return how
+}
+
+// scopedKey scopes the idempotency key to the shop, so that clients cannot collide with each other.
+func scopedKey(data *imagedto.ImageProcessJobData) string {
+	return strconv.Itoa(data.ShopID) + ":" + data.IdempotencyKey
+}
+
+// prune removes the finished jobs older than the configured retention and the unfinished jobs older than the
+// configured maximum age, unless they are running here. The latter were usually consumed by another instance, so they
+// never finish here. The caller must hold the lock.
+func (r *jobRegistry) prune(now time.Time) {
+	retention, maxAge := statusTTLs()
+
+	for id, status := range r.jobs {
+		if status.FinishedAt != nil {
+			if now.Sub(*status.FinishedAt) > retention {
+				delete(r.jobs, id)
+			}
+
+			continue
+		}
+
+		if _, running := r.cancels[id]; !running && now.Sub(status.CreatedAt) > maxAge {
+			delete(r.jobs, id)
+		}
+	}
+}
+
+// statusTTLs returns how long the statuses of finished and unfinished jobs are kept.
+func statusTTLs() (retention, maxAge time.Duration) {
+	cfg := config.GetInstance().ImageConfig
+
+	retention = defaultJobStatusRetention
+	if cfg.JobStatusRetention > 0 {
+		retention = cfg.JobStatusRetention
+	}
+
+	maxAge = defaultJobStatusMaxAge
+	if cfg.JobStatusMaxAge > 0 {
+		maxAge = cfg.JobStatusMaxAge
+	}
+
+	return retention, maxAge
+}
+
+func newStatus(data *imagedto.ImageProcessJobData, priority imagedto.PriorityType) *imagedto.JobStatus {
+	return &imagedto.JobStatus{
+		ID:           data.ID,
+		ShopID:       data.ShopID,
+		Priority:     priority,
+		State:        imagedto.JobStateQueued,
+		Images:       len(data.Images),
+		CreatedAt:    time.Now().UTC(),
+		ProducedKeys: make([]string, 0),
+		Errors:       make([]*imagedto.ProcessImageError, 0),
+		CallbackURL:  data.CallbackURL,
+	}
+}
+
+func copyStatus(status *imagedto.JobStatus) *imagedto.JobStatus {
+	c := *status
+	c.ProducedKeys = append(make([]string, 0, len(status.ProducedKeys)), status.ProducedKeys...)
+	c.Errors = append(make([]*imagedto.ProcessImageError, 0, len(status.Errors)), status.Errors...)
+
+	if len(status.CallbackAttempts) > 0 {
+		c.CallbackAttempts = append([]*imagedto.CallbackAttempt(nil), status.CallbackAttempts...)
+	}
+
+	return &c
+}
+
+func newJobID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+
+	return hex.EncodeToString(b)
+}
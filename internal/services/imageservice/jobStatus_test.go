@@ -0,0 +1,140 @@
+// nolint:testpackage // access to internal functions needed
+package imageservice
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mikarios/imageresizer/internal/constants"
+	"github.com/mikarios/imageresizer/internal/exceptions"
+	"github.com/mikarios/imageresizer/internal/services/config"
+	"github.com/mikarios/imageresizer/internal/services/stateservice"
+	"github.com/mikarios/imageresizer/pkg/dtos/imagedto"
+)
+
+func TestMain(m *testing.M) {
+	_ = os.Setenv("DEV", "true")
+	config.Init("", constants.ServerTypes.ImageResizer)
+
+	os.Exit(m.Run())
+}
+
+func TestPrune(t *testing.T) {
+	registry := &jobRegistry{cancels: make(map[string]context.CancelFunc)}
+
+	now := time.Now()
+	finishedLongAgo, finishedRecently := now.Add(-defaultJobStatusRetention-time.Minute), now.Add(-time.Minute)
+	createdLongAgo := now.Add(-defaultJobStatusMaxAge - time.Minute)
+
+	registry.jobs = map[string]*imagedto.JobStatus{
+		"expired":  {ID: "expired", CreatedAt: createdLongAgo, FinishedAt: &finishedLongAgo},
+		"finished": {ID: "finished", CreatedAt: createdLongAgo, FinishedAt: &finishedRecently},
+		"stale":    {ID: "stale", CreatedAt: createdLongAgo, State: imagedto.JobStateQueued},
+		"running":  {ID: "running", CreatedAt: createdLongAgo, State: imagedto.JobStateRunning},
+		"queued":   {ID: "queued", CreatedAt: now, State: imagedto.JobStateQueued},
+	}
+	registry.cancels["running"] = func() {}
+
+	registry.prune(now)
+
+	kept := map[string]bool{"expired": false, "finished": true, "stale": false, "running": true, "queued": true}
+
+	for id, want := range kept {
+		if _, got := registry.jobs[id]; got != want {
+			t.Errorf("after prune %s kept = %v, want %v", id, got, want)
+		}
+	}
+}
+
+func TestCancelJob(t *testing.T) {
+	ctx := context.Background()
+
+	register := func(t *testing.T) *imagedto.ImageProcessJob {
+		t.Helper()
+
+		job := &imagedto.ImageProcessJob{Data: &imagedto.ImageProcessJobData{ShopID: 1}}
+		if _, _, err := RegisterJob(ctx, job.Data, imagedto.PriorityNormal); err != nil {
+			t.Fatal(err)
+		}
+
+		return job
+	}
+
+	t.Run("queued", func(t *testing.T) {
+		job := register(t)
+
+		status, err := CancelJob(ctx, job.Data.ID)
+		if err != nil || status.State != imagedto.JobStateCancelled {
+			t.Fatalf("CancelJob() = %+v, %v, want cancelled", status, err)
+		}
+
+		if jobStarted(ctx, job, func() {}) {
+			t.Error("cancelled job started, want it dropped")
+		}
+	})
+
+	t.Run("running", func(t *testing.T) {
+		job := register(t)
+		cancelled := false
+
+		if !jobStarted(ctx, job, func() { cancelled = true }) {
+			t.Fatal("job did not start")
+		}
+
+		status, err := CancelJob(ctx, job.Data.ID)
+		if err != nil || status.State != imagedto.JobStateRunning || !cancelled {
+			t.Fatalf("CancelJob() = %+v, %v, cancelled %v, want running and cancelled", status, err, cancelled)
+		}
+	})
+
+	t.Run("finished", func(t *testing.T) {
+		job := register(t)
+
+		if !jobStarted(ctx, job, func() {}) {
+			t.Fatal("job did not start")
+		}
+
+		jobFinished(ctx, job.Data.ID, &jobResult{items: 1})
+
+		if _, err := CancelJob(ctx, job.Data.ID); !errors.Is(err, exceptions.ErrInvalidJobState) {
+			t.Errorf("CancelJob() error = %v, want %v", err, exceptions.ErrInvalidJobState)
+		}
+	})
+
+	t.Run("running elsewhere", func(t *testing.T) {
+		id := newJobID()
+
+		// as recorded by the instance running the job
+		if err := stateservice.GetInstance().Set(ctx, jobStatePrefix+id, string(imagedto.JobStateRunning), 0); err != nil {
+			t.Fatal(err)
+		}
+
+		status, err := CancelJob(ctx, id)
+		if err != nil || status.State != imagedto.JobStateCancelRequested {
+			t.Fatalf("CancelJob() = %+v, %v, want cancel requested", status, err)
+		}
+
+		if got := cancellation(ctx, id); got != cancelRequested {
+			t.Errorf("cancellation() = %q, want %q", got, cancelRequested)
+		}
+
+		// a redelivery of the job is cancelled by the instance receiving it
+		job := &imagedto.ImageProcessJob{Data: &imagedto.ImageProcessJobData{ID: id, ShopID: 1}}
+		if jobStarted(ctx, job, func() {}) {
+			t.Fatal("job cancelled elsewhere started, want it dropped")
+		}
+
+		if status, _ := GetJob(id); status.State != imagedto.JobStateCancelled {
+			t.Errorf("state after dropping = %s, want %s", status.State, imagedto.JobStateCancelled)
+		}
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		if _, err := CancelJob(ctx, newJobID()); !errors.Is(err, exceptions.ErrNotFound) {
+			t.Errorf("CancelJob() error = %v, want %v", err, exceptions.ErrNotFound)
+		}
+	})
+}
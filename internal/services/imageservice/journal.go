@@ -0,0 +1,137 @@
+package imageservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mikarios/golib/logger"
+
+	"github.com/mikarios/imageresizer/internal/jobjournal"
+	"github.com/mikarios/imageresizer/internal/queues"
+	"github.com/mikarios/imageresizer/internal/services/config"
+	"github.com/mikarios/imageresizer/pkg/dtos/imagedto"
+)
+
+var errJournalBroker = errors.New("the job journal is only supported with the memory broker")
+
+var (
+	// journal records the jobs accepted through the API, see IMG_JOURNAL_PATH. Nil if disabled.
+	journal *jobjournal.Journal
+	// journalDone stops replaying and compacting the journal.
+	journalDone chan struct{}
+	journalWG   sync.WaitGroup
+)
+
+// openJournal opens the journal, if configured, removes the finished jobs and starts processing the unfinished ones
+// again. Must be called once the workers are listening. Panics with any broker but the memory one, which would
+// redeliver the unfinished jobs as well.
+func openJournal(cfg *config.ImageConfig, broker string) {
+	if cfg.JournalPath == "" {
+		return
+	}
+
+	ctx := context.Background()
+
+	if broker != queues.BrokerMemory {
+		logger.Panic(ctx, fmt.Errorf("%w: %s", errJournalBroker, broker), "could not open job journal")
+	}
+
+	var err error
+	if journal, err = jobjournal.Open(cfg.JournalPath); err != nil {
+		logger.Panic(ctx, err, "could not open job journal")
+	}
+
+	compactJournal(ctx)
+
+	entries, err := journal.Unfinished()
+	if err != nil {
+		logger.Error(ctx, err, "could not read unfinished jobs from journal")
+	}
+
+	journalDone = make(chan struct{})
+
+	journalWG.Add(1)
+
+	go replayJournal(ctx, entries)
+
+	if cfg.JournalCompactInterval > 0 {
+		journalWG.Add(1)
+
+		go func() {
+			defer journalWG.Done()
+
+			ticker := time.NewTicker(cfg.JournalCompactInterval)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-ticker.C:
+					compactJournal(ctx)
+				case <-journalDone:
+					return
+				}
+			}
+		}()
+	}
+}
+
+// replayJournal queues the jobs that had not finished when the instance stopped. Stops early if the service is
+// destroyed, the jobs left stay in the journal.
+func replayJournal(ctx context.Context, entries []*jobjournal.Entry) {
+	defer journalWG.Done()
+
+	if len(entries) > 0 {
+		logger.Info(ctx, fmt.Sprintf("replaying %d unfinished jobs from journal", len(entries)))
+	}
+
+	for _, e := range entries {
+		jobs.mu.Lock()
+		if _, ok := jobs.jobs[e.Job.ID]; !ok {
+			jobs.jobs[e.Job.ID] = newStatus(e.Job, e.Priority)
+		}
+		jobs.mu.Unlock()
+
+		select {
+		case jobChan <- &imagedto.ImageProcessJob{Data: e.Job}:
+		case <-journalDone:
+			return
+		}
+	}
+}
+
+func compactJournal(ctx context.Context) {
+	deleted, err := journal.Compact(time.Now())
+	if err != nil {
+		logger.Error(ctx, err, "could not compact job journal")
+		return
+	}
+
+	logger.Debug(ctx, fmt.Sprintf("removed %d finished jobs from journal", deleted))
+}
+
+// stopJournal stops replaying and compacting. The journal stays open for the jobs still being processed.
+func stopJournal() {
+	if journalDone == nil {
+		return
+	}
+
+	close(journalDone)
+	journalWG.Wait()
+}
+
+func closeJournal() {
+	if err := journal.Close(); err != nil {
+		logger.Error(context.Background(), err, "could not close job journal")
+	}
+}
+
+// journalError logs the failure to update the journal. The job is processed regardless, it is just not recovered if
+// the instance stops before it finishes.
+func journalError(err error, id string) {
+	if err != nil {
+		logger.Error(context.Background(), err, "could not update job journal", id)
+	}
+}
@@ -0,0 +1,231 @@
+package imageservice
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mikarios/golib/logger"
+
+	"github.com/mikarios/imageresizer/internal/exceptions"
+	"github.com/mikarios/imageresizer/internal/services/config"
+	"github.com/mikarios/imageresizer/internal/services/stateservice"
+	"github.com/mikarios/imageresizer/pkg/dtos/imagedto"
+)
+
+const (
+	// quotaPrefix prefixes the daily usage of the shops in the state store, reservationPrefix the images reserved by
+	// every job.
+	quotaPrefix       = "quota:"
+	reservationPrefix = "quota:job:"
+	// quotaTTL is how long the usage of a day and the reservations are kept, longer than a day so that the jobs
+	// accepted before midnight are released from the right day.
+	quotaTTL = 48 * time.Hour
+)
+
+// CheckQuota returns exceptions.ErrQuotaExceeded if processing the given number of images would exceed the daily
+// quotas of the shop (UTC), see IMG_SHOP_DAILY_IMAGES and IMG_SHOP_DAILY_BYTES. Nothing is reserved, see ReserveQuota.
+func CheckQuota(ctx context.Context, shopID, images int) error {
+	if !quotasEnabled() {
+		return nil
+	}
+
+	day := quotaDay(time.Now())
+
+	usedImages, err := usage(ctx, imagesKey(day, shopID))
+	if err != nil {
+		return err
+	}
+
+	return checkQuota(ctx, day, shopID, images, usedImages)
+}
+
+// ReserveQuota reserves the images of the job against today's quotas of its shop, so that the jobs accepted by every
+// instance count, or returns exceptions.ErrQuotaExceeded. The reservation is released if the job fails or is
+// cancelled.
+func ReserveQuota(ctx context.Context, data *imagedto.ImageProcessJobData) error {
+	if !quotasEnabled() {
+		return nil
+	}
+
+	day := quotaDay(time.Now())
+	images := int64(len(data.Images))
+
+	usedImages, err := addImages(ctx, day, data.ShopID, images)
+	if err != nil {
+		return fmt.Errorf("could not reserve quota: %w", err)
+	}
+
+	if err = checkQuota(ctx, day, data.ShopID, len(data.Images), usedImages-images); err == nil {
+		if _, err = reserve(ctx, data, day); err != nil {
+			err = fmt.Errorf("could not reserve quota: %w", err)
+		}
+	}
+
+	if err != nil {
+		if _, undoErr := addImages(ctx, day, data.ShopID, -images); undoErr != nil {
+			logger.Error(ctx, undoErr, "could not undo quota reservation", data.ShopID, data.ID)
+		}
+	}
+
+	return err
+}
+
+// ReleaseQuota releases the images reserved by the job, if they were not released already.
+func ReleaseQuota(ctx context.Context, id string) {
+	reservation, ok, err := stateservice.GetInstance().Take(ctx, reservationPrefix+id)
+	if err != nil {
+		logger.Error(ctx, err, "could not release quota", id)
+		return
+	}
+
+	if !ok {
+		return
+	}
+
+	day, shopID, images, err := parseReservation(reservation)
+	if err != nil {
+		logger.Error(ctx, err, "invalid quota reservation", id, reservation)
+		return
+	}
+
+	if _, err = addImages(ctx, day, shopID, -images); err != nil {
+		logger.Error(ctx, err, "could not release quota", id)
+	}
+}
+
+// reserveStarted reserves the images of a job that is not reserved, e.g. a retry of a released job or a job published
+// to the queue by another service. It is not checked against the quotas, since the job is processed anyway.
+func reserveStarted(ctx context.Context, data *imagedto.ImageProcessJobData) {
+	if !quotasEnabled() {
+		return
+	}
+
+	day := quotaDay(time.Now())
+
+	reserved, err := reserve(ctx, data, day)
+	if err != nil {
+		logger.Error(ctx, err, "could not reserve quota", data.ShopID, data.ID)
+		return
+	}
+
+	if !reserved {
+		return
+	}
+
+	if _, err = addImages(ctx, day, data.ShopID, int64(len(data.Images))); err != nil {
+		logger.Error(ctx, err, "could not reserve quota", data.ShopID, data.ID)
+	}
+}
+
+// recordBytes adds the bytes stored by a job of the shop to today's usage.
+func recordBytes(ctx context.Context, shopID int, bytes int64) {
+	if !quotasEnabled() || bytes == 0 {
+		return
+	}
+
+	_, err := stateservice.GetInstance().IncrBy(ctx, bytesKey(quotaDay(time.Now()), shopID), bytes, quotaTTL)
+	if err != nil {
+		logger.Error(ctx, err, "could not record stored bytes", shopID, bytes)
+	}
+}
+
+// checkQuota returns exceptions.ErrQuotaExceeded if the images would exceed the images the shop has left, or if the
+// shop stored as many bytes as allowed already.
+func checkQuota(ctx context.Context, day string, shopID, images int, usedImages int64) error {
+	cfg := config.GetInstance().ImageConfig
+
+	if cfg.ShopDailyImages > 0 && usedImages+int64(images) > int64(cfg.ShopDailyImages) {
+		return fmt.Errorf(
+			"%w: shop %d processed %d of %d images today, %d requested",
+			exceptions.ErrQuotaExceeded,
+			shopID,
+			usedImages,
+			cfg.ShopDailyImages,
+			images,
+		)
+	}
+
+	if cfg.ShopDailyBytes <= 0 {
+		return nil
+	}
+
+	usedBytes, err := usage(ctx, bytesKey(day, shopID))
+	if err != nil {
+		return err
+	}
+
+	if usedBytes >= cfg.ShopDailyBytes {
+		return fmt.Errorf(
+			"%w: shop %d stored %d of %d bytes today",
+			exceptions.ErrQuotaExceeded,
+			shopID,
+			usedBytes,
+			cfg.ShopDailyBytes,
+		)
+	}
+
+	return nil
+}
+
+// addImages adds n images to the usage of the shop on the given day and returns the result.
+func addImages(ctx context.Context, day string, shopID int, n int64) (int64, error) {
+	return stateservice.GetInstance().IncrBy(ctx, imagesKey(day, shopID), n, quotaTTL)
+}
+
+// reserve records the reservation of the job, so that it can be released, unless it has one. Returns whether it was
+// recorded now.
+func reserve(ctx context.Context, data *imagedto.ImageProcessJobData, day string) (bool, error) {
+	reservation := fmt.Sprintf("%s %d %d", day, data.ShopID, len(data.Images))
+
+	_, reserved, err := stateservice.GetInstance().SetNX(ctx, reservationPrefix+data.ID, reservation, quotaTTL)
+
+	return reserved, err
+}
+
+func parseReservation(reservation string) (day string, shopID int, images int64, err error) {
+	fields := strings.Fields(reservation)
+	if len(fields) != 3 {
+		return "", 0, 0, fmt.Errorf("%d fields", len(fields))
+	}
+
+	if shopID, err = strconv.Atoi(fields[1]); err != nil {
+		return "", 0, 0, err
+	}
+
+	if images, err = strconv.ParseInt(fields[2], 10, 64); err != nil {
+		return "", 0, 0, err
+	}
+
+	return fields[0], shopID, images, nil
+}
+
+// usage returns the counter at key, zero if it does not exist.
+func usage(ctx context.Context, key string) (int64, error) {
+	value, ok, err := stateservice.GetInstance().Get(ctx, key)
+	if err != nil || !ok {
+		return 0, err
+	}
+
+	return strconv.ParseInt(value, 10, 64)
+}
+
+func quotasEnabled() bool {
+	cfg := config.GetInstance().ImageConfig
+
+	return cfg.ShopDailyImages > 0 || cfg.ShopDailyBytes > 0
+}
+
+func quotaDay(now time.Time) string {
+	return now.UTC().Format("2006-01-02")
+}
+
+func imagesKey(day string, shopID int) string {
+	return quotaPrefix + day + ":" + strconv.Itoa(shopID) + ":images"
+}
+
+func bytesKey(day string, shopID int) string {
+	return quotaPrefix + day + ":" + strconv.Itoa(shopID) + ":bytes"
+}
@@ -0,0 +1,106 @@
+// nolint:testpackage // access to internal functions needed
+package imageservice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/lambda"
+
+	"github.com/mikarios/imageresizer/internal/exceptions"
+	"github.com/mikarios/imageresizer/internal/imagehelper"
+	"github.com/mikarios/imageresizer/internal/services/config"
+	"github.com/mikarios/imageresizer/pkg/dtos/imagedto"
+)
+
+func TestCheckQuota(t *testing.T) {
+	ctx := context.Background()
+
+	cfg := &config.GetInstance().ImageConfig
+	cfg.ShopDailyImages, cfg.ShopDailyBytes = 3, 100
+
+	defer func() { cfg.ShopDailyImages, cfg.ShopDailyBytes = 0, 0 }()
+
+	const shopID = 42
+
+	newJob := func(images int) *imagedto.ImageProcessJobData {
+		return &imagedto.ImageProcessJobData{
+			ID:     newJobID(),
+			ShopID: shopID,
+			Images: make([]*imagedto.ImageStruct, images),
+		}
+	}
+
+	checkQuota := func(images int, want error) {
+		t.Helper()
+
+		if err := CheckQuota(ctx, shopID, images); !errors.Is(err, want) {
+			t.Errorf("CheckQuota(%d) = %v, want %v", images, err, want)
+		}
+	}
+
+	first := newJob(2)
+	if err := ReserveQuota(ctx, first); err != nil {
+		t.Fatalf("ReserveQuota() = %v, want nil", err)
+	}
+
+	// the reserved images count before the job is processed
+	checkQuota(1, nil)
+	checkQuota(2, exceptions.ErrQuotaExceeded)
+
+	if err := ReserveQuota(ctx, newJob(2)); !errors.Is(err, exceptions.ErrQuotaExceeded) {
+		t.Fatalf("ReserveQuota() over the quota = %v, want %v", err, exceptions.ErrQuotaExceeded)
+	}
+
+	// the rejected job reserved nothing
+	checkQuota(1, nil)
+
+	// released once only, e.g. if the job failed and was cancelled
+	ReleaseQuota(ctx, first.ID)
+	ReleaseQuota(ctx, first.ID)
+
+	checkQuota(3, nil)
+	checkQuota(4, exceptions.ErrQuotaExceeded)
+
+	recordBytes(ctx, shopID, 100)
+
+	checkQuota(1, exceptions.ErrQuotaExceeded)
+}
+
+// the bytes the lambda stored are recorded like the ones stored by the server
+func TestLambdaResult(t *testing.T) {
+	t.Parallel()
+
+	stored := &imagehelper.ImageJob{StoredKeys: []string{"images/1/a.jpg"}, StoredBytes: 42}
+	failure := &imagedto.ProcessImageError{URL: "b.jpg", Err: "could not scale image"}
+
+	payload, err := json.Marshal(imagehelper.NewProcessResult(stored, []error{failure, errors.New("other")}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job := &imagehelper.ImageJob{}
+
+	errs, err := lambdaResult(job, &lambda.InvokeOutput{Payload: payload})
+	if err != nil {
+		t.Fatalf("lambdaResult() error = %v", err)
+	}
+
+	if !reflect.DeepEqual(job.StoredKeys, stored.StoredKeys) || job.StoredBytes != stored.StoredBytes {
+		t.Errorf("stored %v, %d bytes, want %v, %d bytes", job.StoredKeys, job.StoredBytes, stored.StoredKeys, 42)
+	}
+
+	want := []error{failure, &imagedto.ProcessImageError{Err: "other"}}
+	if !reflect.DeepEqual(errs, want) {
+		t.Errorf("lambdaResult() = %v, want %v", errs, want)
+	}
+
+	_, err = lambdaResult(&imagehelper.ImageJob{}, &lambda.InvokeOutput{FunctionError: aws.String("Unhandled")})
+	if !errors.Is(err, errLambdaFunction) {
+		t.Errorf("lambdaResult() error = %v, want %v", err, errLambdaFunction)
+	}
+}
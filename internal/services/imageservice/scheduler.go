@@ -0,0 +1,148 @@
+package imageservice
+
+import "sync"
+
+// scheduler hands the images of the jobs in flight to the workers. Shops take turns in proportion to their weight and
+// the jobs of each shop take turns as well, so that a big job does not hold back the ones received after it. Shops
+// using maxPerShop workers are skipped until one of their images finishes.
+type scheduler struct {
+	mu    sync.Mutex
+	ready *sync.Cond
+	// shops holds the shops with pending images
+	shops      map[int]*shopQueue
+	running    map[int]int
+	weights    map[int]int
+	maxPerShop int
+	// vtime is the virtual time of the last image handed out. Every image handed out advances the virtual time of its
+	// shop by the inverse of the shop's weight and the shop furthest behind goes next.
+	vtime  float64
+	seq    uint64
+	closed bool
+}
+
+// shopQueue holds the pending images of a shop per job, in turn order.
+type shopQueue struct {
+	shopID int
+	jobs   [][]*imageJob
+	vtime  float64
+	// seq breaks ties between shops in the order they got pending images
+	seq uint64
+}
+
+// newScheduler creates a scheduler with the given weights per shop ID, shops without one have a weight of 1. A
+// maxPerShop of zero does not limit the workers of a shop.
+func newScheduler(weights map[int]int, maxPerShop int) *scheduler {
+	s := &scheduler{
+		shops:      make(map[int]*shopQueue),
+		running:    make(map[int]int),
+		weights:    weights,
+		maxPerShop: maxPerShop,
+	}
+	s.ready = sync.NewCond(&s.mu)
+
+	return s
+}
+
+// add queues the images of a job of the given shop.
+func (s *scheduler) add(shopID int, images []*imageJob) {
+	if len(images) == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	shop, ok := s.shops[shopID]
+	if !ok {
+		// shops start at the current virtual time, so that they cannot claim the turns they missed while idle
+		s.seq++
+		shop = &shopQueue{shopID: shopID, vtime: s.vtime, seq: s.seq}
+		s.shops[shopID] = shop
+	}
+
+	shop.jobs = append(shop.jobs, images)
+	s.ready.Broadcast()
+}
+
+// next returns the image of the next job of the next shop, waiting until there is one. The worker must call done once
+// the image is processed. Returns false once the scheduler is closed and every image has been handed out.
+func (s *scheduler) next() (*imageJob, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		if shop := s.pick(); shop != nil {
+			return s.take(shop), true
+		}
+
+		if s.closed && len(s.shops) == 0 {
+			return nil, false
+		}
+
+		s.ready.Wait()
+	}
+}
+
+// done releases the worker of an image of the given shop.
+func (s *scheduler) done(shopID int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.running[shopID]--; s.running[shopID] <= 0 {
+		delete(s.running, shopID)
+	}
+
+	s.ready.Broadcast()
+}
+
+// close releases the workers waiting for images once the pending ones are handed out.
+func (s *scheduler) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	s.ready.Broadcast()
+}
+
+// pick returns the shop furthest behind among the ones below the worker limit, nil if there is none. The caller must
+// hold the lock.
+func (s *scheduler) pick() *shopQueue {
+	var next *shopQueue
+
+	for id, shop := range s.shops {
+		if s.maxPerShop > 0 && s.running[id] >= s.maxPerShop {
+			continue
+		}
+
+		if next == nil || shop.vtime < next.vtime || (shop.vtime == next.vtime && shop.seq < next.seq) {
+			next = shop
+		}
+	}
+
+	return next
+}
+
+// take hands out the image of the next job of the shop. The caller must hold the lock.
+func (s *scheduler) take(shop *shopQueue) *imageJob {
+	images := shop.jobs[0]
+	shop.jobs = shop.jobs[1:]
+
+	if len(images) > 1 {
+		shop.jobs = append(shop.jobs, images[1:])
+	}
+
+	weight := s.weights[shop.shopID]
+	if weight <= 0 {
+		weight = 1
+	}
+
+	s.vtime = shop.vtime
+	shop.vtime += 1 / float64(weight)
+	s.running[shop.shopID]++
+
+	if len(shop.jobs) == 0 {
+		delete(s.shops, shop.shopID)
+	}
+
+	return images[0]
+}
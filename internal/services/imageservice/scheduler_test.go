@@ -0,0 +1,84 @@
+// nolint:testpackage // access to internal functions needed
+package imageservice
+
+import (
+	"testing"
+
+	"github.com/mikarios/imageresizer/internal/imagehelper"
+	"github.com/mikarios/imageresizer/pkg/dtos/imagedto"
+)
+
+func TestSchedulerTakesTurns(t *testing.T) {
+	t.Parallel()
+
+	s := newScheduler(nil, 0)
+
+	// shop 1 queues a big job and then a small one, shop 2 queues a small job afterwards
+	s.add(1, newImages(1, "big", 4))
+	s.add(1, newImages(1, "small", 1))
+	s.add(2, newImages(2, "other", 2))
+	s.close()
+
+	want := []string{"big0", "other0", "small0", "other1", "big1", "big2", "big3"}
+
+	for i, name := range want {
+		img, ok := s.next()
+		if !ok {
+			t.Fatalf("next() %d = closed, want %s", i, name)
+		}
+
+		if img.Name != name {
+			t.Errorf("next() %d = %s, want %s", i, img.Name, name)
+		}
+	}
+
+	if _, ok := s.next(); ok {
+		t.Error("next() after the last image = ok, want closed")
+	}
+}
+
+func TestSchedulerWeightsAndLimits(t *testing.T) {
+	t.Parallel()
+
+	s := newScheduler(map[int]int{1: 2}, 2)
+
+	s.add(1, newImages(1, "heavy", 4))
+	s.add(2, newImages(2, "light", 4))
+	s.add(3, newImages(3, "other", 1))
+	s.close()
+
+	// shop 1 has twice the weight of the others, so it goes again before shop 2 does
+	want := []string{"heavy0", "light0", "other0", "heavy1", "light1"}
+
+	for i, name := range want {
+		if img, _ := s.next(); img.Name != name {
+			t.Fatalf("next() %d = %s, want %s", i, img.Name, name)
+		}
+	}
+
+	// shop 2 is at the limit as well, so the next image waits for one of them to finish
+	taken := make(chan *imageJob)
+
+	go func() {
+		img, _ := s.next()
+		taken <- img
+	}()
+
+	s.done(1)
+
+	if img := <-taken; img.Name != "heavy2" {
+		t.Errorf("next() after done = %s, want heavy2", img.Name)
+	}
+}
+
+func newImages(shopID int, name string, n int) []*imageJob {
+	images := make([]*imageJob, n)
+	data := &imagedto.ImageProcessJobData{ShopID: shopID}
+
+	for i := range images {
+		img := &imagedto.ImageStruct{Name: name + string(rune('0'+i))}
+		images[i] = &imageJob{ImageJob: &imagehelper.ImageJob{ImageStruct: img}, data: data}
+	}
+
+	return images
+}
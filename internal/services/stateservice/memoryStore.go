@@ -0,0 +1,151 @@
+package stateservice
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// memoryPruneInterval is how often the expired values are removed.
+const memoryPruneInterval = time.Minute
+
+// MemoryStore keeps the values in process.
+type MemoryStore struct {
+	mu        sync.Mutex
+	values    map[string]*memoryValue
+	lastPrune time.Time
+}
+
+type memoryValue struct {
+	value   string
+	expires time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{values: make(map[string]*memoryValue), lastPrune: time.Now()}
+}
+
+func (s *MemoryStore) Get(_ context.Context, key string) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if v, ok := s.get(key, time.Now()); ok {
+		return v.value, true, nil
+	}
+
+	return "", false, nil
+}
+
+func (s *MemoryStore) Set(_ context.Context, key, value string, ttl time.Duration) error {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.prune(now)
+	s.set(key, value, ttl, now)
+
+	return nil
+}
+
+func (s *MemoryStore) SetNX(_ context.Context, key, value string, ttl time.Duration) (string, bool, error) {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.prune(now)
+
+	if v, ok := s.get(key, now); ok {
+		return v.value, false, nil
+	}
+
+	s.set(key, value, ttl, now)
+
+	return value, true, nil
+}
+
+func (s *MemoryStore) Take(_ context.Context, key string) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, ok := s.get(key, time.Now())
+	if !ok {
+		return "", false, nil
+	}
+
+	delete(s.values, key)
+
+	return v.value, true, nil
+}
+
+func (s *MemoryStore) IncrBy(_ context.Context, key string, n int64, ttl time.Duration) (int64, error) {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.prune(now)
+
+	var current int64
+
+	if v, ok := s.get(key, now); ok {
+		var err error
+		if current, err = strconv.ParseInt(v.value, 10, 64); err != nil {
+			return 0, err
+		}
+	}
+
+	current += n
+	s.set(key, strconv.FormatInt(current, 10), ttl, now)
+
+	return current, nil
+}
+
+func (s *MemoryStore) Delete(_ context.Context, key string) error {
+	s.mu.Lock()
+	delete(s.values, key)
+	s.mu.Unlock()
+
+	return nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// get returns the value at key unless it expired. The caller must hold the lock.
+func (s *MemoryStore) get(key string, now time.Time) (*memoryValue, bool) {
+	v, ok := s.values[key]
+	if !ok || (!v.expires.IsZero() && now.After(v.expires)) {
+		return nil, false
+	}
+
+	return v, true
+}
+
+// set stores value at key. The caller must hold the lock.
+func (s *MemoryStore) set(key, value string, ttl time.Duration, now time.Time) {
+	v := &memoryValue{value: value}
+	if ttl > 0 {
+		v.expires = now.Add(ttl)
+	}
+
+	s.values[key] = v
+}
+
+// prune removes the expired values, at most every memoryPruneInterval. The caller must hold the lock.
+func (s *MemoryStore) prune(now time.Time) {
+	if now.Sub(s.lastPrune) < memoryPruneInterval {
+		return
+	}
+
+	s.lastPrune = now
+
+	for key := range s.values {
+		if _, ok := s.get(key, now); !ok {
+			delete(s.values, key)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package stateservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/mikarios/imageresizer/internal/services/config"
+)
+
+var errStateStore = errors.New("got error from state store")
+
+// RedisStore keeps the values in Redis, every key prefixed with STATE_PREFIX.
+type RedisStore struct {
+	client *redis.Client
+	prefix string
+}
+
+func NewRedisStore(cfg *config.StateConfig) (*RedisStore, error) {
+	opts, err := redis.ParseURL(cfg.RedisURL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid url: %s", errStateStore, err.Error())
+	}
+
+	prefix := cfg.Prefix
+	if prefix == "" {
+		prefix = defaultPrefix
+	}
+
+	s := &RedisStore{client: redis.NewClient(opts), prefix: prefix}
+
+	if err = s.client.Ping(context.Background()).Err(); err != nil {
+		_ = s.client.Close()
+
+		return nil, fmt.Errorf("%w: %s", errStateStore, err.Error())
+	}
+
+	return s, nil
+}
+
+func (s *RedisStore) Get(ctx context.Context, key string) (string, bool, error) {
+	value, err := s.client.Get(ctx, s.prefix+key).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", false, nil
+	}
+
+	return value, err == nil, err
+}
+
+func (s *RedisStore) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	return s.client.Set(ctx, s.prefix+key, value, ttl).Err()
+}
+
+func (s *RedisStore) SetNX(ctx context.Context, key, value string, ttl time.Duration) (string, bool, error) {
+	for {
+		stored, err := s.client.SetNX(ctx, s.prefix+key, value, ttl).Result()
+		if err != nil || stored {
+			return value, stored, err
+		}
+
+		current, err := s.client.Get(ctx, s.prefix+key).Result()
+		// expired in the meantime, so it can be stored now
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+
+		return current, false, err
+	}
+}
+
+func (s *RedisStore) Take(ctx context.Context, key string) (string, bool, error) {
+	value, err := s.client.GetDel(ctx, s.prefix+key).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", false, nil
+	}
+
+	return value, err == nil, err
+}
+
+func (s *RedisStore) IncrBy(ctx context.Context, key string, n int64, ttl time.Duration) (int64, error) {
+	var incr *redis.IntCmd
+
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		incr = pipe.IncrBy(ctx, s.prefix+key, n)
+
+		if ttl > 0 {
+			pipe.PExpire(ctx, s.prefix+key, ttl)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return incr.Val(), nil
+}
+
+func (s *RedisStore) Delete(ctx context.Context, key string) error {
+	return s.client.Del(ctx, s.prefix+key).Err()
+}
+
+func (s *RedisStore) Close() error {
+	return s.client.Close()
+}
@@ -0,0 +1,71 @@
+// Package stateservice keeps the state the instances share, e.g. the idempotency keys and the cancellations of the
+// jobs and the quota usage of the shops. It is kept in Redis if STATE_REDIS_URL is set and in process otherwise, which
+// is only correct with a single instance.
+package stateservice
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/mikarios/golib/logger"
+
+	"github.com/mikarios/imageresizer/internal/services/config"
+)
+
+const defaultPrefix = "imageresizer:"
+
+var (
+	once     sync.Once
+	instance Store
+)
+
+// Store holds string values that expire after their ttl, never if it is zero.
+type Store interface {
+	// Get returns the value at key and whether it exists.
+	Get(ctx context.Context, key string) (string, bool, error)
+	// Set stores value at key.
+	Set(ctx context.Context, key, value string, ttl time.Duration) error
+	// SetNX stores value at key unless the key exists. Returns the value at key and whether it was stored.
+	SetNX(ctx context.Context, key, value string, ttl time.Duration) (string, bool, error)
+	// Take removes the key and returns its value and whether it existed.
+	Take(ctx context.Context, key string) (string, bool, error)
+	// Delete removes the key.
+	Delete(ctx context.Context, key string) error
+	// IncrBy adds n to the integer at key, zero if it does not exist, and returns the result. The ttl is set whenever it
+	// is incremented.
+	IncrBy(ctx context.Context, key string, n int64, ttl time.Duration) (int64, error)
+	Close() error
+}
+
+// GetInstance returns the store, connecting to it on first use.
+func GetInstance() Store {
+	return Init(&config.GetInstance().StateConfig)
+}
+
+// Init connects to the store selected by STATE_REDIS_URL.
+func Init(cfg *config.StateConfig) Store {
+	once.Do(func() {
+		if cfg.RedisURL == "" {
+			instance = NewMemoryStore()
+			return
+		}
+
+		var err error
+		if instance, err = NewRedisStore(cfg); err != nil {
+			logger.Panic(context.Background(), err, "could not connect to state store")
+		}
+	})
+
+	return instance
+}
+
+func Destroy() {
+	if instance == nil {
+		return
+	}
+
+	if err := instance.Close(); err != nil {
+		logger.Error(context.Background(), err, "could not close state store")
+	}
+}
@@ -0,0 +1,121 @@
+package stateservice_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+
+	"github.com/mikarios/imageresizer/internal/services/config"
+	"github.com/mikarios/imageresizer/internal/services/stateservice"
+)
+
+// newStore returns an empty store and a function letting the given time pass for it.
+type newStore func(t *testing.T) (stateservice.Store, func(d time.Duration))
+
+func TestStores(t *testing.T) {
+	t.Parallel()
+
+	stores := map[string]newStore{
+		"memory": func(t *testing.T) (stateservice.Store, func(d time.Duration)) {
+			t.Helper()
+
+			return stateservice.NewMemoryStore(), time.Sleep
+		},
+		"redis": func(t *testing.T) (stateservice.Store, func(d time.Duration)) {
+			t.Helper()
+
+			mr := miniredis.RunT(t)
+
+			s, err := stateservice.NewRedisStore(&config.StateConfig{RedisURL: "redis://" + mr.Addr()})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			t.Cleanup(func() { _ = s.Close() })
+
+			return s, mr.FastForward
+		},
+	}
+
+	for name, store := range stores {
+		store := store
+
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			testStore(t, store)
+		})
+	}
+}
+
+func testStore(t *testing.T, newStore newStore) {
+	t.Helper()
+
+	ctx := context.Background()
+	s, wait := newStore(t)
+	ttl := 50 * time.Millisecond
+
+	if value, stored, err := s.SetNX(ctx, "key", "first", ttl); err != nil || !stored || value != "first" {
+		t.Fatalf("SetNX() = %q, %v, %v, want first stored", value, stored, err)
+	}
+
+	if value, stored, err := s.SetNX(ctx, "key", "second", ttl); err != nil || stored || value != "first" {
+		t.Fatalf("SetNX() of a set key = %q, %v, %v, want first kept", value, stored, err)
+	}
+
+	wait(2 * ttl)
+
+	if value, stored, err := s.SetNX(ctx, "key", "third", 0); err != nil || !stored || value != "third" {
+		t.Fatalf("SetNX() of an expired key = %q, %v, %v, want third stored", value, stored, err)
+	}
+
+	if err := s.Set(ctx, "key", "fourth", ttl); err != nil {
+		t.Fatal(err)
+	}
+
+	if value, ok, err := s.Get(ctx, "key"); err != nil || !ok || value != "fourth" {
+		t.Fatalf("Get() = %q, %v, %v, want fourth", value, ok, err)
+	}
+
+	wait(2 * ttl)
+
+	if _, ok, err := s.Get(ctx, "key"); err != nil || ok {
+		t.Fatalf("Get() of an expired key = %v, %v, want missing", ok, err)
+	}
+
+	if err := s.Set(ctx, "key", "fifth", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Delete(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, stored, err := s.SetNX(ctx, "key", "sixth", 0); err != nil || !stored {
+		t.Fatalf("SetNX() of a deleted key = %v, %v, want stored", stored, err)
+	}
+
+	if value, ok, err := s.Take(ctx, "key"); err != nil || !ok || value != "sixth" {
+		t.Fatalf("Take() = %q, %v, %v, want sixth", value, ok, err)
+	}
+
+	if _, ok, err := s.Take(ctx, "key"); err != nil || ok {
+		t.Fatalf("Take() of a taken key = %v, %v, want missing", ok, err)
+	}
+
+	if got, err := s.IncrBy(ctx, "counter", 3, ttl); err != nil || got != 3 {
+		t.Fatalf("IncrBy(3) = %d, %v, want 3", got, err)
+	}
+
+	if got, err := s.IncrBy(ctx, "counter", -2, ttl); err != nil || got != 1 {
+		t.Fatalf("IncrBy(-2) = %d, %v, want 1", got, err)
+	}
+
+	wait(2 * ttl)
+
+	if got, err := s.IncrBy(ctx, "counter", 1, ttl); err != nil || got != 1 {
+		t.Fatalf("IncrBy() of an expired counter = %d, %v, want 1", got, err)
+	}
+}
@@ -0,0 +1,151 @@
+package sourcefetcher
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mikarios/imageresizer/internal/services/cdnservice"
+	"github.com/mikarios/imageresizer/internal/services/config"
+)
+
+func fetchHTTP(parentContext context.Context, source string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(parentContext, 20*time.Second)
+
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+
+	httpClient := &http.Client{}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return nil, fmt.Errorf("%w: %s responded with %s", ErrFetchingSource, source, resp.Status)
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+// fetchS3 reads s3://bucket/key through the cdn credentials.
+func fetchS3(ctx context.Context, source string) ([]byte, error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return nil, err
+	}
+
+	key := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || key == "" {
+		return nil, fmt.Errorf("%w: expected s3://bucket/key, got %s", ErrUnsupportedSource, source)
+	}
+
+	if !allowedBucketKey(u.Host, key) {
+		return nil, fmt.Errorf("%w: %s is not an allowed source", ErrUnsupportedSource, source)
+	}
+
+	return cdnservice.GetInstance().GetFile(ctx, u.Host, key)
+}
+
+func fetchBucketKey(ctx context.Context, source string) ([]byte, error) {
+	key := strings.TrimPrefix(source, "/")
+	if key == "" {
+		return nil, fmt.Errorf("%w: empty source", ErrUnsupportedSource)
+	}
+
+	if !allowedBucketKey(config.GetInstance().CDN.Bucket, key) {
+		return nil, fmt.Errorf("%w: %s is not an allowed source", ErrUnsupportedSource, source)
+	}
+
+	return cdnservice.GetInstance().GetFile(ctx, "", key)
+}
+
+// allowedBucketKey reports whether key of bucket is below one of the configured source prefixes. Keys that are not
+// clean paths are never allowed, so that dot segments cannot step out of a prefix.
+func allowedBucketKey(bucket, key string) bool {
+	cfg := config.GetInstance()
+
+	source := bucket + "/" + key
+	if bucket == "" || path.Clean(source) != source {
+		return false
+	}
+
+	allowed := cfg.ImageConfig.S3Sources
+	if len(allowed) == 0 {
+		allowed = []string{path.Join(cfg.CDN.Bucket, cfg.CDN.ImagesFolder)}
+	}
+
+	for _, prefix := range allowed {
+		if prefix = strings.Trim(prefix, "/ "); prefix != "" && strings.HasPrefix(source, prefix+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// fetchFile reads file:///absolute/path only if the path is inside the configured directory.
+func fetchFile(_ context.Context, source string) ([]byte, error) {
+	root := config.GetInstance().ImageConfig.FileSourcesDir
+	if root == "" {
+		return nil, fmt.Errorf("%w: file sources are disabled", ErrUnsupportedSource)
+	}
+
+	u, err := url.Parse(source)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err = filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	filePath := filepath.Clean(filepath.FromSlash(u.Path))
+	if !strings.HasPrefix(filePath, root+string(filepath.Separator)) {
+		return nil, fmt.Errorf("%w: %s is outside of %s", ErrUnsupportedSource, u.Path, root)
+	}
+
+	return os.ReadFile(filePath)
+}
+
+// fetchData decodes data:[<media type>][;base64],<data>.
+func fetchData(_ context.Context, source string) ([]byte, error) {
+	comma := strings.IndexByte(source, ',')
+	if comma < 0 {
+		return nil, fmt.Errorf("%w: malformed data uri", ErrUnsupportedSource)
+	}
+
+	meta, data := source[len("data:"):comma], source[comma+1:]
+
+	if strings.HasSuffix(strings.ToLower(meta), ";base64") {
+		decoded, err := io.ReadAll(base64.NewDecoder(base64.StdEncoding, strings.NewReader(data)))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrFetchingSource, err.Error())
+		}
+
+		return decoded, nil
+	}
+
+	unescaped, err := url.PathUnescape(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrFetchingSource, err.Error())
+	}
+
+	return []byte(unescaped), nil
+}
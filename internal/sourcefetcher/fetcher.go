@@ -0,0 +1,79 @@
+// Package sourcefetcher retrieves the original images of the jobs. The fetcher is picked by the scheme of the source:
+//
+//	http://, https://   downloaded
+//	s3://bucket/key     read from the given bucket of the cdn
+//	key                 a source without scheme is a key of the default bucket
+//	file://             read from disk, only below the configured IMG_FILE_SOURCES_DIR
+//	data:               decoded from the URI itself
+//
+// Both bucket sources are only read below the IMG_S3_SOURCES entries, by default the images folder of the cdn bucket.
+// Additional schemes can be added with Register.
+package sourcefetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrUnsupportedSource = errors.New("unsupported image source")
+	ErrFetchingSource    = errors.New("could not fetch image source")
+
+	mu       sync.RWMutex
+	fetchers = map[string]Fetcher{
+		"http":  fetchHTTP,
+		"https": fetchHTTP,
+		"s3":    fetchS3,
+		"":      fetchBucketKey,
+		"file":  fetchFile,
+		"data":  fetchData,
+	}
+)
+
+// Fetcher returns the contents of the given source. The source is passed as is, including its scheme.
+type Fetcher func(ctx context.Context, source string) ([]byte, error)
+
+// Register adds or replaces the fetcher used for the given scheme.
+func Register(scheme string, fetcher Fetcher) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	fetchers[strings.ToLower(scheme)] = fetcher
+}
+
+// Fetch returns the contents of the given source using the fetcher registered for its scheme.
+func Fetch(ctx context.Context, source string) ([]byte, error) {
+	scheme := Scheme(source)
+
+	mu.RLock()
+	fetcher, ok := fetchers[scheme]
+	mu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedSource, scheme)
+	}
+
+	return fetcher(ctx, source)
+}
+
+// Scheme returns the lower case scheme of the source or an empty string if it is a plain key.
+func Scheme(source string) string {
+	idx := strings.IndexByte(source, ':')
+	if idx <= 0 {
+		return ""
+	}
+
+	for i, c := range source[:idx] {
+		isLetter := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+		isOther := (c >= '0' && c <= '9') || c == '+' || c == '-' || c == '.'
+
+		if !isLetter && (i == 0 || !isOther) {
+			return ""
+		}
+	}
+
+	return strings.ToLower(source[:idx])
+}
@@ -0,0 +1,104 @@
+package sourcefetcher_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/mikarios/imageresizer/internal/constants"
+	"github.com/mikarios/imageresizer/internal/services/config"
+	"github.com/mikarios/imageresizer/internal/sourcefetcher"
+)
+
+func TestScheme(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]string{
+		"https://example.com/a.jpg": "https",
+		"S3://bucket/key.jpg":       "s3",
+		"data:image/png;base64,AA":  "data",
+		"file:///tmp/a.jpg":         "file",
+		"static/12/a.jpg":           "",
+		"/static/12/a.jpg":          "",
+		"static/12:3/a.jpg":         "",
+		":a.jpg":                    "",
+	}
+
+	for source, want := range tests {
+		if got := sourcefetcher.Scheme(source); got != want {
+			t.Errorf("Scheme(%q) = %q, want %q", source, got, want)
+		}
+	}
+}
+
+func TestFetch_Data(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]string{
+		"data:image/png;base64,aGVsbG8=": "hello",
+		"data:;BASE64,aGVsbG8=":          "hello",
+		"data:text/plain,hello%20world":  "hello world",
+	}
+
+	for source, want := range tests {
+		got, err := sourcefetcher.Fetch(context.Background(), source)
+		if err != nil {
+			t.Errorf("Fetch(%q) error = %v", source, err)
+			continue
+		}
+
+		if string(got) != want {
+			t.Errorf("Fetch(%q) = %q, want %q", source, got, want)
+		}
+	}
+
+	if _, err := sourcefetcher.Fetch(context.Background(), "data:image/png;base64"); !errors.Is(
+		err,
+		sourcefetcher.ErrUnsupportedSource,
+	) {
+		t.Errorf("Fetch() error = %v, want %v", err, sourcefetcher.ErrUnsupportedSource)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	t.Parallel()
+
+	sourcefetcher.Register("Test", func(_ context.Context, source string) ([]byte, error) {
+		return []byte(source), nil
+	})
+
+	got, err := sourcefetcher.Fetch(context.Background(), "test:abc")
+	if err != nil || string(got) != "test:abc" {
+		t.Errorf("Fetch() = %q, %v", got, err)
+	}
+
+	if _, err = sourcefetcher.Fetch(context.Background(), "ftp://example.com/a.jpg"); !errors.Is(
+		err,
+		sourcefetcher.ErrUnsupportedSource,
+	) {
+		t.Errorf("Fetch() error = %v, want %v", err, sourcefetcher.ErrUnsupportedSource)
+	}
+}
+
+func TestFetch_BucketAllowList(t *testing.T) {
+	t.Setenv("DEV", "true")
+	t.Setenv("CDN_BUCKET", "images")
+	t.Setenv("CDN_IMAGES_FOLDER", "static")
+	config.Init("", constants.ServerTypes.ImageResizer)
+
+	sources := []string{
+		"s3://other/static/a.jpg",
+		"s3://images/private/a.jpg",
+		"s3://images/static/../private/a.jpg",
+		"s3://images/staticfiles/a.jpg",
+		"private/a.jpg",
+		"static/./a.jpg",
+		"static//a.jpg",
+	}
+
+	for _, source := range sources {
+		if _, err := sourcefetcher.Fetch(context.Background(), source); !errors.Is(err, sourcefetcher.ErrUnsupportedSource) {
+			t.Errorf("Fetch(%q) error = %v, want %v", source, err, sourcefetcher.ErrUnsupportedSource)
+		}
+	}
+}
@@ -9,3 +9,24 @@ type UpdateImagesReq struct {
 	Carousel *bool `json:"carousel"`
 	Gallery  *bool `json:"gallery"`
 }
+
+// DeleteImagesReq removes the given files, and everything under the paths ending with a slash. If DryRun is set the
+// keys are only reported.
+type DeleteImagesReq struct {
+	DeleteImages []string `json:"deleteImages"`
+	DryRun       bool     `json:"dryRun"`
+}
+
+type DeleteImagesResp struct {
+	Keys    []string `json:"keys"`
+	DryRun  bool     `json:"dryRun"`
+	Trashed bool     `json:"trashed"`
+}
+
+// UploadImageResp holds the key of the stored original, the keys of the variants scheduled for it and the ID of the job
+// creating them.
+type UploadImageResp struct {
+	JobID    string   `json:"jobID"`
+	Original string   `json:"original"`
+	Variants []string `json:"variants"`
+}
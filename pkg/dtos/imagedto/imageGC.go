@@ -0,0 +1,19 @@
+package imagedto
+
+// ImageGCReq describes the complete set of images a shop should have. Every file under the shop's folder that is not
+// the original or one of the requested variants of these images, or the manifest of their products, is an orphan.
+// If DryRun is set the orphans are only reported.
+type ImageGCReq struct {
+	ShopID       int            `json:"shopID"`
+	Images       []*ImageStruct `json:"images"`
+	PathTemplate string         `json:"pathTemplate,omitempty"`
+	DryRun       bool           `json:"dryRun"`
+}
+
+type ImageGCResp struct {
+	ShopID  int      `json:"shopID"`
+	Listed  int      `json:"listed"`
+	Desired int      `json:"desired"`
+	Orphans []string `json:"orphans"`
+	DryRun  bool     `json:"dryRun"`
+}
@@ -1,41 +1,71 @@
 package imagedto
 
-import (
-	"github.com/streadway/amqp"
-)
+import "time"
 
 const (
-	PriorityUrgent priorityType = "urgent"
-	PriorityNormal priorityType = "normal"
+	PriorityUrgent PriorityType = "urgent"
+	PriorityNormal PriorityType = "normal"
 )
 
-type priorityType string
+type PriorityType string
 
+// ImageScaleJobReq schedules a job. CallbackURL, if set, is used when the job itself does not define one.
 type ImageScaleJobReq struct {
-	Job      *ImageProcessJobData `json:"job"`
-	Priority priorityType         `json:"priority"`
+	Job         *ImageProcessJobData `json:"job"`
+	Priority    PriorityType         `json:"priority"`
+	CallbackURL string               `json:"callbackURL,omitempty"`
 }
 
+// ImageProcessJob is a job to be processed. QueueJob is the message the job was received with, nil if it was not
+// received from a queue.
 type ImageProcessJob struct {
 	Data     *ImageProcessJobData
-	QueueJob amqp.Delivery
+	QueueJob QueueMessage
+}
+
+// QueueMessage settles the message a job was received with.
+type QueueMessage interface {
+	// Ack removes the message from the queue.
+	Ack() error
+	// Reject parks the message in the dead letter queue without retrying it.
+	Reject() error
+	// Retry redelivers the message after an increasing delay, or parks it in the dead letter queue once the configured
+	// retries are exhausted.
+	Retry() error
 }
 
+// ImageProcessJobData is the job as queued. ID is assigned when the job is scheduled, if not already set, and is used
+// to query its status. If CallbackURL is set a signed JobReport is posted to it once the job finishes. Jobs of the same
+// shop with the same IdempotencyKey are processed once within the configured IMG_IDEMPOTENCY_WINDOW.
+// Images not processed by Deadline fail, if it is not set the job is given IMG_JOB_TIMEOUT once started. Each image is
+// given ImageTimeoutSeconds, or IMG_IMAGE_TIMEOUT if zero. DeleteImages are the keys of the files to remove, or folders
+// ending with a slash to remove everything under them.
 type ImageProcessJobData struct {
+	ID             string         `json:"id,omitempty"`
+	IdempotencyKey string         `json:"idempotencyKey,omitempty"`
+	CallbackURL    string         `json:"callbackURL,omitempty"`
 	ShopID         int            `json:"shopID"`
 	ImageExtension string         `json:"imageExtension"`
 	Images         []*ImageStruct `json:"images"`
 	DeleteImages   []string       `json:"deleteImages"`
+	PathTemplate   string         `json:"pathTemplate,omitempty"`
+	// Overwrite regenerates the variants that are already stored, e.g. because the original was replaced.
+	Overwrite bool `json:"overwrite,omitempty"`
+
+	Deadline            *time.Time `json:"deadline,omitempty"`
+	ImageTimeoutSeconds int        `json:"imageTimeoutSeconds,omitempty"`
 }
 
 // ImageStruct holds the information on how the image will be scaled and where it will be stored.
 // Only one of ScaleDimensionMax, CropDimensions should have value.
-// The image will be stored in the following folder structure:
+// The location of each image is defined by the path template of the job (see ImageProcessJobData.PathTemplate) or,
+// if that is not set, by the configured one. The default template results in the following folder structure:
 // If ScaleDimensionMax is set: /<shopID>/<ScaleDimensionMax>/<Name>
 // If CropDimensions is set: /<shopID>/<CropDimensions.X>x<CropDimensions.Y>/<Name>
 // If MinXMaxY is set: /<shopID>/minxmaxy/<MinXMaxY.X>x<MinXMaxY.Y>/<Name>
 // If MinYMaxX is set: /<shopID>/miny<MinYMaxX.X>maxx<MinYMaxX.Y>/<Name>
-// URL is the url from which the image will be downloaded
+// URL is the source of the image: an http(s) url, s3://bucket/key, a key of the cdn bucket, a file:// url inside the
+// configured IMG_FILE_SOURCES_DIR or a data: uri.
 // Name is the filename.
 type ImageStruct struct {
 	URL               string        `json:"url"`
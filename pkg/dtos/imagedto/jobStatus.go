@@ -0,0 +1,88 @@
+package imagedto
+
+import (
+	"time"
+)
+
+const (
+	JobStateQueued          JobState = "queued"
+	JobStateRunning         JobState = "running"
+	JobStateSucceeded       JobState = "succeeded"
+	JobStatePartiallyFailed JobState = "partiallyFailed"
+	JobStateFailed          JobState = "failed"
+	JobStateCancelled       JobState = "cancelled"
+	// JobStateCancelRequested is a job being cancelled by the instance running it.
+	JobStateCancelRequested JobState = "cancelRequested"
+)
+
+type JobState string
+
+// Valid reports whether the state is one of the known ones.
+func (s JobState) Valid() bool {
+	switch s {
+	case JobStateQueued, JobStateRunning, JobStateSucceeded, JobStatePartiallyFailed, JobStateFailed, JobStateCancelled,
+		JobStateCancelRequested:
+		return true
+	default:
+		return false
+	}
+}
+
+// Finished reports whether the job will not change state any more, unless it is redelivered by the queue.
+func (s JobState) Finished() bool {
+	switch s {
+	case JobStateSucceeded, JobStatePartiallyFailed, JobStateFailed, JobStateCancelled:
+		return true
+	default:
+		return false
+	}
+}
+
+// JobStatus is the progress of an ImageProcessJob. ProducedKeys are the keys stored by the job, images already on the
+// cdn are skipped and not reported. Errors holds one entry per failed image or variant. CallbackAttempts records every
+// delivery of the JobReport to CallbackURL.
+type JobStatus struct {
+	ID           string               `json:"id"`
+	ShopID       int                  `json:"shopID"`
+	Priority     PriorityType         `json:"priority,omitempty"`
+	State        JobState             `json:"state"`
+	Images       int                  `json:"images"`
+	CreatedAt    time.Time            `json:"createdAt"`
+	StartedAt    *time.Time           `json:"startedAt,omitempty"`
+	FinishedAt   *time.Time           `json:"finishedAt,omitempty"`
+	ProducedKeys []string             `json:"producedKeys"`
+	Errors       []*ProcessImageError `json:"errors"`
+
+	CallbackURL      string             `json:"callbackURL,omitempty"`
+	CallbackAttempts []*CallbackAttempt `json:"callbackAttempts,omitempty"`
+}
+
+// CallbackAttempt is a single delivery of a JobReport. StatusCode is zero if no response was received.
+type CallbackAttempt struct {
+	At         time.Time `json:"at"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// JobReport is the outcome of a finished job. It is posted, signed, to the callback url of the job, see package
+// webhooksigner, and published to the configured result exchange.
+type JobReport struct {
+	JobID        string               `json:"jobID"`
+	ShopID       int                  `json:"shopID"`
+	State        JobState             `json:"state"`
+	FinishedAt   *time.Time           `json:"finishedAt,omitempty"`
+	ProducedKeys []string             `json:"producedKeys"`
+	Errors       []*ProcessImageError `json:"errors"`
+}
+
+// ProcessImageError describes the failure of a single image or variant of a job.
+type ProcessImageError struct {
+	URL string `json:"url"`
+	Err string `json:"err"`
+	Msg string `json:"msg"`
+	Dim string `json:"dim"`
+}
+
+func (e *ProcessImageError) Error() string {
+	return "Err: " + e.Err + ", url: " + e.URL + ", dimensions: " + e.Dim + ", msg: " + e.Msg
+}
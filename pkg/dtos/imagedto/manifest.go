@@ -0,0 +1,31 @@
+package imagedto
+
+import (
+	"time"
+)
+
+// ManifestFileName is the name of the manifest stored next to the images of each product.
+const ManifestFileName = "manifest.json"
+
+// Manifest lists every variant stored for a product so that consumers do not have to reconstruct the URLs from the
+// path conventions.
+type Manifest struct {
+	ShopID    int                `json:"shopID"`
+	ProductID string             `json:"productID"`
+	UpdatedAt time.Time          `json:"updatedAt"`
+	Variants  []*ManifestVariant `json:"variants"`
+}
+
+// ManifestVariant describes a single stored image. Mode is one of original, scale, crop, minxmaxy, minymaxx.
+// SourceFingerprint is the hex encoded sha256 of the original image the variant was created from.
+type ManifestVariant struct {
+	Key               string `json:"key"`
+	URL               string `json:"url"`
+	Name              string `json:"name"`
+	Mode              string `json:"mode"`
+	Width             int    `json:"width"`
+	Height            int    `json:"height"`
+	Format            string `json:"format"`
+	Size              int    `json:"size"`
+	SourceFingerprint string `json:"sourceFingerprint"`
+}
@@ -2,10 +2,10 @@ package queueservice
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"sync"
 
-	"github.com/streadway/amqp"
-
 	"github.com/mikarios/golib/logger"
 
 	"github.com/mikarios/imageresizer/internal/queues"
@@ -14,13 +14,16 @@ import (
 )
 
 type Instance struct {
-	imagePublisher *queues.ImageQ
-	imageConsumer  *queues.ImageQ
+	imagePublisher  queues.Q
+	imageConsumer   queues.Q
+	resultPublisher queues.ResultQueue
 }
 
 var (
 	once     sync.Once
 	instance *Instance
+
+	errUnknownBroker = errors.New("unknown queue broker")
 )
 
 func GetInstance() *Instance {
@@ -31,29 +34,119 @@ func GetInstance() *Instance {
 	return instance
 }
 
+// Init connects to the broker selected by QUEUE_BROKER.
 func Init(imageP, imageC, statsP, statsC bool) *Instance {
-	var err error
-
 	cfg := config.GetInstance()
 
 	once.Do(func() {
+		queueCfg := queues.WithDefaults(&cfg.QueueConfig, cfg.ImageConfig.ConcurrentJobs())
+		var err error
+
 		instance = &Instance{}
-		if imageP {
-			if instance.imagePublisher, err = queues.ImagePublisher(&cfg.RabbitMQConfig); err != nil {
-				logger.Panic(context.Background(), err, "could not create publisher")
+
+		switch cfg.QueueConfig.Broker {
+		case queues.BrokerRabbitMQ, "":
+			err = instance.initRabbitMQ(cfg, queueCfg, imageP, imageC)
+		case queues.BrokerNATS:
+			if imageP || imageC {
+				err = instance.initNATS(cfg, queueCfg)
+			}
+		case queues.BrokerRedis:
+			if imageP || imageC {
+				err = instance.initRedis(cfg, queueCfg)
 			}
+		case queues.BrokerSQS:
+			if imageP || imageC {
+				err = instance.initSQS(cfg, queueCfg)
+			}
+		case queues.BrokerMemory:
+			memoryQ := queues.NewMemoryQ(queueCfg)
+			instance.imagePublisher, instance.imageConsumer = memoryQ, memoryQ
+		default:
+			err = fmt.Errorf("%w: %s", errUnknownBroker, cfg.QueueConfig.Broker)
 		}
 
-		if imageC {
-			if instance.imageConsumer, err = queues.ImageConsumer(&cfg.RabbitMQConfig); err != nil {
-				logger.Panic(context.Background(), err, "could not create consumer")
-			}
+		if err != nil {
+			logger.Panic(context.Background(), err, "could not connect to queue broker")
 		}
 	})
 
 	return instance
 }
 
+func (i *Instance) initRabbitMQ(cfg *config.Config, queueCfg *config.QueueConfig, imageP, imageC bool) error {
+	var err error
+
+	if imageP {
+		if i.imagePublisher, err = queues.ImagePublisher(&cfg.RabbitMQConfig, queueCfg); err != nil {
+			return fmt.Errorf("could not create publisher: %w", err)
+		}
+	}
+
+	if imageC {
+		if i.imageConsumer, err = queues.ImageConsumer(&cfg.RabbitMQConfig, queueCfg); err != nil {
+			return fmt.Errorf("could not create consumer: %w", err)
+		}
+
+		// consumers process the jobs so they report the results
+		if cfg.RabbitMQConfig.ResultExchange != "" {
+			if i.resultPublisher, err = queues.ResultPublisher(&cfg.RabbitMQConfig); err != nil {
+				return fmt.Errorf("could not create result publisher: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// initNATS uses a single connection for publishing, consuming and reporting results.
+func (i *Instance) initNATS(cfg *config.Config, queueCfg *config.QueueConfig) error {
+	natsQ, err := queues.NewNATSQ(&cfg.NATSConfig, queueCfg)
+	if err != nil {
+		return fmt.Errorf("could not connect to NATS: %w", err)
+	}
+
+	i.imagePublisher, i.imageConsumer = natsQ, natsQ
+
+	if cfg.NATSConfig.ResultSubject != "" {
+		i.resultPublisher = natsQ.ResultQueue(cfg.NATSConfig.ResultSubject)
+	}
+
+	return nil
+}
+
+// initRedis uses a single client for publishing, consuming and reporting results.
+func (i *Instance) initRedis(cfg *config.Config, queueCfg *config.QueueConfig) error {
+	redisQ, err := queues.NewRedisQ(&cfg.RedisConfig, queueCfg)
+	if err != nil {
+		return fmt.Errorf("could not connect to redis: %w", err)
+	}
+
+	i.imagePublisher, i.imageConsumer = redisQ, redisQ
+
+	if cfg.RedisConfig.ResultStream != "" {
+		i.resultPublisher = redisQ.ResultQueue(cfg.RedisConfig.ResultStream)
+	}
+
+	return nil
+}
+
+// initSQS uses a single client for publishing, consuming and reporting results.
+func (i *Instance) initSQS(cfg *config.Config, queueCfg *config.QueueConfig) error {
+	sqsQ, err := queues.NewSQSQ(&cfg.SQSConfig, queueCfg)
+	if err != nil {
+		return fmt.Errorf("could not connect to SQS: %w", err)
+	}
+
+	i.imagePublisher, i.imageConsumer = sqsQ, sqsQ
+
+	if cfg.SQSConfig.ResultQueueURL != "" {
+		i.resultPublisher = sqsQ.ResultQueue(cfg.SQSConfig.ResultQueueURL)
+	}
+
+	return nil
+}
+
 func Destroy() {
 	if instance.imagePublisher != nil {
 		instance.imagePublisher.Close()
@@ -62,12 +155,40 @@ func Destroy() {
 	if instance.imageConsumer != nil {
 		instance.imageConsumer.Close()
 	}
+
+	if instance.resultPublisher != nil {
+		instance.resultPublisher.Close()
+	}
 }
 
-func (i *Instance) ImagePublish(job *imagedto.ImageProcessJobData) error {
-	return i.imagePublisher.Publish(&queues.Job{ImageJob: job})
+// ImagePublish queues the job. Urgent jobs are delivered before the normal ones already waiting.
+func (i *Instance) ImagePublish(job *imagedto.ImageProcessJobData, priority imagedto.PriorityType) error {
+	return i.imagePublisher.Publish(&queues.Job{ImageJob: job, Priority: priority})
 }
 
-func (i *Instance) ImageConsume() (<-chan amqp.Delivery, error) {
+// ImageConsume returns the jobs of the image queue. Each message should be settled once handled.
+func (i *Instance) ImageConsume() (<-chan queues.Message, error) {
 	return i.imageConsumer.Consume()
 }
+
+// Ready reports whether every queue in use is connected to the broker.
+func (i *Instance) Ready() bool {
+	if i.imagePublisher != nil && !i.imagePublisher.Ready() {
+		return false
+	}
+
+	if i.imageConsumer != nil && !i.imageConsumer.Ready() {
+		return false
+	}
+
+	return i.resultPublisher == nil || i.resultPublisher.Ready()
+}
+
+// ResultPublish publishes the report of a finished job. Nothing is published if no result exchange is configured.
+func (i *Instance) ResultPublish(report *imagedto.JobReport) error {
+	if i.resultPublisher == nil {
+		return nil
+	}
+
+	return i.resultPublisher.Publish(report)
+}
@@ -0,0 +1,135 @@
+// Package urlsigner builds and verifies signed URLs of the on demand image route, /img/{options}/{key}. The signature
+// is an HMAC-SHA256 of the path, the expiry and the key id, so several keys can be active at the same time while they
+// are rotated.
+package urlsigner
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Query parameters carrying the signature.
+const (
+	ParamKeyID     = "kid"
+	ParamExpires   = "exp"
+	ParamSignature = "sig"
+)
+
+var (
+	ErrMissingSignature = errors.New("missing signature")
+	ErrUnknownKey       = errors.New("unknown signing key")
+	ErrInvalidSignature = errors.New("invalid signature")
+	ErrExpired          = errors.New("signature expired")
+	ErrInvalidKey       = errors.New("invalid signing key")
+)
+
+// Signer signs URLs with a single key.
+type Signer struct {
+	keyID  string
+	secret []byte
+}
+
+// New returns a signer using the given key. The key id is sent along with the signature so the verifier knows which of
+// its keys to check against.
+func New(keyID, secret string) (*Signer, error) {
+	if keyID == "" || secret == "" {
+		return nil, fmt.Errorf("%w: key id and secret are required", ErrInvalidKey)
+	}
+
+	return &Signer{keyID: keyID, secret: []byte(secret)}, nil
+}
+
+// ImagePath returns the path of the on demand route for the given options and key, e.g. "scale:300,format:png" and
+// "static/1/2/img.jpg".
+func ImagePath(options, key string) string {
+	return "/img/" + options + "/" + strings.TrimPrefix(key, "/")
+}
+
+// Sign returns the given path with the signature query parameters appended. If expires is zero the URL never expires.
+func (s *Signer) Sign(path string, expires time.Time) string {
+	query := url.Values{}
+	query.Set(ParamKeyID, s.keyID)
+
+	exp := ""
+	if !expires.IsZero() {
+		exp = strconv.FormatInt(expires.Unix(), 10)
+		query.Set(ParamExpires, exp)
+	}
+
+	query.Set(ParamSignature, signature(s.secret, path, exp, s.keyID))
+
+	return (&url.URL{Path: path, RawQuery: query.Encode()}).String()
+}
+
+// SignImageURL returns the signed URL of the on demand route of the server at baseURL, e.g.
+// SignImageURL("https://images.example.com", "scale:300", "static/1/2/img.jpg", time.Time{}).
+func (s *Signer) SignImageURL(baseURL, options, key string, expires time.Time) string {
+	return strings.TrimSuffix(baseURL, "/") + s.Sign(ImagePath(options, key), expires)
+}
+
+// Verifier verifies signatures created by any of its keys.
+type Verifier struct {
+	keys map[string][]byte
+}
+
+// NewVerifier returns a verifier accepting signatures of the given keys, mapped by key id.
+func NewVerifier(keys map[string]string) (*Verifier, error) {
+	v := &Verifier{keys: make(map[string][]byte, len(keys))}
+
+	for id, secret := range keys {
+		if id == "" || secret == "" {
+			return nil, fmt.Errorf("%w: key id and secret are required", ErrInvalidKey)
+		}
+
+		v.keys[id] = []byte(secret)
+	}
+
+	return v, nil
+}
+
+// Verify checks the signature found in query against the given unescaped path.
+func (v *Verifier) Verify(path string, query url.Values, now time.Time) error {
+	keyID, sig := query.Get(ParamKeyID), query.Get(ParamSignature)
+	if keyID == "" || sig == "" {
+		return ErrMissingSignature
+	}
+
+	secret, ok := v.keys[keyID]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownKey, keyID)
+	}
+
+	exp := query.Get(ParamExpires)
+	if !hmac.Equal([]byte(sig), []byte(signature(secret, path, exp, keyID))) {
+		return ErrInvalidSignature
+	}
+
+	if exp == "" {
+		return nil
+	}
+
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: malformed expiry %q", ErrInvalidSignature, exp)
+	}
+
+	if now.Unix() > expires {
+		return ErrExpired
+	}
+
+	return nil
+}
+
+func signature(secret []byte, path, exp, keyID string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(path + "\n" + exp + "\n" + keyID))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
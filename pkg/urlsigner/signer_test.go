@@ -0,0 +1,60 @@
+package urlsigner_test
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/mikarios/imageresizer/pkg/urlsigner"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1700000000, 0)
+
+	current, err := urlsigner.New("2023", "current-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	retired, err := urlsigner.New("2022", "retired-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifier, err := urlsigner.NewVerifier(map[string]string{"2023": "current-secret", "2024": "next-secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := urlsigner.ImagePath("scale:300", "static/a.jpg")
+
+	tests := map[string]struct {
+		signed string
+		want   error
+	}{
+		"no expiry":     {signed: current.Sign(urlsigner.ImagePath("scale:300", "static/a b.jpg"), time.Time{})},
+		"not expired":   {signed: current.Sign(path, now.Add(time.Minute))},
+		"expired":       {signed: current.Sign(path, now.Add(-time.Minute)), want: urlsigner.ErrExpired},
+		"retired key":   {signed: retired.Sign(path, time.Time{}), want: urlsigner.ErrUnknownKey},
+		"unsigned":      {signed: path, want: urlsigner.ErrMissingSignature},
+		"tampered path": {signed: tamper(current.Sign(path, time.Time{})), want: urlsigner.ErrInvalidSignature},
+	}
+
+	for name, tt := range tests {
+		u, err := url.Parse(tt.signed)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = verifier.Verify(u.Path, u.Query(), now); !errors.Is(err, tt.want) {
+			t.Errorf("%s: Verify(%q) error = %v, want %v", name, tt.signed, err, tt.want)
+		}
+	}
+}
+
+func tamper(signed string) string {
+	return "/img/scale:4000" + signed[len("/img/scale:300"):]
+}
@@ -0,0 +1,68 @@
+// Package webhooksigner signs and verifies the job completion callbacks sent by the image resizer. The signature is an
+// HMAC-SHA256 of the timestamp and the body, so receivers can reject both forged and replayed requests.
+package webhooksigner
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	HeaderTimestamp = "X-Imageresizer-Timestamp"
+	HeaderSignature = "X-Imageresizer-Signature"
+	signaturePrefix = "sha256="
+)
+
+var (
+	ErrMissingSignature = errors.New("missing signature")
+	ErrInvalidSignature = errors.New("invalid signature")
+	ErrExpired          = errors.New("signature expired")
+)
+
+// Sign returns the signature of the body sent at the given unix timestamp.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignRequest sets the timestamp and signature headers of the request carrying body.
+func SignRequest(req *http.Request, secret string, body []byte, now time.Time) {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderSignature, Sign(secret, timestamp, body))
+}
+
+// Verify checks the signature headers against the body. Requests signed more than tolerance ago are rejected, unless
+// tolerance is zero.
+func Verify(secret string, header http.Header, body []byte, now time.Time, tolerance time.Duration) error {
+	timestamp, signature := header.Get(HeaderTimestamp), header.Get(HeaderSignature)
+	if timestamp == "" || !strings.HasPrefix(signature, signaturePrefix) {
+		return ErrMissingSignature
+	}
+
+	if !hmac.Equal([]byte(signature), []byte(Sign(secret, timestamp, body))) {
+		return ErrInvalidSignature
+	}
+
+	sent, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: malformed timestamp %q", ErrInvalidSignature, timestamp)
+	}
+
+	if tolerance > 0 && now.Sub(time.Unix(sent, 0)) > tolerance {
+		return ErrExpired
+	}
+
+	return nil
+}
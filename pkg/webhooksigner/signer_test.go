@@ -0,0 +1,47 @@
+package webhooksigner_test
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mikarios/imageresizer/pkg/webhooksigner"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1700000000, 0)
+	body := []byte(`{"jobID":"1"}`)
+
+	req, err := http.NewRequest(http.MethodPost, "http://localhost/callback", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	webhooksigner.SignRequest(req, "secret", body, now)
+
+	tests := map[string]struct {
+		secret string
+		body   []byte
+		now    time.Time
+		want   error
+	}{
+		"valid":         {secret: "secret", body: body, now: now.Add(time.Minute)},
+		"wrong secret":  {secret: "other", body: body, now: now, want: webhooksigner.ErrInvalidSignature},
+		"tampered body": {secret: "secret", body: []byte(`{"jobID":"2"}`), now: now, want: webhooksigner.ErrInvalidSignature},
+		"replayed":      {secret: "secret", body: body, now: now.Add(time.Hour), want: webhooksigner.ErrExpired},
+	}
+
+	for name, tt := range tests {
+		if err = webhooksigner.Verify(tt.secret, req.Header, tt.body, tt.now, 5*time.Minute); !errors.Is(err, tt.want) {
+			t.Errorf("%s: Verify() error = %v, want %v", name, err, tt.want)
+		}
+	}
+
+	err = webhooksigner.Verify("secret", http.Header{}, body, now, 0)
+	if !errors.Is(err, webhooksigner.ErrMissingSignature) {
+		t.Errorf("unsigned: Verify() error = %v, want %v", err, webhooksigner.ErrMissingSignature)
+	}
+}